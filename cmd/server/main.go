@@ -1,24 +1,32 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/baliboy20/smtp_server_go/internal/api"
 	"github.com/baliboy20/smtp_server_go/internal/config"
+	"github.com/baliboy20/smtp_server_go/internal/imap"
+	"github.com/baliboy20/smtp_server_go/internal/logging"
+	"github.com/baliboy20/smtp_server_go/internal/pop3"
 	"github.com/baliboy20/smtp_server_go/internal/smtp"
 	"github.com/baliboy20/smtp_server_go/internal/storage"
 	_ "github.com/joho/godotenv/autoload"
 )
 
 func main() {
-	log.Println("Starting SMTP Server...")
-
 	// Load configuration
 	cfg := config.LoadConfig()
 
+	// Initialize logging
+	if err := logging.Setup(cfg); err != nil {
+		fatal("Failed to initialize logging", err)
+	}
+
+	slog.Info("Starting SMTP Server...")
+
 	// Initialize storage
 	var store storage.Storage
 	var err error
@@ -26,45 +34,87 @@ func main() {
 	if cfg.StorageType == "file" {
 		store, err = storage.NewFileStorage(cfg.StorageFile, cfg.MaxEmails, cfg.ServerStarted)
 		if err != nil {
-			log.Fatalf("Failed to initialize file storage: %v", err)
+			fatal("Failed to initialize file storage", err)
 		}
-		log.Printf("Using file storage: %s", cfg.StorageFile)
+		slog.Info("Using file storage", "file", cfg.StorageFile)
 	} else {
 		store = storage.NewMemoryStorage(cfg.MaxEmails, cfg.ServerStarted)
-		log.Println("Using in-memory storage")
+		slog.Info("Using in-memory storage")
 	}
 
+	store = storage.NewInstrumentedStorage(store)
+
 	// Initialize SMTP server
-	smtpServer := smtp.NewServer(cfg, store)
+	smtpServer, err := smtp.NewServer(cfg, store)
+	if err != nil {
+		fatal("Failed to initialize SMTP server", err)
+	}
 
 	// Initialize API server
-	apiServer := api.NewServer(cfg, store, smtpServer)
+	apiServer, err := api.NewServer(cfg, store, smtpServer)
+	if err != nil {
+		fatal("Failed to initialize API server", err)
+	}
 
 	// Start SMTP server in goroutine
 	go func() {
 		if err := smtpServer.Start(); err != nil {
-			log.Fatalf("SMTP server error: %v", err)
+			fatal("SMTP server error", err)
 		}
 	}()
 
+	// Start IMAP server in goroutine
+	var imapServer *imap.Server
+	if cfg.EnableIMAP {
+		imapServer = imap.NewServer(cfg, store)
+		go func() {
+			if err := imapServer.Start(); err != nil {
+				fatal("IMAP server error", err)
+			}
+		}()
+	}
+
+	// Start POP3 server in goroutine
+	var pop3Server *pop3.Server
+	if cfg.EnablePOP3 {
+		pop3Server = pop3.NewServer(cfg, store)
+		go func() {
+			if err := pop3Server.Start(); err != nil {
+				fatal("POP3 server error", err)
+			}
+		}()
+	}
+
 	// Start API server in goroutine
 	go func() {
 		if err := apiServer.Start(); err != nil {
-			log.Fatalf("API server error: %v", err)
+			fatal("API server error", err)
 		}
 	}()
 
-	log.Println("Server started successfully!")
-	log.Printf("SMTP Server: %s:%s", cfg.SMTPHost, cfg.SMTPPort)
-	log.Printf("API Server: http://%s:%s", cfg.APIHost, cfg.APIPort)
-	log.Printf("Health Check: http://%s:%s/health", cfg.APIHost, cfg.APIPort)
+	slog.Info("Server started successfully",
+		"smtp", cfg.SMTPHost+":"+cfg.SMTPPort,
+		"api", "http://"+cfg.APIHost+":"+cfg.APIPort,
+		"health", "http://"+cfg.APIHost+":"+cfg.APIPort+"/health")
 
 	// Wait for interrupt signal to gracefully shut down
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server...")
 	smtpServer.Stop()
-	log.Println("Server stopped")
+	if imapServer != nil {
+		imapServer.Stop()
+	}
+	if pop3Server != nil {
+		pop3Server.Stop()
+	}
+	slog.Info("Server stopped")
+}
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
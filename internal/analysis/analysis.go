@@ -0,0 +1,570 @@
+// Package analysis inspects captured emails the way a QA engineer would:
+// links, images, how well clients support the HTML and CSS, and the
+// one-time codes and verification links a test has to follow
+package analysis
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/mimeparse"
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+const (
+	// GmailClipSize is the HTML size above which Gmail clips a message
+	GmailClipSize = 102 * 1024
+	// MaxMessageSize is the size above which many providers reject a message
+	MaxMessageSize = 10 * 1024 * 1024
+)
+
+// Link and image issues
+const (
+	IssueEmptyURL    = "empty_url"
+	IssuePlaceholder = "placeholder_url" // "#"
+	IssueJavaScript  = "javascript_url"
+	IssueInvalidURL  = "invalid_url"
+	IssueInsecure    = "insecure" // plain http
+	IssueMismatch    = "text_mismatch"
+	IssueLocalHost   = "local_host"
+	IssueShortener   = "url_shortener"
+	IssueMissingAlt  = "missing_alt"
+	IssueMissingSrc  = "missing_src"
+	IssueUnresolved  = "unresolved_cid"
+	IssueDataURI     = "data_uri"
+	IssueTracking    = "tracking_pixel"
+)
+
+// Report is the result of analysing an email
+type Report struct {
+	EmailID  string    `json:"email_id"`
+	Parts    Parts     `json:"parts"`
+	Size     Size      `json:"size"`
+	Links    []Link    `json:"links"`
+	Images   []Image   `json:"images"`
+	CSS      []Feature `json:"css"`
+	Elements []Feature `json:"elements"`
+	Warnings []Warning `json:"warnings"`
+}
+
+// Parts tells which parts a message has
+type Parts struct {
+	Text         bool `json:"text"`
+	HTML         bool `json:"html"`
+	Attachments  int  `json:"attachments"`
+	InlineImages int  `json:"inline_images"`
+}
+
+// Size is the size of a message and its parts in bytes
+type Size struct {
+	Total       int64 `json:"total"`
+	Text        int   `json:"text"`
+	HTML        int   `json:"html"`
+	Attachments int64 `json:"attachments"`
+}
+
+// Link is a link in the HTML part
+type Link struct {
+	URL    string   `json:"url"`
+	Text   string   `json:"text"`
+	Issues []string `json:"issues,omitempty"`
+}
+
+// Image is an image in the HTML part
+type Image struct {
+	Src    string `json:"src"`
+	Alt    string `json:"alt"`
+	HasAlt bool   `json:"has_alt"`
+	Width  string `json:"width,omitempty"`
+	Height string `json:"height,omitempty"`
+	// Attachment names the attachment a cid: URL resolves to
+	Attachment string   `json:"attachment,omitempty"`
+	Issues     []string `json:"issues,omitempty"`
+
+	hidden bool // by its style
+}
+
+// Feature is a CSS feature or HTML element with poor client support
+type Feature struct {
+	Name    string `json:"name"`
+	Count   int    `json:"count"`
+	Support string `json:"support"`
+}
+
+// Warning is a problem worth a look
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Count   int    `json:"count,omitempty"`
+}
+
+// cssFeatures are looked for in style elements and attributes
+var cssFeatures = []struct {
+	name    string
+	pattern *regexp.Regexp
+	support string
+}{
+	{"position", regexp.MustCompile(`(?i)\bposition\s*:\s*(absolute|fixed|relative|sticky)`), "Ignored by Gmail and Outlook for Windows"},
+	{"display: flex", regexp.MustCompile(`(?i)\bdisplay\s*:\s*(inline-)?flex\b`), "Not supported by Outlook for Windows"},
+	{"display: grid", regexp.MustCompile(`(?i)\bdisplay\s*:\s*(inline-)?grid\b`), "Not supported by Gmail or Outlook"},
+	{"float", regexp.MustCompile(`(?i)(^|[\s;{"])float\s*:`), "Not supported by Outlook for Windows"},
+	{"background-image", regexp.MustCompile(`(?i)\bbackground(-image)?\s*:[^;}]*url\(`), "Not supported by Outlook for Windows"},
+	{"max-width", regexp.MustCompile(`(?i)\bmax-width\s*:`), "Not supported by Outlook for Windows"},
+	{"border-radius", regexp.MustCompile(`(?i)\bborder-radius\s*:`), "Not supported by Outlook for Windows"},
+	{"box-shadow", regexp.MustCompile(`(?i)\bbox-shadow\s*:`), "Not supported by Gmail or Outlook"},
+	{"transform", regexp.MustCompile(`(?i)\btransform\s*:`), "Not supported by Gmail or Outlook"},
+	{"animation", regexp.MustCompile(`(?i)(\banimation(-name)?\s*:|@keyframes\b)`), "Not supported by Gmail or Outlook"},
+	{"calc()", regexp.MustCompile(`(?i)\bcalc\(`), "Not supported by Outlook for Windows"},
+	{"var()", regexp.MustCompile(`(?i)\bvar\(\s*--`), "Not supported by Gmail or Outlook"},
+	{":hover", regexp.MustCompile(`(?i):hover\b`), "Not supported by Outlook or the Gmail apps"},
+	{"@media", regexp.MustCompile(`(?i)@media\b`), "Not supported by Outlook for Windows and some webmail"},
+	{"@font-face", regexp.MustCompile(`(?i)@font-face\b`), "Web fonts are ignored by Gmail and Outlook"},
+	{"@import", regexp.MustCompile(`(?i)@import\b`), "Not supported by Gmail or Outlook"},
+}
+
+// elementSupport lists elements that most clients strip or ignore
+var elementSupport = map[string]string{
+	"script": "Removed by every email client",
+	"form":   "Not supported by Gmail or Outlook",
+	"input":  "Not supported by Gmail or Outlook",
+	"button": "Rendered without behaviour by most clients",
+	"iframe": "Removed by every major email client",
+	"video":  "Only supported by Apple Mail",
+	"audio":  "Only supported by Apple Mail",
+	"embed":  "Removed by every major email client",
+	"object": "Removed by every major email client",
+	"svg":    "Not supported by Gmail or Outlook",
+	"canvas": "Removed by every major email client",
+}
+
+// elementOrder keeps the report stable
+var elementOrder = []string{"script", "form", "input", "button", "iframe", "video", "audio", "embed", "object", "svg", "canvas"}
+
+// issueText describes link and image issues in warnings
+var issueText = map[string]string{
+	IssueEmptyURL:    "have no URL",
+	IssuePlaceholder: "point at a placeholder (#)",
+	IssueJavaScript:  "use javascript: URLs",
+	IssueInvalidURL:  "have invalid URLs",
+	IssueInsecure:    "use plain http",
+	IssueMismatch:    "show a URL other than the one they lead to",
+	IssueLocalHost:   "point at a local host",
+	IssueShortener:   "use a URL shortener",
+	IssueMissingAlt:  "have no alt text",
+	IssueMissingSrc:  "have no source",
+	IssueUnresolved:  "reference a cid: attachment that is missing",
+	IssueDataURI:     "are data: URIs, which Gmail and Outlook block",
+	IssueTracking:    "look like tracking pixels",
+}
+
+var linkIssues = []string{IssueEmptyURL, IssuePlaceholder, IssueJavaScript, IssueInvalidURL, IssueInsecure, IssueMismatch, IssueLocalHost, IssueShortener}
+var imageIssues = []string{IssueMissingSrc, IssueMissingAlt, IssueUnresolved, IssueDataURI, IssueInsecure, IssueTracking}
+
+// shorteners are URL shortening services
+var shorteners = map[string]bool{
+	"bit.ly": true, "tinyurl.com": true, "goo.gl": true, "t.co": true, "ow.ly": true,
+	"is.gd": true, "v.gd": true, "buff.ly": true, "rebrand.ly": true, "cutt.ly": true,
+	"shorturl.at": true, "tiny.cc": true, "bl.ink": true, "t.ly": true, "rb.gy": true,
+	"s.id": true, "lnkd.in": true, "soo.gd": true, "x.co": true, "qr.ae": true,
+}
+
+// IsShortener reports whether host belongs to a URL shortening service
+func IsShortener(host string) bool {
+	return shorteners[strings.TrimPrefix(strings.ToLower(host), "www.")]
+}
+
+// Content returns the text, HTML and attachments of an email. Emails
+// stored before bodies were split into parts are parsed from the raw
+// message.
+func Content(email *models.Email) *mimeparse.Content {
+	if email.HTML == "" && len(email.Attachments) == 0 && email.Raw != "" {
+		if msg, err := mail.ReadMessage(strings.NewReader(email.Raw)); err == nil {
+			if body, err := io.ReadAll(msg.Body); err == nil {
+				return mimeparse.Parse(msg.Header, body)
+			}
+		}
+	}
+	return &mimeparse.Content{Text: email.Body, HTML: email.HTML, Attachments: email.Attachments}
+}
+
+// Analyze reports on the parts, links, images and client support of an
+// email
+func Analyze(email *models.Email) *Report {
+	c := Content(email)
+	r := &Report{
+		EmailID:  email.ID,
+		Links:    []Link{},
+		Images:   []Image{},
+		CSS:      []Feature{},
+		Elements: []Feature{},
+		Warnings: []Warning{},
+	}
+
+	r.Parts.Text = strings.TrimSpace(c.Text) != ""
+	r.Parts.HTML = strings.TrimSpace(c.HTML) != ""
+	r.Size = Size{Total: email.Size, Text: len(c.Text), HTML: len(c.HTML)}
+	if r.Size.Total == 0 {
+		r.Size.Total = int64(len(email.Raw))
+	}
+	for _, a := range c.Attachments {
+		r.Size.Attachments += a.Size
+		if a.Inline && strings.HasPrefix(a.ContentType, "image/") {
+			r.Parts.InlineImages++
+		} else {
+			r.Parts.Attachments++
+		}
+	}
+
+	doc := parseDocument(c.HTML)
+	for _, link := range doc.links {
+		link.Issues = checkLink(link)
+		r.Links = append(r.Links, link)
+	}
+	used := map[string]bool{}
+	for _, img := range doc.images {
+		img.Issues = checkImage(&img, c.Attachments, used)
+		r.Images = append(r.Images, img)
+	}
+
+	css := doc.css.String()
+	for _, f := range cssFeatures {
+		if n := len(f.pattern.FindAllStringIndex(css, -1)); n > 0 {
+			r.CSS = append(r.CSS, Feature{Name: f.name, Count: n, Support: f.support})
+		}
+	}
+	if doc.stylesheets > 0 {
+		r.CSS = append(r.CSS, Feature{Name: "external stylesheet", Count: doc.stylesheets, Support: "Removed by nearly every email client"})
+	}
+	for _, name := range elementOrder {
+		if n := doc.elements[name]; n > 0 {
+			r.Elements = append(r.Elements, Feature{Name: name, Count: n, Support: elementSupport[name]})
+		}
+	}
+
+	r.Warnings = warnings(r, c.Attachments, used)
+	return r
+}
+
+func warnings(r *Report, attachments []models.Attachment, used map[string]bool) []Warning {
+	var list []Warning
+	add := func(code string, count int, format string, args ...interface{}) {
+		list = append(list, Warning{Code: code, Count: count, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case !r.Parts.Text && !r.Parts.HTML:
+		add("no_body", 0, "The message has no text or HTML body")
+	case !r.Parts.Text:
+		add("no_text_part", 0, "There is no plain-text alternative to the HTML part")
+	case !r.Parts.HTML:
+		add("no_html_part", 0, "There is no HTML part; clients will show the plain text")
+	}
+	if r.Size.HTML > GmailClipSize {
+		add("html_clipped", 0, "The HTML part is %s; Gmail clips messages with more than %s of HTML", formatSize(int64(r.Size.HTML)), formatSize(GmailClipSize))
+	}
+	if r.Size.Total > MaxMessageSize {
+		add("message_too_large", 0, "The message is %s; many providers reject messages over %s", formatSize(r.Size.Total), formatSize(MaxMessageSize))
+	}
+
+	counts := map[string]int{}
+	for _, link := range r.Links {
+		for _, issue := range link.Issues {
+			counts["link:"+issue]++
+		}
+	}
+	for _, img := range r.Images {
+		for _, issue := range img.Issues {
+			counts["image:"+issue]++
+		}
+	}
+	for _, issue := range linkIssues {
+		if n := counts["link:"+issue]; n > 0 {
+			add("link_"+issue, n, "%d of %d %s %s", n, len(r.Links), plural(len(r.Links), "link"), issueText[issue])
+		}
+	}
+	for _, issue := range imageIssues {
+		if n := counts["image:"+issue]; n > 0 {
+			add("image_"+issue, n, "%d of %d %s %s", n, len(r.Images), plural(len(r.Images), "image"), issueText[issue])
+		}
+	}
+
+	unused := 0
+	for _, a := range attachments {
+		if a.Inline && a.ContentID != "" && !used[strings.ToLower(a.ContentID)] {
+			unused++
+		}
+	}
+	if unused > 0 && r.Parts.HTML {
+		add("unused_inline_image", unused, "%d inline %s not referenced from the HTML", unused, plural(unused, "attachment is", "attachments are"))
+	}
+	if n := len(r.CSS); n > 0 {
+		add("unsupported_css", n, "%d CSS %s poor client support", n, plural(n, "feature has", "features have"))
+	}
+	if n := len(r.Elements); n > 0 {
+		add("unsupported_elements", n, "%d HTML %s poor client support", n, plural(n, "element has", "elements have"))
+	}
+
+	if list == nil {
+		return []Warning{}
+	}
+	return list
+}
+
+// document is what an HTML part is made of, as far as the analysis cares
+type document struct {
+	links       []Link
+	images      []Image
+	css         strings.Builder // style elements and attributes
+	elements    map[string]int
+	stylesheets int
+	text        strings.Builder
+}
+
+func parseDocument(doc string) *document {
+	d := &document{elements: map[string]int{}}
+	var anchor *Link
+	var anchorText strings.Builder
+	closeAnchor := func() {
+		if anchor != nil {
+			anchor.Text = collapse(anchorText.String())
+			d.links = append(d.links, *anchor)
+			anchor = nil
+		}
+	}
+
+	onTag := func(t tag) {
+		d.text.WriteByte(' ')
+		if t.end {
+			if t.name == "a" {
+				closeAnchor()
+			}
+			return
+		}
+		d.elements[t.name]++
+		if style, ok := t.attrs["style"]; ok {
+			d.css.WriteString(style)
+			d.css.WriteString(";\n")
+		}
+
+		switch t.name {
+		case "a":
+			closeAnchor()
+			if href, ok := t.attrs["href"]; ok {
+				anchor = &Link{URL: strings.TrimSpace(href)}
+				anchorText.Reset()
+			}
+		case "area":
+			if href, ok := t.attrs["href"]; ok {
+				d.links = append(d.links, Link{URL: strings.TrimSpace(href), Text: collapse(t.attrs["alt"])})
+			}
+		case "img":
+			alt, hasAlt := t.attrs["alt"]
+			img := Image{
+				Src:    strings.TrimSpace(t.attrs["src"]),
+				Alt:    collapse(alt),
+				HasAlt: hasAlt,
+				Width:  dimension(t, "width"),
+				Height: dimension(t, "height"),
+				hidden: styleHidden.MatchString(t.attrs["style"]),
+			}
+			d.images = append(d.images, img)
+			if anchor != nil {
+				anchorText.WriteString(" " + alt + " ")
+			}
+		case "link":
+			if strings.EqualFold(strings.TrimSpace(t.attrs["rel"]), "stylesheet") {
+				d.stylesheets++
+			}
+		}
+	}
+	onText := func(text string) {
+		d.text.WriteString(text)
+		if anchor != nil {
+			anchorText.WriteString(text)
+		}
+	}
+	onRaw := func(name, text string) {
+		if name == "style" {
+			d.css.WriteString(text)
+			d.css.WriteString("\n")
+		}
+	}
+
+	scanHTML(doc, onTag, onText, onRaw)
+	closeAnchor()
+	return d
+}
+
+var (
+	styleWidth  = regexp.MustCompile(`(?i)(?:^|;)\s*width\s*:\s*([0-9.]+)(px)?\s*(?:;|$)`)
+	styleHeight = regexp.MustCompile(`(?i)(?:^|;)\s*height\s*:\s*([0-9.]+)(px)?\s*(?:;|$)`)
+	styleHidden = regexp.MustCompile(`(?i)(display\s*:\s*none|visibility\s*:\s*hidden|opacity\s*:\s*0(\.0*)?\s*(;|$))`)
+)
+
+// dimension returns an image's width or height from its attribute or,
+// failing that, its style
+func dimension(t tag, name string) string {
+	if v := strings.TrimSpace(t.attrs[name]); v != "" {
+		return v
+	}
+	pattern := styleWidth
+	if name == "height" {
+		pattern = styleHeight
+	}
+	if m := pattern.FindStringSubmatch(t.attrs["style"]); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+func checkLink(link Link) []string {
+	var issues []string
+	lower := strings.ToLower(link.URL)
+	switch {
+	case link.URL == "":
+		return []string{IssueEmptyURL}
+	case strings.HasPrefix(link.URL, "#"):
+		return []string{IssuePlaceholder}
+	case strings.HasPrefix(lower, "javascript:"):
+		return []string{IssueJavaScript}
+	}
+
+	u, err := url.Parse(link.URL)
+	if err != nil || (u.Scheme == "" && u.Host == "") {
+		return []string{IssueInvalidURL}
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil // mailto:, tel: and the like
+	}
+	if u.Host == "" {
+		return []string{IssueInvalidURL}
+	}
+	if u.Scheme == "http" {
+		issues = append(issues, IssueInsecure)
+	}
+	if isLocalHost(u.Hostname()) {
+		issues = append(issues, IssueLocalHost)
+	}
+	if IsShortener(u.Hostname()) {
+		issues = append(issues, IssueShortener)
+	}
+	if shown := textHost(link.Text); shown != "" && !sameSite(shown, u.Hostname()) {
+		issues = append(issues, IssueMismatch)
+	}
+	return issues
+}
+
+func checkImage(img *Image, attachments []models.Attachment, used map[string]bool) []string {
+	var issues []string
+	lower := strings.ToLower(img.Src)
+	switch {
+	case img.Src == "":
+		issues = append(issues, IssueMissingSrc)
+	case strings.HasPrefix(lower, "cid:"):
+		id, err := url.PathUnescape(img.Src[4:])
+		if err != nil {
+			id = img.Src[4:]
+		}
+		id = strings.Trim(id, "<>")
+		for _, a := range attachments {
+			if strings.EqualFold(a.ContentID, id) {
+				img.Attachment = a.Filename
+				if img.Attachment == "" {
+					img.Attachment = a.ContentID
+				}
+				used[strings.ToLower(a.ContentID)] = true
+				break
+			}
+		}
+		if img.Attachment == "" {
+			issues = append(issues, IssueUnresolved)
+		}
+	case strings.HasPrefix(lower, "data:"):
+		issues = append(issues, IssueDataURI)
+	case strings.HasPrefix(lower, "http:"):
+		issues = append(issues, IssueInsecure)
+	}
+	if !img.HasAlt {
+		issues = append(issues, IssueMissingAlt)
+	}
+	if strings.HasPrefix(lower, "http") && (img.hidden || isTiny(img.Width) && isTiny(img.Height)) {
+		issues = append(issues, IssueTracking)
+	}
+	return issues
+}
+
+// isTiny reports whether an image dimension is at most a pixel
+func isTiny(v string) bool {
+	n, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "px"), 64)
+	return err == nil && n <= 1
+}
+
+// textHost returns the host of link text that looks like a URL or domain
+func textHost(text string) string {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.ContainsAny(text, " \t") || !strings.Contains(text, ".") {
+		return ""
+	}
+	if !strings.Contains(text, "://") {
+		text = "http://" + text
+	}
+	u, err := url.Parse(text)
+	if err != nil || u.Hostname() == "" || strings.Contains(u.Hostname(), "@") {
+		return ""
+	}
+	host := u.Hostname()
+	tld := host[strings.LastIndexByte(host, '.')+1:]
+	if len(tld) < 2 || strings.IndexFunc(tld, func(r rune) bool { return r < 'a' || r > 'z' }) >= 0 {
+		return "" // "v1.2", "Step 1." and the like
+	}
+	return strings.ToLower(host)
+}
+
+// sameSite reports whether two hosts are the same, or one is a
+// subdomain of the other
+func sameSite(a, b string) bool {
+	a = strings.TrimPrefix(strings.ToLower(a), "www.")
+	b = strings.TrimPrefix(strings.ToLower(b), "www.")
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+func isLocalHost(host string) bool {
+	host = strings.ToLower(host)
+	switch host {
+	case "localhost", "127.0.0.1", "::1", "0.0.0.0":
+		return true
+	}
+	return strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".local") || strings.HasPrefix(host, "127.")
+}
+
+// collapse trims text and collapses runs of white space
+func collapse(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// plural picks the singular or plural form; with one form, an "s" is
+// appended for the plural
+func plural(n int, forms ...string) string {
+	if n == 1 {
+		return forms[0]
+	}
+	if len(forms) > 1 {
+		return forms[1]
+	}
+	return forms[0] + "s"
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.0f KB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
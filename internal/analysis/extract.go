@@ -0,0 +1,167 @@
+package analysis
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// Extractor types
+const (
+	ExtractOTP   = "otp"   // numeric one-time codes
+	ExtractURL   = "url"   // links, optionally to one host
+	ExtractRegex = "regex" // a regular expression
+)
+
+// Extractor pulls values out of the decoded text and HTML of an email
+type Extractor struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Pattern is the expression of a regex extractor. The value is the
+	// first group, or the whole match when there is none.
+	Pattern string `json:"pattern,omitempty"`
+	Host    string `json:"host,omitempty"`   // url: this host and its subdomains only
+	Digits  int    `json:"digits,omitempty"` // otp: exact length; 4 to 8 when zero
+
+	re *regexp.Regexp
+}
+
+// Extracted is what one extractor found
+type Extracted struct {
+	Type   string            `json:"type"`
+	Value  string            `json:"value,omitempty"` // the first value
+	Values []string          `json:"values"`
+	Groups map[string]string `json:"groups,omitempty"` // named groups of the first match
+}
+
+// Compile checks an extractor and prepares it for use
+func (e *Extractor) Compile() error {
+	if e.Type == "" && e.Pattern != "" {
+		e.Type = ExtractRegex
+	}
+	switch e.Type {
+	case ExtractOTP:
+		if e.Digits < 0 || e.Digits > 12 {
+			return fmt.Errorf("invalid digits %d", e.Digits)
+		}
+	case ExtractURL:
+		e.Host = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e.Host), "."))
+	case ExtractRegex:
+		re, err := regexp.Compile(e.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", e.Pattern, err)
+		}
+		e.re = re
+	default:
+		return fmt.Errorf("unknown extractor type %q", e.Type)
+	}
+	if e.Name == "" {
+		e.Name = e.Type
+	}
+	return nil
+}
+
+// Extract runs compiled extractors on an email, keyed by extractor name
+func Extract(email *models.Email, extractors []*Extractor) map[string]*Extracted {
+	c := Content(email)
+	doc := parseDocument(c.HTML)
+	subject := decodeSubject(email.Subject)
+	htmlText := collapse(doc.text.String())
+
+	results := make(map[string]*Extracted, len(extractors))
+	for _, e := range extractors {
+		res := &Extracted{Type: e.Type, Values: []string{}}
+		seen := map[string]bool{}
+		add := func(value string) {
+			if value != "" && !seen[value] {
+				seen[value] = true
+				res.Values = append(res.Values, value)
+			}
+		}
+
+		switch e.Type {
+		case ExtractOTP:
+			texts := []string{subject, c.Text, htmlText}
+			for _, text := range texts {
+				for _, code := range findCodes(collapse(textURL.ReplaceAllString(text, " "))) {
+					if isDigits(code.Value) && (e.Digits == 0 || len(code.Value) == e.Digits) {
+						add(code.Value)
+					}
+				}
+			}
+			if len(res.Values) == 0 && e.Digits > 0 {
+				// No code next to a keyword; settle for any number that long
+				exact := regexp.MustCompile(fmt.Sprintf(`\b\d{%d}\b`, e.Digits))
+				for _, text := range texts {
+					for _, match := range exact.FindAllString(textURL.ReplaceAllString(text, " "), -1) {
+						add(match)
+					}
+				}
+			}
+		case ExtractURL:
+			var urls []string
+			for _, link := range doc.links {
+				urls = append(urls, link.URL)
+			}
+			for _, match := range textURL.FindAllString(c.Text, -1) {
+				urls = append(urls, strings.TrimRight(match, ".,;:!?"))
+			}
+			for _, raw := range urls {
+				if u, err := url.Parse(raw); err == nil && (u.Scheme == "http" || u.Scheme == "https") && matchHost(u.Hostname(), e.Host) {
+					add(raw)
+				}
+			}
+		case ExtractRegex:
+			for _, text := range []string{subject, c.Text, htmlText, c.HTML} {
+				for _, m := range e.re.FindAllStringSubmatch(text, -1) {
+					value := m[0]
+					if len(m) > 1 {
+						value = m[1]
+					}
+					if len(res.Values) == 0 && value != "" {
+						res.Groups = namedGroups(e.re, m)
+					}
+					add(value)
+				}
+			}
+		}
+
+		if len(res.Values) > 0 {
+			res.Value = res.Values[0]
+		}
+		results[e.Name] = res
+	}
+	return results
+}
+
+// matchHost reports whether host is want or one of its subdomains; an
+// empty want matches any host
+func matchHost(host, want string) bool {
+	host = strings.ToLower(host)
+	return want == "" || host == want || strings.HasSuffix(host, "."+want)
+}
+
+func namedGroups(re *regexp.Regexp, match []string) map[string]string {
+	var groups map[string]string
+	for i, name := range re.SubexpNames() {
+		if name != "" && i < len(match) {
+			if groups == nil {
+				groups = map[string]string{}
+			}
+			groups[name] = match[i]
+		}
+	}
+	return groups
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,160 @@
+package analysis
+
+import (
+	"html"
+	"strings"
+)
+
+// tag is a start or end tag with its attributes
+type tag struct {
+	name        string // lower case
+	end         bool
+	selfClosing bool
+	attrs       map[string]string // lower-case names, unescaped values
+}
+
+// rawTextElements hold text that is not markup
+var rawTextElements = map[string]bool{"script": true, "style": true, "title": true, "textarea": true}
+
+// scanHTML walks a document, calling onTag for every tag and onText for
+// the unescaped text between tags. The text of script, style and similar
+// elements is passed to onRaw instead. It is forgiving: anything that
+// does not look like a tag is text, as browsers treat it.
+func scanHTML(doc string, onTag func(t tag), onText func(text string), onRaw func(name, text string)) {
+	for i := 0; i < len(doc); {
+		lt := strings.IndexByte(doc[i:], '<')
+		if lt < 0 {
+			onText(html.UnescapeString(doc[i:]))
+			return
+		}
+		if lt > 0 {
+			onText(html.UnescapeString(doc[i : i+lt]))
+		}
+		i += lt
+
+		rest := doc[i:]
+		switch {
+		case strings.HasPrefix(rest, "<!--"):
+			end := strings.Index(rest[4:], "-->")
+			if end < 0 {
+				return
+			}
+			i += 4 + end + 3
+			continue
+		case strings.HasPrefix(rest, "<!") || strings.HasPrefix(rest, "<?"):
+			end := strings.IndexByte(rest, '>')
+			if end < 0 {
+				return
+			}
+			i += end + 1
+			continue
+		}
+
+		t, n := readTag(rest)
+		if n == 0 {
+			onText("<")
+			i++
+			continue
+		}
+		i += n
+		onTag(t)
+
+		if rawTextElements[t.name] && !t.end && !t.selfClosing {
+			end := indexFold(doc[i:], "</"+t.name)
+			if end < 0 {
+				end = len(doc) - i
+			}
+			onRaw(t.name, doc[i:i+end])
+			i += end
+		}
+	}
+}
+
+// readTag parses the tag at the start of s, returning its length, or 0
+// if s does not start with a tag
+func readTag(s string) (tag, int) {
+	var t tag
+	i := 1
+	if i < len(s) && s[i] == '/' {
+		t.end = true
+		i++
+	}
+	start := i
+	for i < len(s) && (isLetter(s[i]) || (i > start && (isDigit(s[i]) || s[i] == '-' || s[i] == ':'))) {
+		i++
+	}
+	if i == start {
+		return t, 0
+	}
+	t.name = strings.ToLower(s[start:i])
+	t.attrs = map[string]string{}
+
+	for i < len(s) {
+		for i < len(s) && (isSpace(s[i]) || s[i] == '/') {
+			t.selfClosing = s[i] == '/'
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+		if s[i] == '>' {
+			return t, i + 1
+		}
+		t.selfClosing = false
+
+		nameStart := i
+		for i < len(s) && !isSpace(s[i]) && s[i] != '=' && s[i] != '>' && s[i] != '/' {
+			i++
+		}
+		name := strings.ToLower(s[nameStart:i])
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		value := ""
+		if i < len(s) && s[i] == '=' {
+			i++
+			for i < len(s) && isSpace(s[i]) {
+				i++
+			}
+			if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+				quote := s[i]
+				end := strings.IndexByte(s[i+1:], quote)
+				if end < 0 {
+					end = len(s) - i - 1
+				}
+				value = s[i+1 : i+1+end]
+				i += end + 2
+			} else {
+				valueStart := i
+				for i < len(s) && !isSpace(s[i]) && s[i] != '>' {
+					i++
+				}
+				value = s[valueStart:i]
+			}
+		}
+		if _, dup := t.attrs[name]; !dup && name != "" {
+			t.attrs[name] = html.UnescapeString(value)
+		}
+	}
+	return t, len(s)
+}
+
+// indexFold is strings.Index ignoring ASCII case; offsets are kept, as
+// only ASCII letters change
+func indexFold(s, substr string) int {
+	return strings.Index(asciiLower(s), asciiLower(substr))
+}
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isSpace(c byte) bool  { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
@@ -0,0 +1,233 @@
+package analysis
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// Link kinds
+const (
+	KindVerification  = "verification"
+	KindPasswordReset = "password_reset"
+	KindLogin         = "login"
+	KindInvitation    = "invitation"
+	KindUnsubscribe   = "unsubscribe"
+	KindOther         = "other"
+)
+
+// Links are the links and one-time codes of an email
+type Links struct {
+	EmailID string          `json:"email_id"`
+	Links   []ExtractedLink `json:"links"`
+	// Verification holds the links a test is likely to follow: email
+	// verification, password reset, magic login and invitation links
+	Verification []ExtractedLink `json:"verification_links"`
+	Codes        []Code          `json:"codes"`
+}
+
+// ExtractedLink is a link with its kind and the tokens it carries
+type ExtractedLink struct {
+	URL    string            `json:"url"`
+	Text   string            `json:"text,omitempty"`
+	Kind   string            `json:"kind"`
+	Tokens map[string]string `json:"tokens,omitempty"`
+}
+
+// Code is a one-time code found in the text of an email
+type Code struct {
+	Value   string `json:"value"`
+	Context string `json:"context"`
+}
+
+// linkKinds are tried in order against the URL and text of a link
+var linkKinds = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{KindUnsubscribe, regexp.MustCompile(`unsubscribe|opt[-_]?out`)},
+	{KindPasswordReset, regexp.MustCompile(`reset|forgot|recover`)},
+	{KindVerification, regexp.MustCompile(`verif|confirm|activat|validat`)},
+	{KindLogin, regexp.MustCompile(`magic|log[-_ ]?in|sign[-_ ]?in|auth|sso|otp`)},
+	{KindInvitation, regexp.MustCompile(`invit|accept|join`)},
+}
+
+// tokenParams are query parameters that carry tokens
+var tokenParams = map[string]bool{
+	"token": true, "code": true, "key": true, "otp": true, "t": true, "k": true,
+	"hash": true, "sig": true, "signature": true, "nonce": true, "ticket": true,
+	"auth": true, "verify": true, "confirm": true, "reset": true, "magic": true,
+}
+
+var (
+	textURL     = regexp.MustCompile(`https?://[^\s<>"'()\[\]{}]+`)
+	randomValue = regexp.MustCompile(`^[A-Za-z0-9_\-.~%=]{16,}$`)
+
+	codeKeyword   = regexp.MustCompile(`(?i)\b(code|otp|pin|passcode|one[- ]time|verification|verify|security|2fa|token)\b`)
+	codeCandidate = regexp.MustCompile(`\b(\d{3}[- ]\d{3}|[A-Z0-9]{4,10})\b`)
+)
+
+// ExtractLinks finds the links of an email, in both its HTML and text
+// parts, and the one-time codes in its subject and text
+func ExtractLinks(email *models.Email) *Links {
+	c := Content(email)
+	doc := parseDocument(c.HTML)
+	l := &Links{EmailID: email.ID, Links: []ExtractedLink{}, Verification: []ExtractedLink{}, Codes: []Code{}}
+
+	seen := map[string]bool{}
+	add := func(rawURL, text string) {
+		lower := strings.ToLower(rawURL)
+		if rawURL == "" || strings.HasPrefix(rawURL, "#") || strings.HasPrefix(lower, "javascript:") || seen[rawURL] {
+			return
+		}
+		seen[rawURL] = true
+		link := classify(rawURL, text)
+		l.Links = append(l.Links, link)
+		if link.Kind != KindOther && link.Kind != KindUnsubscribe {
+			l.Verification = append(l.Verification, link)
+		}
+	}
+	for _, link := range doc.links {
+		add(link.URL, link.Text)
+	}
+	for _, match := range textURL.FindAllString(c.Text, -1) {
+		add(strings.TrimRight(match, ".,;:!?"), "")
+	}
+
+	subject := decodeSubject(email.Subject)
+	found := map[string]bool{}
+	for _, text := range []string{subject, c.Text, doc.text.String()} {
+		text = collapse(textURL.ReplaceAllString(text, " "))
+		for _, code := range findCodes(text) {
+			if !found[code.Value] {
+				found[code.Value] = true
+				l.Codes = append(l.Codes, code)
+			}
+		}
+	}
+	return l
+}
+
+// classify works out the kind of a link and the tokens in it
+func classify(rawURL, text string) ExtractedLink {
+	link := ExtractedLink{URL: rawURL, Text: text, Kind: KindOther}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return link
+	}
+
+	haystack := strings.ToLower(u.Host + u.Path + "?" + u.RawQuery + " " + text)
+	for _, k := range linkKinds {
+		if k.pattern.MatchString(haystack) {
+			link.Kind = k.kind
+			break
+		}
+	}
+
+	tokens := map[string]string{}
+	for name, values := range u.Query() {
+		lower := strings.ToLower(name)
+		for _, value := range values {
+			if value != "" && (tokenParams[lower] || strings.Contains(lower, "token") ||
+				strings.Contains(lower, "code") || looksRandom(value)) {
+				tokens[name] = value
+			}
+		}
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if last := segments[len(segments)-1]; len(last) >= 20 && looksRandom(last) {
+		tokens["path"] = last
+	}
+	if len(tokens) > 0 {
+		link.Tokens = tokens
+	}
+	return link
+}
+
+// looksRandom reports whether a value looks like a generated token: long,
+// without spaces, and mixing letters and digits
+func looksRandom(value string) bool {
+	return randomValue.MatchString(value) &&
+		strings.ContainsAny(value, "0123456789") &&
+		strings.IndexFunc(value, func(r rune) bool { return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' }) >= 0
+}
+
+// findCodes looks for a code after, or failing that before, each mention
+// of a code, OTP, PIN and the like
+func findCodes(text string) []Code {
+	var codes []Code
+	for _, kw := range codeKeyword.FindAllStringIndex(text, -1) {
+		after := text[kw[1]:runeBoundary(text, kw[1]+60)]
+		if m := firstCode(after); m != nil {
+			codes = append(codes, newCode(text, kw[1]+m[0], kw[1]+m[1]))
+			continue
+		}
+		start := runeBoundary(text, kw[0]-40)
+		before := text[start:kw[0]]
+		if m := lastCode(before); m != nil {
+			codes = append(codes, newCode(text, start+m[0], start+m[1]))
+		}
+	}
+	return codes
+}
+
+func firstCode(s string) []int {
+	for _, m := range codeCandidate.FindAllStringIndex(s, -1) {
+		if isCode(s[m[0]:m[1]]) {
+			return m
+		}
+	}
+	return nil
+}
+
+func lastCode(s string) []int {
+	matches := codeCandidate.FindAllStringIndex(s, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		if m := matches[i]; isCode(s[m[0]:m[1]]) {
+			return m
+		}
+	}
+	return nil
+}
+
+// isCode accepts 4 to 8 digits, or 6 to 10 letters and digits with at
+// least one of each
+func isCode(s string) bool {
+	s = strings.NewReplacer(" ", "", "-", "").Replace(s)
+	digits := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	switch {
+	case digits == len(s):
+		return len(s) >= 4 && len(s) <= 8
+	case digits > 0:
+		return len(s) >= 6
+	}
+	return false
+}
+
+func newCode(text string, start, end int) Code {
+	value := strings.NewReplacer(" ", "", "-", "").Replace(text[start:end])
+	context := text[runeBoundary(text, start-40):runeBoundary(text, end+40)]
+	return Code{Value: value, Context: strings.TrimSpace(context)}
+}
+
+// runeBoundary clamps i to text and moves it back to the start of a rune
+func runeBoundary(text string, i int) int {
+	if i <= 0 {
+		return 0
+	}
+	if i >= len(text) {
+		return len(text)
+	}
+	for i > 0 && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	return i
+}
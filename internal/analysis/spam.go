@@ -0,0 +1,189 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"mime"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// DefaultSpamThreshold is the score at which SpamAssassin calls a message
+// spam
+const DefaultSpamThreshold = 5.0
+
+// Spam rules, named after their SpamAssassin counterparts where there is
+// one
+const (
+	RuleMissingUnsubscribe = "MISSING_LIST_UNSUBSCRIBE"
+	RuleImageOnly          = "HTML_IMAGE_ONLY"
+	RuleImageRatio         = "HTML_IMAGE_RATIO"
+	RuleSubjectAllCaps     = "SUBJ_ALL_CAPS"
+	RuleMissingDate        = "MISSING_DATE"
+	RuleMissingMessageID   = "MISSING_MID"
+	RuleHTMLOnly           = "MIME_HTML_ONLY"
+	RuleReturnPathMismatch = "FROM_RETURN_PATH_MISMATCH"
+	RuleURLShortener       = "URI_SHORTENER"
+)
+
+// spamScores are the points each rule adds
+var spamScores = map[string]float64{
+	RuleMissingUnsubscribe: 1.0,
+	RuleImageOnly:          2.0,
+	RuleImageRatio:         0.8,
+	RuleSubjectAllCaps:     1.5,
+	RuleMissingDate:        1.4,
+	RuleMissingMessageID:   0.5,
+	RuleHTMLOnly:           0.7,
+	RuleReturnPathMismatch: 0.8,
+	RuleURLShortener:       1.2,
+}
+
+const (
+	// imageOnlyText is the text, in characters, below which an HTML part
+	// with images counts as image-only
+	imageOnlyText = 200
+	// textPerImage is the text expected for each image
+	textPerImage = 400
+)
+
+// ScoreSpam runs the spam heuristics on an email. A threshold of zero
+// means DefaultSpamThreshold.
+func ScoreSpam(email *models.Email, threshold float64) *models.SpamReport {
+	if threshold == 0 {
+		threshold = DefaultSpamThreshold
+	}
+	report := &models.SpamReport{Threshold: threshold, Rules: []models.SpamRule{}}
+	hit := func(rule, format string, args ...interface{}) {
+		report.Rules = append(report.Rules, models.SpamRule{
+			Name:        rule,
+			Score:       spamScores[rule],
+			Description: fmt.Sprintf(format, args...),
+		})
+		report.Score += spamScores[rule]
+	}
+
+	if header(email, "List-Unsubscribe") == "" {
+		hit(RuleMissingUnsubscribe, "No List-Unsubscribe header")
+	}
+
+	c := Content(email)
+	doc := parseDocument(c.HTML)
+	hasHTML := strings.TrimSpace(c.HTML) != ""
+	if images := len(doc.images); hasHTML && images > 0 {
+		text := len([]rune(collapse(doc.text.String())))
+		switch {
+		case text < imageOnlyText:
+			hit(RuleImageOnly, "HTML has %d %s and only %d characters of text", images, plural(images, "image"), text)
+		case text < images*textPerImage:
+			hit(RuleImageRatio, "HTML has %d %s for %d characters of text", images, plural(images, "image"), text)
+		}
+	}
+
+	if subject := decodeSubject(email.Subject); isAllCaps(subject) {
+		hit(RuleSubjectAllCaps, "Subject is all capitals")
+	}
+	if header(email, "Date") == "" {
+		hit(RuleMissingDate, "Missing Date header")
+	}
+	if header(email, "Message-ID") == "" {
+		hit(RuleMissingMessageID, "Missing Message-ID header")
+	}
+	if hasHTML && strings.TrimSpace(c.Text) == "" {
+		hit(RuleHTMLOnly, "Message only has an HTML part")
+	}
+
+	fromDomain := addressDomain(header(email, "From"))
+	returnDomain := addressDomain(header(email, "Return-Path"))
+	if fromDomain != "" && returnDomain != "" && !sameSite(fromDomain, returnDomain) {
+		hit(RuleReturnPathMismatch, "From domain %s differs from Return-Path domain %s", fromDomain, returnDomain)
+	}
+
+	shortened := map[string]bool{}
+	var urls []string
+	for _, link := range doc.links {
+		urls = append(urls, link.URL)
+	}
+	urls = append(urls, textURL.FindAllString(c.Text, -1)...)
+	for _, raw := range urls {
+		if u, err := url.Parse(raw); err == nil && IsShortener(u.Hostname()) {
+			shortened[strings.ToLower(u.Hostname())] = true
+		}
+	}
+	if len(shortened) > 0 {
+		hosts := make([]string, 0, len(shortened))
+		for host := range shortened {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		hit(RuleURLShortener, "Links to a URL shortener (%s)", strings.Join(hosts, ", "))
+	}
+
+	report.Score = math.Round(report.Score*10) / 10
+	report.IsSpam = report.Score >= threshold
+	return report
+}
+
+// SpamReportText formats a report as SpamAssassin does in its
+// X-Spam-Report header
+func SpamReportText(report *models.SpamReport) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Content analysis details:   (%.1f points, %.1f required)\n\n", report.Score, report.Threshold)
+	b.WriteString(" pts rule name                  description\n")
+	b.WriteString("---- -------------------------- --------------------------------------------------\n")
+	for _, rule := range report.Rules {
+		fmt.Fprintf(&b, "%4.1f %-26s %s\n", rule.Score, rule.Name, rule.Description)
+	}
+	return b.String()
+}
+
+// header returns the first value of a header of the email
+func header(email *models.Email, name string) string {
+	for _, h := range email.Headers {
+		if strings.EqualFold(h.Key, name) {
+			return strings.TrimSpace(h.Value)
+		}
+	}
+	return ""
+}
+
+func decodeSubject(subject string) string {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		return decoded
+	}
+	return subject
+}
+
+// isAllCaps reports whether a subject has a few letters, all capitals
+func isAllCaps(s string) bool {
+	letters := 0
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			if !unicode.IsUpper(r) {
+				return false
+			}
+			letters++
+		}
+	}
+	return letters >= 5
+}
+
+// addressDomain returns the lower-case domain of an address header, or ""
+func addressDomain(value string) string {
+	if value == "" || value == "<>" {
+		return ""
+	}
+	address := strings.Trim(value, "<>")
+	if addr, err := mail.ParseAddress(value); err == nil {
+		address = addr.Address
+	}
+	if at := strings.LastIndexByte(address, '@'); at >= 0 {
+		return strings.ToLower(address[at+1:])
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/baliboy20/smtp_server_go/internal/analysis"
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// spamResponse is a spam report with its SpamAssassin-style text
+type spamResponse struct {
+	EmailID string `json:"email_id"`
+	*models.SpamReport
+	Report string `json:"report"`
+}
+
+// analyzeEmail reports on the links, images and client support of an
+// email's HTML
+func (s *Server) analyzeEmail(w http.ResponseWriter, r *http.Request) {
+	email, err := s.storage.Get(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondStorageError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, analysis.Analyze(email))
+}
+
+// getLinks lists the links of an email, picking out verification links
+// and one-time codes
+func (s *Server) getLinks(w http.ResponseWriter, r *http.Request) {
+	email, err := s.storage.Get(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondStorageError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, analysis.ExtractLinks(email))
+}
+
+// scoreSpam runs the spam heuristics on an email, as plain text with
+// format=text
+func (s *Server) scoreSpam(w http.ResponseWriter, r *http.Request) {
+	email, err := s.storage.Get(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondStorageError(w, err)
+		return
+	}
+
+	report := analysis.ScoreSpam(email, s.config.SpamThreshold)
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(analysis.SpamReportText(report)))
+		return
+	}
+	s.respondJSON(w, http.StatusOK, spamResponse{
+		EmailID:    email.ID,
+		SpamReport: report,
+		Report:     analysis.SpamReportText(report),
+	})
+}
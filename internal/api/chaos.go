@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+func (s *Server) getChaos(w http.ResponseWriter, r *http.Request) {
+	s.respondJSON(w, http.StatusOK, s.smtpServer.Chaos())
+}
+
+// updateChaos replaces the fault injection settings. They apply from the
+// next SMTP command of every session.
+func (s *Server) updateChaos(w http.ResponseWriter, r *http.Request) {
+	var cfg models.ChaosConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := s.smtpServer.SetChaos(cfg); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid chaos settings: "+err.Error())
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, s.smtpServer.Chaos())
+}
+
+// resetChaos turns fault injection off
+func (s *Server) resetChaos(w http.ResponseWriter, r *http.Request) {
+	s.smtpServer.SetChaos(models.ChaosConfig{})
+
+	s.respondJSON(w, http.StatusOK, map[string]string{
+		"message": "Chaos mode disabled successfully",
+	})
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/baliboy20/smtp_server_go/internal/config"
+	"github.com/baliboy20/smtp_server_go/internal/mailauth"
+)
+
+// maxSignBody limits the size of a message posted for signing
+const maxSignBody = 25 << 20
+
+// newSigner loads the configured DKIM key, or returns nil when signing is
+// not configured
+func newSigner(cfg *config.Config) (*mailauth.Signer, error) {
+	if cfg.DKIMPrivateKeyFile == "" {
+		return nil, nil
+	}
+
+	signer, err := mailauth.LoadSigner(cfg.DKIMDomain, cfg.DKIMSelector, cfg.DKIMPrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("DKIM signing enabled",
+		"domain", signer.Domain(),
+		"selector", signer.Selector(),
+		"algorithm", signer.Algorithm(),
+		"record_name", signer.RecordName(),
+		"record", signer.DNSRecord())
+	return signer, nil
+}
+
+// signOptions builds signing options from the configuration, overridden by
+// the canonicalization and headers query parameters
+func (s *Server) signOptions(r *http.Request) mailauth.SignOptions {
+	opts := mailauth.SignOptions{
+		Canonicalization: s.config.DKIMCanonicalization,
+		Headers:          s.config.DKIMHeaders,
+	}
+	if c := r.URL.Query().Get("canonicalization"); c != "" {
+		opts.Canonicalization = c
+	}
+	if h := r.URL.Query().Get("headers"); h != "" {
+		opts.Headers = nil
+		for _, name := range strings.Split(h, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				opts.Headers = append(opts.Headers, name)
+			}
+		}
+	}
+	return opts
+}
+
+// respondMessage writes a raw message as a .eml download
+func (s *Server) respondMessage(w http.ResponseWriter, name string, raw []byte) {
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".eml\"")
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(raw)
+}
+
+// exportEmail returns the stored message as .eml, DKIM signed when
+// ?sign=true
+func (s *Server) exportEmail(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	email, err := s.storage.Get(id)
+	if err != nil {
+		s.respondError(w, http.StatusNotFound, "Email not found")
+		return
+	}
+	if email.Raw == "" {
+		s.respondError(w, http.StatusNotFound, "No raw message stored for this email")
+		return
+	}
+
+	raw := []byte(email.Raw)
+	if sign, _ := strconv.ParseBool(r.URL.Query().Get("sign")); sign {
+		if s.signer == nil {
+			s.respondError(w, http.StatusConflict, "DKIM signing is not configured")
+			return
+		}
+		if raw, err = s.signer.Sign(raw, s.signOptions(r)); err != nil {
+			s.respondError(w, http.StatusUnprocessableEntity, "Failed to sign message: "+err.Error())
+			return
+		}
+	}
+
+	s.respondMessage(w, id, raw)
+}
+
+// dkimSign signs a message posted as the request body
+func (s *Server) dkimSign(w http.ResponseWriter, r *http.Request) {
+	if s.signer == nil {
+		s.respondError(w, http.StatusConflict, "DKIM signing is not configured")
+		return
+	}
+
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.respondError(w, http.StatusRequestEntityTooLarge, "Message too large")
+			return
+		}
+		s.respondError(w, http.StatusBadRequest, "Failed to read message")
+		return
+	}
+	if len(raw) == 0 {
+		s.respondError(w, http.StatusBadRequest, "Message body is empty")
+		return
+	}
+
+	signed, err := s.signer.Sign(raw, s.signOptions(r))
+	if err != nil {
+		s.respondError(w, http.StatusUnprocessableEntity, "Failed to sign message: "+err.Error())
+		return
+	}
+
+	s.respondMessage(w, "signed", signed)
+}
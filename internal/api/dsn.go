@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/baliboy20/smtp_server_go/internal/dsn"
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/pkg/utils"
+)
+
+// dsnRequest is the body of POST /api/emails/{id}/dsn
+type dsnRequest struct {
+	Action     string   `json:"action"`      // failed (default), delayed, delivered, relayed or expanded
+	Recipients []string `json:"recipients"`  // default: every envelope recipient
+	Status     string   `json:"status"`      // enhanced status code, e.g. 5.1.1
+	Diagnostic string   `json:"diagnostic"`  // SMTP reply, e.g. "550 5.1.1 User unknown"
+	Return     string   `json:"return"`      // FULL or HDRS; defaults to the message's RET
+	Force      bool     `json:"force"`       // report even where NOTIFY did not ask for it
+	WebhookURL string   `json:"webhook_url"` // POST the notification here instead of storing it
+}
+
+// createDSN generates a delivery status notification for a captured
+// message and stores it, or posts it to a webhook
+func (s *Server) createDSN(w http.ResponseWriter, r *http.Request) {
+	var req dsnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Action == "" {
+		req.Action = dsn.ActionFailed
+	}
+	req.Action = strings.ToLower(req.Action)
+
+	email, err := s.storage.Get(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondError(w, http.StatusNotFound, "Email not found")
+		return
+	}
+
+	env := email.Envelope
+	if env == nil {
+		env = &models.Envelope{MailFrom: email.From}
+		for _, to := range email.To {
+			env.Recipients = append(env.Recipients, models.Recipient{Address: to})
+		}
+	}
+	if env.MailFrom == "" {
+		s.respondError(w, http.StatusConflict, "The message has a null sender, so no notification can be sent")
+		return
+	}
+
+	report := dsn.Report{
+		ReportingMTA: s.config.SMTPHostname,
+		ArrivalDate:  email.ReceivedAt,
+		Return:       req.Return,
+		Original:     []byte(email.Raw),
+	}
+	if report.Return == "" {
+		report.Return = env.MailParams["RET"]
+	}
+	if report.Return != "" {
+		if report.Return, err = dsn.ParseRet(report.Return); err != nil {
+			s.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if envid, ok := env.MailParams["ENVID"]; ok {
+		report.EnvelopeID, _ = dsn.ParseEnvID(envid)
+	}
+
+	addresses := req.Recipients
+	if len(addresses) == 0 {
+		for _, rcpt := range env.Recipients {
+			addresses = append(addresses, rcpt.Address)
+		}
+	}
+	for _, addr := range addresses {
+		rcpt := dsn.Recipient{Final: addr, Action: req.Action, Status: req.Status, Diagnostic: req.Diagnostic}
+		params := envelopeParams(env, addr)
+
+		var notify []string
+		if value, ok := params["NOTIFY"]; ok {
+			notify, _ = dsn.ParseNotify(value)
+		}
+		if !req.Force && !dsn.Wants(notify, req.Action) {
+			continue
+		}
+		if value, ok := params["ORCPT"]; ok {
+			rcpt.OriginalType, rcpt.Original, _ = dsn.ParseORCPT(value)
+		}
+		report.Recipients = append(report.Recipients, rcpt)
+	}
+	if len(report.Recipients) == 0 {
+		s.respondError(w, http.StatusUnprocessableEntity, "No recipient asked for this notification (set force to override NOTIFY)")
+		return
+	}
+
+	raw, err := report.Build(env.MailFrom)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	notification := s.smtpServer.Compose("", []string{env.MailFrom}, raw, "dsn")
+
+	if req.WebhookURL != "" {
+		if err := utils.TriggerWebhook(models.Webhook{URL: req.WebhookURL}, notification); err != nil {
+			s.respondError(w, http.StatusBadGateway, "Webhook delivery failed: "+err.Error())
+			return
+		}
+		s.respondJSON(w, http.StatusOK, notification)
+		return
+	}
+
+	stored, err := s.smtpServer.Inject(notification)
+	if err != nil {
+		s.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if stored == nil {
+		s.respondJSON(w, http.StatusOK, map[string]string{
+			"message": "Notification deleted by a rule",
+		})
+		return
+	}
+	s.respondJSON(w, http.StatusCreated, stored)
+}
+
+// envelopeParams returns the RCPT TO parameters given for addr
+func envelopeParams(env *models.Envelope, addr string) map[string]string {
+	for _, rcpt := range env.Recipients {
+		if strings.EqualFold(rcpt.Address, addr) {
+			return rcpt.Params
+		}
+	}
+	return nil
+}
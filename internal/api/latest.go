@@ -0,0 +1,225 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/baliboy20/smtp_server_go/internal/analysis"
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/storage"
+)
+
+const (
+	// maxWait bounds how long a request waits for an email to arrive
+	maxWait = 5 * time.Minute
+	// waitPollInterval is how often storage is checked while waiting
+	waitPollInterval = 200 * time.Millisecond
+)
+
+// extractRequest is the optional body of a POST to an extract endpoint
+type extractRequest struct {
+	Extractors []*analysis.Extractor `json:"extractors"`
+}
+
+// extractResponse is the email values were extracted from, and the values
+type extractResponse struct {
+	EmailID    string                         `json:"email_id"`
+	From       string                         `json:"from"`
+	To         []string                       `json:"to"`
+	Subject    string                         `json:"subject"`
+	ReceivedAt time.Time                      `json:"received_at"`
+	Results    map[string]*analysis.Extracted `json:"results"`
+}
+
+// latestEmail returns the newest email matching the filter parameters
+func (s *Server) latestEmail(w http.ResponseWriter, r *http.Request) {
+	if email, ok := s.awaitLatest(w, r); ok {
+		s.respondJSON(w, http.StatusOK, email)
+	}
+}
+
+// extractLatest runs extractors on the newest matching email
+func (s *Server) extractLatest(w http.ResponseWriter, r *http.Request) {
+	extractors, err := parseExtractors(r)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if email, ok := s.awaitLatest(w, r); ok {
+		s.respondJSON(w, http.StatusOK, newExtractResponse(email, extractors))
+	}
+}
+
+// extractEmail runs extractors on one email
+func (s *Server) extractEmail(w http.ResponseWriter, r *http.Request) {
+	extractors, err := parseExtractors(r)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	email, err := s.storage.Get(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondStorageError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, newExtractResponse(email, extractors))
+}
+
+func newExtractResponse(email *models.Email, extractors []*analysis.Extractor) extractResponse {
+	return extractResponse{
+		EmailID:    email.ID,
+		From:       email.From,
+		To:         email.To,
+		Subject:    email.Subject,
+		ReceivedAt: email.ReceivedAt,
+		Results:    analysis.Extract(email, extractors),
+	}
+}
+
+// awaitLatest finds the newest email matching the request's filter,
+// checking again until the wait parameter runs out. On failure it has
+// already responded, or the client has gone.
+func (s *Server) awaitLatest(w http.ResponseWriter, r *http.Request) (*models.Email, bool) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	// A test must never be handed another recipient's code, so addresses
+	// match whole, as for deletes
+	filter.ExactAddresses = true
+	wait, err := parseWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	deadline := time.Now().Add(wait)
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+	for {
+		email, err := s.newestMatching(filter)
+		if err != nil {
+			s.respondError(w, http.StatusInternalServerError, err.Error())
+			return nil, false
+		}
+		if email != nil {
+			return email, true
+		}
+		if !time.Now().Before(deadline) {
+			s.respondError(w, http.StatusNotFound, "No matching email")
+			return nil, false
+		}
+
+		select {
+		case <-r.Context().Done():
+			return nil, false
+		case <-ticker.C:
+		}
+	}
+}
+
+// newestMatching returns the most recently received email matching the
+// filter, or nil
+func (s *Server) newestMatching(filter *storage.Filter) (*models.Email, error) {
+	emails, err := s.storage.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var newest *models.Email
+	for _, email := range emails {
+		if filter.Match(email) && (newest == nil || email.ReceivedAt.After(newest.ReceivedAt)) {
+			newest = email
+		}
+	}
+	return newest, nil
+}
+
+// parseWait reads a wait such as "30s", or a number of seconds
+func parseWait(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		seconds, serr := strconv.ParseFloat(v, 64)
+		if serr != nil {
+			return 0, fmt.Errorf("invalid wait value %q", v)
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	if d < 0 || d > maxWait {
+		return 0, fmt.Errorf("wait must be between 0 and %s", maxWait)
+	}
+	return d, nil
+}
+
+// parseExtractors reads the extractors of a request: from a POSTed JSON
+// body, or from the extract, digits, host and pattern parameters. Without
+// any, the OTP and URL extractors run.
+func parseExtractors(r *http.Request) ([]*analysis.Extractor, error) {
+	var extractors []*analysis.Extractor
+	if r.Method == http.MethodPost && r.ContentLength != 0 {
+		var req extractRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, fmt.Errorf("invalid request body: %v", err)
+		}
+		extractors = req.Extractors
+	}
+
+	if len(extractors) == 0 {
+		q := r.URL.Query()
+		digits := 0
+		if v := q.Get("digits"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid digits value %q", v)
+			}
+			digits = n
+		}
+
+		types := q.Get("extract")
+		if types == "" && q.Get("pattern") == "" {
+			types = analysis.ExtractOTP + "," + analysis.ExtractURL
+		}
+		for _, t := range strings.Split(types, ",") {
+			switch t = strings.TrimSpace(t); t {
+			case "":
+			case analysis.ExtractOTP:
+				extractors = append(extractors, &analysis.Extractor{Type: t, Digits: digits})
+			case analysis.ExtractURL:
+				extractors = append(extractors, &analysis.Extractor{Type: t, Host: q.Get("host")})
+			default:
+				return nil, fmt.Errorf("unknown extractor %q", t)
+			}
+		}
+		if pattern := q.Get("pattern"); pattern != "" {
+			extractors = append(extractors, &analysis.Extractor{Name: "pattern", Type: analysis.ExtractRegex, Pattern: pattern})
+		}
+	}
+
+	names := map[string]bool{}
+	for _, e := range extractors {
+		if e == nil {
+			return nil, fmt.Errorf("extractor must be an object")
+		}
+		if err := e.Compile(); err != nil {
+			return nil, err
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("duplicate extractor name %q", e.Name)
+		}
+		names[e.Name] = true
+	}
+	return extractors, nil
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/pkg/utils"
+)
+
+// accessLogMiddleware assigns every request an ID, echoed in the
+// X-Request-ID response header, and logs the request once it completes.
+// A client-supplied X-Request-ID is kept so IDs can be correlated across
+// services.
+func (s *Server) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = utils.GenerateID()[:16]
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		slog.Info("API request",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr)
+	})
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/baliboy20/smtp_server_go/internal/metrics"
+)
+
+var requestDuration = metrics.NewHistogramVec("api_request_duration_seconds",
+	"API request latency by route, method and status.", nil, "route", "method", "status")
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// metricsMiddleware records request durations labelled by route template,
+// so that /api/emails/{id} is one series rather than one per ID
+func (s *Server) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		requestDuration.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// registerStorageMetrics exports the storage Stats as gauges evaluated at
+// scrape time
+func (s *Server) registerStorageMetrics() {
+	metrics.NewGaugeFunc("storage_emails", "Emails currently stored.", func() float64 {
+		return float64(s.storage.Stats().TotalEmails)
+	})
+	metrics.NewGaugeFunc("storage_size_bytes", "Total size of stored emails.", func() float64 {
+		return float64(s.storage.Stats().TotalSize)
+	})
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientIdleTTL is how long an idle client's bucket is kept before eviction
+const clientIdleTTL = 10 * time.Minute
+
+// clientLimiter keeps one token bucket per client IP, split by whether the
+// caller is authenticated
+type clientLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	limit     rate.Limit
+	clients   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateDecision is the outcome of a single rate limit check
+type rateDecision struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration // until the bucket is full again
+	retryAfter time.Duration // until the next request is allowed
+}
+
+// newClientLimiter creates a limiter allowing perMinute requests per client,
+// with bursts of up to perMinute requests
+func newClientLimiter(perMinute int) *clientLimiter {
+	return &clientLimiter{
+		perMinute: perMinute,
+		limit:     rate.Limit(float64(perMinute) / 60),
+		clients:   make(map[string]*clientBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *clientLimiter) allow(key string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > clientIdleTTL {
+		for k, bucket := range l.clients {
+			if now.Sub(bucket.lastSeen) > clientIdleTTL {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, exists := l.clients[key]
+	if !exists {
+		bucket = &clientBucket{limiter: rate.NewLimiter(l.limit, l.perMinute)}
+		l.clients[key] = bucket
+	}
+	bucket.lastSeen = now
+
+	d := rateDecision{
+		allowed: bucket.limiter.AllowN(now, 1),
+		limit:   l.perMinute,
+	}
+
+	tokens := bucket.limiter.TokensAt(now)
+	d.remaining = int(math.Max(0, math.Floor(tokens)))
+	d.reset = l.durationFor(float64(l.perMinute) - tokens)
+	if !d.allowed {
+		d.retryAfter = l.durationFor(1 - tokens)
+	}
+	return d
+}
+
+// durationFor returns how long it takes to refill the given number of tokens
+func (l *clientLimiter) durationFor(tokens float64) time.Duration {
+	if tokens <= 0 || l.limit <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / float64(l.limit) * float64(time.Second))
+}
+
+// rateLimitKey identifies the caller by remote IP. Callers presenting the
+// configured API key get a bucket of their own, apart from unauthenticated
+// requests from the same IP; since every authenticated caller sends the
+// same key, the key alone would put them all in one bucket. Unchecked keys
+// are not trusted, or a client could pick a fresh bucket for every request.
+func rateLimitKey(r *http.Request, apiKey string) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if validAPIKey(r, apiKey) {
+		return "key:" + host
+	}
+	return "ip:" + host
+}
+
+func (d rateDecision) writeHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(d.limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(d.remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(ceilSeconds(d.reset), 10))
+	if !d.allowed {
+		h.Set("Retry-After", strconv.FormatInt(max(ceilSeconds(d.retryAfter), 1), 10))
+	}
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/responses"
+)
+
+func (s *Server) listResponses(w http.ResponseWriter, r *http.Request) {
+	list := s.smtpServer.Responses().List()
+
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"responses": list,
+		"count":     len(list),
+	})
+}
+
+func (s *Server) getResponse(w http.ResponseWriter, r *http.Request) {
+	rule, err := s.smtpServer.Responses().Get(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondResponseError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, rule)
+}
+
+func (s *Server) createResponse(w http.ResponseWriter, r *http.Request) {
+	var rule models.ResponseRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	created, err := s.smtpServer.Responses().Create(rule)
+	if err != nil {
+		s.respondResponseError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) updateResponse(w http.ResponseWriter, r *http.Request) {
+	var rule models.ResponseRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	updated, err := s.smtpServer.Responses().Update(mux.Vars(r)["id"], rule)
+	if err != nil {
+		s.respondResponseError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, updated)
+}
+
+func (s *Server) deleteResponse(w http.ResponseWriter, r *http.Request) {
+	if err := s.smtpServer.Responses().Delete(mux.Vars(r)["id"]); err != nil {
+		s.respondResponseError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, map[string]string{
+		"message": "Response rule deleted successfully",
+	})
+}
+
+func (s *Server) listGreylist(w http.ResponseWriter, r *http.Request) {
+	entries := s.smtpServer.Responses().Greylist()
+
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+		"count":   len(entries),
+	})
+}
+
+// clearGreylist forgets every triplet so the next attempt is deferred
+// again
+func (s *Server) clearGreylist(w http.ResponseWriter, r *http.Request) {
+	s.smtpServer.Responses().ClearGreylist()
+
+	s.respondJSON(w, http.StatusOK, map[string]string{
+		"message": "Greylist cleared successfully",
+	})
+}
+
+// respondResponseError maps response table errors to HTTP statuses
+func (s *Server) respondResponseError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, responses.ErrNotFound):
+		s.respondError(w, http.StatusNotFound, "Response rule not found")
+	case errors.Is(err, responses.ErrInvalid):
+		s.respondError(w, http.StatusBadRequest, err.Error())
+	default:
+		s.respondError(w, http.StatusInternalServerError, "Failed to save response rules: "+err.Error())
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/rules"
+)
+
+// ruleTestRequest is the body of POST /api/rules/test. Without a rule,
+// all saved rules are evaluated. The email is given inline or by ID.
+type ruleTestRequest struct {
+	Rule    *models.Rule  `json:"rule"`
+	EmailID string        `json:"email_id"`
+	Email   *models.Email `json:"email"`
+}
+
+func (s *Server) listRules(w http.ResponseWriter, r *http.Request) {
+	list := s.smtpServer.Rules().List()
+
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"rules": list,
+		"count": len(list),
+	})
+}
+
+func (s *Server) getRule(w http.ResponseWriter, r *http.Request) {
+	rule, err := s.smtpServer.Rules().Get(mux.Vars(r)["id"])
+	if err != nil {
+		s.respondRuleError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, rule)
+}
+
+func (s *Server) createRule(w http.ResponseWriter, r *http.Request) {
+	var rule models.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	created, err := s.smtpServer.Rules().Create(rule)
+	if err != nil {
+		s.respondRuleError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) updateRule(w http.ResponseWriter, r *http.Request) {
+	var rule models.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	updated, err := s.smtpServer.Rules().Update(mux.Vars(r)["id"], rule)
+	if err != nil {
+		s.respondRuleError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, updated)
+}
+
+func (s *Server) deleteRule(w http.ResponseWriter, r *http.Request) {
+	if err := s.smtpServer.Rules().Delete(mux.Vars(r)["id"]); err != nil {
+		s.respondRuleError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, map[string]string{
+		"message": "Rule deleted successfully",
+	})
+}
+
+// testRules reports what rules would do to an email without changing
+// anything
+func (s *Server) testRules(w http.ResponseWriter, r *http.Request) {
+	var req ruleTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	email := req.Email
+	switch {
+	case req.EmailID != "":
+		stored, err := s.storage.Get(req.EmailID)
+		if err != nil {
+			s.respondError(w, http.StatusNotFound, "Email not found")
+			return
+		}
+		email = stored
+	case email == nil:
+		s.respondError(w, http.StatusBadRequest, "Either email or email_id is required")
+		return
+	}
+
+	if req.Rule == nil {
+		s.respondJSON(w, http.StatusOK, s.smtpServer.Rules().Evaluate(email))
+		return
+	}
+
+	result, err := rules.Test(*req.Rule, email)
+	if err != nil {
+		s.respondRuleError(w, err)
+		return
+	}
+	s.respondJSON(w, http.StatusOK, result)
+}
+
+// respondRuleError maps rule engine errors to HTTP statuses
+func (s *Server) respondRuleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, rules.ErrNotFound):
+		s.respondError(w, http.StatusNotFound, "Rule not found")
+	case errors.Is(err, rules.ErrInvalid):
+		s.respondError(w, http.StatusBadRequest, err.Error())
+	default:
+		s.respondError(w, http.StatusInternalServerError, "Failed to save rules: "+err.Error())
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/search"
+)
+
+// Search result pagination
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// searchResult is one ranked match with highlighted snippets by field
+type searchResult struct {
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+	Email      *models.Email     `json:"email"`
+}
+
+func (s *Server) searchEmails(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query, err := search.Parse(q.Get("q"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit, err := queryInt(q.Get("limit"), defaultSearchLimit)
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		s.respondError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+		return
+	}
+	offset, err := queryInt(q.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		s.respondError(w, http.StatusBadRequest, "offset must not be negative")
+		return
+	}
+
+	hits, err := s.storage.Search(query)
+	if err != nil {
+		if errors.Is(err, search.ErrSyntax) {
+			s.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	results := []searchResult{}
+	for i := offset; i < len(hits) && len(results) < limit; i++ {
+		email, err := s.storage.Get(hits[i].ID)
+		if err != nil {
+			continue
+		}
+		results = append(results, searchResult{
+			Score:      hits[i].Score,
+			Highlights: search.Highlight(email, query),
+			Email:      email,
+		})
+	}
+
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"results": results,
+		"count":   len(results),
+		"total":   len(hits),
+	})
+}
+
+// queryInt parses an optional integer query parameter
+func queryInt(v string, defaultValue int) (int, error) {
+	if v == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(v)
+}
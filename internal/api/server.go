@@ -1,17 +1,20 @@
 package api
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
-	"golang.org/x/time/rate"
 
 	"github.com/baliboy20/smtp_server_go/internal/config"
+	"github.com/baliboy20/smtp_server_go/internal/mailauth"
+	"github.com/baliboy20/smtp_server_go/internal/metrics"
 	"github.com/baliboy20/smtp_server_go/internal/models"
 	"github.com/baliboy20/smtp_server_go/internal/smtp"
 	"github.com/baliboy20/smtp_server_go/internal/storage"
@@ -23,74 +26,143 @@ type Server struct {
 	storage     storage.Storage
 	smtpServer  *smtp.Server
 	router      *mux.Router
-	rateLimiter *rate.Limiter
+	rateLimiter *clientLimiter
+	signer      *mailauth.Signer // nil unless a DKIM key is configured
 }
 
 // NewServer creates a new API server
-func NewServer(cfg *config.Config, store storage.Storage, smtpServer *smtp.Server) *Server {
+func NewServer(cfg *config.Config, store storage.Storage, smtpServer *smtp.Server) (*Server, error) {
+	signer, err := newSigner(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load DKIM key: %w", err)
+	}
+
 	s := &Server{
 		config:      cfg,
 		storage:     store,
 		smtpServer:  smtpServer,
 		router:      mux.NewRouter(),
-		rateLimiter: rate.NewLimiter(rate.Limit(cfg.RateLimit), cfg.RateLimit*2),
+		rateLimiter: newClientLimiter(cfg.RateLimit),
+		signer:      signer,
 	}
 
 	s.setupRoutes()
-	return s
+	s.registerStorageMetrics()
+	return s, nil
 }
 
 func (s *Server) setupRoutes() {
+	s.router.Use(s.metricsMiddleware)
+
 	// API routes
 	api := s.router.PathPrefix("/api").Subrouter()
 
 	// Middleware
-	api.Use(s.rateLimitMiddleware)
+	if s.config.RateLimit > 0 {
+		api.Use(s.rateLimitMiddleware)
+	}
 	if s.config.APIKey != "" {
 		api.Use(s.authMiddleware)
 	}
 
 	// Email endpoints
 	api.HandleFunc("/emails", s.listEmails).Methods("GET")
+	api.HandleFunc("/emails/bulk", s.bulkEmails).Methods("POST")
+	api.HandleFunc("/emails/latest", s.latestEmail).Methods("GET")
+	api.HandleFunc("/emails/latest/extract", s.extractLatest).Methods("GET", "POST")
 	api.HandleFunc("/emails/{id}", s.getEmail).Methods("GET")
+	api.HandleFunc("/emails/{id}", s.updateEmail).Methods("PATCH")
+	api.HandleFunc("/emails/{id}/transcript", s.getTranscript).Methods("GET")
+	api.HandleFunc("/emails/{id}/raw", s.exportEmail).Methods("GET")
+	api.HandleFunc("/emails/{id}/dsn", s.createDSN).Methods("POST")
+	api.HandleFunc("/emails/{id}/analysis", s.analyzeEmail).Methods("GET")
+	api.HandleFunc("/emails/{id}/links", s.getLinks).Methods("GET")
+	api.HandleFunc("/emails/{id}/spam", s.scoreSpam).Methods("GET")
+	api.HandleFunc("/emails/{id}/extract", s.extractEmail).Methods("GET", "POST")
 	api.HandleFunc("/emails/{id}", s.deleteEmail).Methods("DELETE")
 	api.HandleFunc("/emails", s.clearEmails).Methods("DELETE")
 
+	// Full-text search
+	api.HandleFunc("/search", s.searchEmails).Methods("GET")
+
+	// Conversations
+	api.HandleFunc("/threads", s.listThreads).Methods("GET")
+	api.HandleFunc("/threads/{id}", s.getThread).Methods("GET")
+
+	// SMTP sessions that ended without a message
+	api.HandleFunc("/sessions", s.listSessions).Methods("GET")
+
 	// Stats endpoint
 	api.HandleFunc("/stats", s.getStats).Methods("GET")
 
 	// Webhook endpoint
 	api.HandleFunc("/webhooks", s.addWebhook).Methods("POST")
 
+	// Rules
+	api.HandleFunc("/rules", s.listRules).Methods("GET")
+	api.HandleFunc("/rules", s.createRule).Methods("POST")
+	api.HandleFunc("/rules/test", s.testRules).Methods("POST")
+	api.HandleFunc("/rules/{id}", s.getRule).Methods("GET")
+	api.HandleFunc("/rules/{id}", s.updateRule).Methods("PUT")
+	api.HandleFunc("/rules/{id}", s.deleteRule).Methods("DELETE")
+
+	// Scripted SMTP responses
+	api.HandleFunc("/responses", s.listResponses).Methods("GET")
+	api.HandleFunc("/responses", s.createResponse).Methods("POST")
+	api.HandleFunc("/responses/greylist", s.listGreylist).Methods("GET")
+	api.HandleFunc("/responses/greylist", s.clearGreylist).Methods("DELETE")
+	api.HandleFunc("/responses/{id}", s.getResponse).Methods("GET")
+	api.HandleFunc("/responses/{id}", s.updateResponse).Methods("PUT")
+	api.HandleFunc("/responses/{id}", s.deleteResponse).Methods("DELETE")
+
+	// Fault injection
+	api.HandleFunc("/chaos", s.getChaos).Methods("GET")
+	api.HandleFunc("/chaos", s.updateChaos).Methods("PUT")
+	api.HandleFunc("/chaos", s.resetChaos).Methods("DELETE")
+
+	// Tools
+	api.HandleFunc("/tools/dkim-sign", s.dkimSign).Methods("POST")
+
 	// Health check (no auth required)
 	s.router.HandleFunc("/health", s.healthCheck).Methods("GET")
 	s.router.HandleFunc("/api/health", s.healthCheck).Methods("GET")
+
+	// Prometheus metrics (no auth required)
+	s.router.Handle("/metrics", metrics.Handler()).Methods("GET")
 }
 
 // Start starts the API server
 func (s *Server) Start() error {
 	addr := fmt.Sprintf("%s:%s", s.config.APIHost, s.config.APIPort)
 
-	handler := s.router
+	slog.Info("API server listening", "addr", addr)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+// Handler returns the API with CORS and access logging, for serving
+// from another listener
+func (s *Server) Handler() http.Handler {
+	var handler http.Handler = s.router
 	if s.config.EnableCORS {
 		c := cors.New(cors.Options{
 			AllowedOrigins:   []string{"*"},
-			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 			AllowedHeaders:   []string{"*"},
+			ExposedHeaders:   []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After", "X-Request-ID"},
 			AllowCredentials: true,
 		})
 		handler = c.Handler(s.router)
 	}
-
-	log.Printf("API server listening on %s", addr)
-	return http.ListenAndServe(addr, handler)
+	return s.accessLogMiddleware(handler)
 }
 
 // Middleware
 
 func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !s.rateLimiter.Allow() {
+		decision := s.rateLimiter.allow(rateLimitKey(r, s.config.APIKey))
+		decision.writeHeaders(w)
+		if !decision.allowed {
 			s.respondError(w, http.StatusTooManyRequests, "Rate limit exceeded")
 			return
 		}
@@ -100,8 +172,7 @@ func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
 
 func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey != s.config.APIKey {
+		if !validAPIKey(r, s.config.APIKey) {
 			s.respondError(w, http.StatusUnauthorized, "Invalid API key")
 			return
 		}
@@ -109,15 +180,35 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// validAPIKey reports whether the request carries apiKey, comparing in
+// constant time. No key is valid when apiKey is empty.
+func validAPIKey(r *http.Request, apiKey string) bool {
+	return apiKey != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(apiKey)) == 1
+}
+
 // Handlers
 
 func (s *Server) listEmails(w http.ResponseWriter, r *http.Request) {
-	emails, err := s.storage.List()
+	filter, err := parseFilter(r)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	all, err := s.storage.List()
 	if err != nil {
 		s.respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	emails := make([]*models.Email, 0, len(all))
+	for _, email := range all {
+		if filter.Match(email) {
+			emails = append(emails, email)
+		}
+	}
+
 	s.respondJSON(w, http.StatusOK, map[string]interface{}{
 		"emails": emails,
 		"count":  len(emails),
@@ -137,6 +228,33 @@ func (s *Server) getEmail(w http.ResponseWriter, r *http.Request) {
 	s.respondJSON(w, http.StatusOK, email)
 }
 
+func (s *Server) getTranscript(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	email, err := s.storage.Get(id)
+	if err != nil {
+		s.respondError(w, http.StatusNotFound, "Email not found")
+		return
+	}
+
+	if email.Transcript == nil {
+		s.respondError(w, http.StatusNotFound, "No transcript recorded for this email")
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, email.Transcript)
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := s.smtpServer.RecentSessions()
+
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+		"count":    len(sessions),
+	})
+}
+
 func (s *Server) deleteEmail(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
@@ -151,7 +269,36 @@ func (s *Server) deleteEmail(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// clearEmails deletes every email, or only those matching the list
+// filters when any are given. Unknown or empty parameters are refused
+// rather than ignored, since an empty filter would delete everything.
 func (s *Server) clearEmails(w http.ResponseWriter, r *http.Request) {
+	if q := r.URL.Query(); len(q) > 0 {
+		if err := checkFilterParams(q); err != nil {
+			s.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		filter, err := parseFilter(r)
+		if err != nil {
+			s.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		filter.ExactAddresses = true
+		removed, err := s.storage.DeleteMatching(filter)
+		if err != nil {
+			s.respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		s.respondJSON(w, http.StatusOK, map[string]interface{}{
+			"message": "Emails deleted successfully",
+			"count":   removed,
+		})
+		return
+	}
+
 	if err := s.storage.Clear(); err != nil {
 		s.respondError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -164,6 +311,7 @@ func (s *Server) clearEmails(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
 	stats := s.storage.Stats()
+	stats.RejectedSenders, stats.RejectedRecipients = s.smtpServer.RejectionStats()
 	s.respondJSON(w, http.StatusOK, stats)
 }
 
@@ -204,6 +352,29 @@ func (s *Server) healthCheck(w http.ResponseWriter, r *http.Request) {
 
 // Helper functions
 
+// checkFilterParams requires every parameter to be a filter given once,
+// with a value. parseFilter reads only the first value, so a repeated
+// parameter would silently narrow a delete.
+func checkFilterParams(q url.Values) error {
+	for name, values := range q {
+		if !storage.IsFilterParam(name) {
+			return fmt.Errorf("unknown filter %q", name)
+		}
+		if len(values) > 1 {
+			return fmt.Errorf("%s filter given more than once", name)
+		}
+		if values[0] == "" {
+			return fmt.Errorf("empty %s filter", name)
+		}
+	}
+	return nil
+}
+
+// parseFilter builds a storage filter from the request's query string
+func parseFilter(r *http.Request) (*storage.Filter, error) {
+	return storage.ParseFilterQuery(r.URL.Query(), time.Now())
+}
+
 func (s *Server) respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// threadResponse is a thread with its emails, in thread order
+type threadResponse struct {
+	*models.Thread
+	Emails []*models.Email `json:"emails"`
+}
+
+func (s *Server) listThreads(w http.ResponseWriter, r *http.Request) {
+	threads, err := s.storage.Threads()
+	if err != nil {
+		s.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Summaries only; GET /api/threads/{id} has the messages
+	summaries := make([]models.Thread, len(threads))
+	for i, thread := range threads {
+		summaries[i] = *thread
+		summaries[i].Messages = nil
+	}
+
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"threads": summaries,
+		"count":   len(summaries),
+	})
+}
+
+// getThread looks a thread up by its ID or the ID of any of its emails
+func (s *Server) getThread(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	threads, err := s.storage.Threads()
+	if err != nil {
+		s.respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, thread := range threads {
+		if !threadContains(thread, id) {
+			continue
+		}
+
+		resp := threadResponse{Thread: thread, Emails: make([]*models.Email, 0, len(thread.Messages))}
+		for _, msg := range thread.Messages {
+			if email, err := s.storage.Get(msg.EmailID); err == nil {
+				resp.Emails = append(resp.Emails, email)
+			}
+		}
+		s.respondJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	s.respondError(w, http.StatusNotFound, "Thread not found")
+}
+
+func threadContains(thread *models.Thread, id string) bool {
+	if thread.ID == id {
+		return true
+	}
+	for _, msg := range thread.Messages {
+		if msg.EmailID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/storage"
+)
+
+// Bulk actions
+const (
+	bulkMarkRead   = "mark-read"
+	bulkMarkUnread = "mark-unread"
+	bulkFlag       = "flag"
+	bulkUnflag     = "unflag"
+	bulkTag        = "tag"
+	bulkUntag      = "untag"
+	bulkDelete     = "delete"
+)
+
+// bulkRequest is the body of POST /api/emails/bulk. Emails are chosen by
+// ID or by a filter with at least one criterion, not both. Filters match
+// whole addresses, as for DELETE /api/emails.
+type bulkRequest struct {
+	Action string          `json:"action"`
+	IDs    []string        `json:"ids"`
+	Filter *storage.Filter `json:"filter"`
+	Tags   []string        `json:"tags"` // for tag and untag
+}
+
+func (s *Server) updateEmail(w http.ResponseWriter, r *http.Request) {
+	var update models.EmailUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if update.Seen == nil && update.Flagged == nil && update.Tags == nil &&
+		len(update.AddTags) == 0 && len(update.RemoveTags) == 0 && update.Notes == nil {
+		s.respondError(w, http.StatusBadRequest, "No changes given")
+		return
+	}
+
+	email, err := s.storage.Update(mux.Vars(r)["id"], &update)
+	if err != nil {
+		s.respondStorageError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, email)
+}
+
+// bulkEmails applies one action to many emails. IDs that are not stored
+// are reported rather than failing the request. The body is decoded
+// strictly, so a misspelled filter key is refused instead of being dropped
+// and leaving a filter that matches everything.
+func (s *Server) bulkEmails(w http.ResponseWriter, r *http.Request) {
+	var req bulkRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+	if (req.IDs == nil) == (req.Filter == nil) {
+		s.respondError(w, http.StatusBadRequest, "Either ids or filter is required")
+		return
+	}
+	if req.Filter != nil && req.Filter.Empty() {
+		s.respondError(w, http.StatusBadRequest, "Empty filter")
+		return
+	}
+	if req.Filter != nil {
+		// Every action selects the same emails, matching whole addresses
+		// as deletes must
+		req.Filter.ExactAddresses = true
+	}
+
+	var update *models.EmailUpdate
+	if req.Action != bulkDelete {
+		var err error
+		if update, err = bulkUpdate(req.Action, req.Tags); err != nil {
+			s.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	ids := req.IDs
+	if req.Filter != nil {
+		all, err := s.storage.List()
+		if err != nil {
+			s.respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, email := range all {
+			if req.Filter.Match(email) {
+				ids = append(ids, email.ID)
+			}
+		}
+	}
+
+	var affected []string
+	var err error
+	if update == nil {
+		affected, err = s.storage.DeleteMany(ids)
+	} else {
+		affected, err = s.storage.UpdateMany(ids, update)
+	}
+	if err != nil {
+		s.respondError(w, http.StatusInternalServerError, "Failed to update emails: "+err.Error())
+		return
+	}
+
+	done := make(map[string]bool, len(affected))
+	for _, id := range affected {
+		done[id] = true
+	}
+	notFound := []string{}
+	for _, id := range ids {
+		if !done[id] {
+			notFound = append(notFound, id)
+		}
+	}
+
+	s.respondJSON(w, http.StatusOK, map[string]interface{}{
+		"action":    req.Action,
+		"ids":       affected,
+		"count":     len(affected),
+		"not_found": notFound,
+	})
+}
+
+// bulkUpdate returns the update a bulk action other than delete applies
+func bulkUpdate(action string, tags []string) (*models.EmailUpdate, error) {
+	yes, no := true, false
+	switch action {
+	case bulkMarkRead:
+		return &models.EmailUpdate{Seen: &yes}, nil
+	case bulkMarkUnread:
+		return &models.EmailUpdate{Seen: &no}, nil
+	case bulkFlag:
+		return &models.EmailUpdate{Flagged: &yes}, nil
+	case bulkUnflag:
+		return &models.EmailUpdate{Flagged: &no}, nil
+	case bulkTag, bulkUntag:
+		if len(tags) == 0 {
+			return nil, fmt.Errorf("action %q needs tags", action)
+		}
+		if action == bulkTag {
+			return &models.EmailUpdate{AddTags: tags}, nil
+		}
+		return &models.EmailUpdate{RemoveTags: tags}, nil
+	case "":
+		return nil, errors.New("action is required")
+	}
+	return nil, fmt.Errorf("unknown action %q", action)
+}
+
+// respondStorageError maps storage errors to HTTP statuses
+func (s *Server) respondStorageError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrNotFound) {
+		s.respondError(w, http.StatusNotFound, "Email not found")
+		return
+	}
+	s.respondError(w, http.StatusInternalServerError, err.Error())
+}
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"crypto/subtle"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,10 +14,27 @@ type Config struct {
 	SMTPHost     string
 	SMTPPort     string
 	SMTPTimeout  time.Duration
+	SMTPHostname string // name used in Received headers
+
+	// IMAP and POP3 Servers
+	EnableIMAP bool
+	IMAPPort   string
+	EnablePOP3 bool
+	POP3Port   string
+
+	// SMTP Limits
+	SMTPMaxConnections      int // concurrent, across all clients
+	SMTPMaxConnectionsPerIP int // concurrent, per source IP
+	SMTPConnectRate         int // new connections per minute per IP
+	SMTPMessageRate         int // messages per minute per IP
+	SMTPMaxCommands         int // commands per session
+
+	// SMTP Transcripts
+	SessionHistory int // transcripts kept for sessions without a message
 
 	// API Server
-	APIHost      string
-	APIPort      string
+	APIHost string
+	APIPort string
 
 	// Security
 	EnableTLS    bool
@@ -26,14 +45,51 @@ type Config struct {
 	SMTPPassword string
 
 	// Storage
-	StorageType  string // "memory" or "file"
-	StorageFile  string
-	MaxEmails    int
+	StorageType string // "memory" or "file"
+	StorageFile string
+	MaxEmails   int
+
+	// Policy
+	AllowedRecipientDomains  []string
+	BlockedRecipientDomains  []string
+	AllowedRecipientPatterns []string
+	BlockedRecipientPatterns []string
+	BlockedSenderDomains     []string
+	BlockedSenderPatterns    []string
+	MaxRecipients            int
+	RejectNullSender         bool
+
+	// Sender authentication
+	EnableVerification  bool
+	DNSZoneFile         string // static records used instead of live DNS
+	VerificationTimeout time.Duration
+
+	// Message processing
+	PipelineFile string // JSON list of processors run on each session
+	RulesFile    string // where rules created through the API are kept
+
+	// Spam scoring
+	EnableSpamScoring bool    // store a spam report on each email
+	SpamThreshold     float64 // score at which a message counts as spam
+
+	// Scripted responses
+	ResponsesFile string // response rules, also where API changes are kept
+
+	// DKIM signing of exported messages
+	DKIMDomain           string
+	DKIMSelector         string
+	DKIMPrivateKeyFile   string // PEM, RSA or Ed25519; signing is off when empty
+	DKIMCanonicalization string
+	DKIMHeaders          []string
 
 	// Features
-	EnableAuth   bool
-	EnableCORS   bool
-	RateLimit    int // requests per minute
+	EnableAuth bool
+	EnableCORS bool
+	RateLimit  int // requests per minute
+
+	// Logging
+	LogLevel  string // "debug", "info", "warn" or "error"
+	LogFormat string // "text" or "json"
 
 	// Server
 	ServerStarted time.Time
@@ -42,30 +98,93 @@ type Config struct {
 // LoadConfig loads configuration from environment variables with defaults
 func LoadConfig() *Config {
 	return &Config{
-		SMTPHost:      getEnv("SMTP_HOST", "0.0.0.0"),
-		SMTPPort:      getEnv("SMTP_PORT", "2525"),
-		SMTPTimeout:   getDurationEnv("SMTP_TIMEOUT", 30*time.Second),
-
-		APIHost:       getEnv("API_HOST", "0.0.0.0"),
-		APIPort:       getEnv("API_PORT", "8080"),
-
-		EnableTLS:     getBoolEnv("ENABLE_TLS", false),
-		TLSCertFile:   getEnv("TLS_CERT_FILE", ""),
-		TLSKeyFile:    getEnv("TLS_KEY_FILE", ""),
-		APIKey:        getEnv("API_KEY", ""),
-		SMTPUsername:  getEnv("SMTP_USERNAME", ""),
-		SMTPPassword:  getEnv("SMTP_PASSWORD", ""),
+		SMTPHost:     getEnv("SMTP_HOST", "0.0.0.0"),
+		SMTPPort:     getEnv("SMTP_PORT", "2525"),
+		SMTPTimeout:  getDurationEnv("SMTP_TIMEOUT", 30*time.Second),
+		SMTPHostname: getEnv("SMTP_HOSTNAME", defaultHostname()),
+
+		EnableIMAP: getBoolEnv("ENABLE_IMAP", false),
+		IMAPPort:   getEnv("IMAP_PORT", "1143"),
+		EnablePOP3: getBoolEnv("ENABLE_POP3", false),
+		POP3Port:   getEnv("POP3_PORT", "1110"),
+
+		SMTPMaxConnections:      getIntEnv("SMTP_MAX_CONNECTIONS", 100),
+		SMTPMaxConnectionsPerIP: getIntEnv("SMTP_MAX_CONNECTIONS_PER_IP", 10),
+		SMTPConnectRate:         getIntEnv("SMTP_CONNECT_RATE", 0),
+		SMTPMessageRate:         getIntEnv("SMTP_MESSAGE_RATE", 0),
+		SMTPMaxCommands:         getIntEnv("SMTP_MAX_COMMANDS", 1000),
+
+		SessionHistory: getIntEnv("SESSION_HISTORY", 100),
+
+		APIHost: getEnv("API_HOST", "0.0.0.0"),
+		APIPort: getEnv("API_PORT", "8080"),
+
+		EnableTLS:    getBoolEnv("ENABLE_TLS", false),
+		TLSCertFile:  getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:   getEnv("TLS_KEY_FILE", ""),
+		APIKey:       getEnv("API_KEY", ""),
+		SMTPUsername: getEnv("SMTP_USERNAME", ""),
+		SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+
+		StorageType: getEnv("STORAGE_TYPE", "memory"),
+		StorageFile: getEnv("STORAGE_FILE", "emails.json"),
+		MaxEmails:   getIntEnv("MAX_EMAILS", 1000),
+
+		AllowedRecipientDomains:  getListEnv("ALLOWED_RECIPIENT_DOMAINS"),
+		BlockedRecipientDomains:  getListEnv("BLOCKED_RECIPIENT_DOMAINS"),
+		AllowedRecipientPatterns: getFieldsEnv("ALLOWED_RECIPIENT_PATTERNS"),
+		BlockedRecipientPatterns: getFieldsEnv("BLOCKED_RECIPIENT_PATTERNS"),
+		BlockedSenderDomains:     getListEnv("BLOCKED_SENDER_DOMAINS"),
+		BlockedSenderPatterns:    getFieldsEnv("BLOCKED_SENDER_PATTERNS"),
+		MaxRecipients:            getIntEnv("MAX_RECIPIENTS", 100),
+		RejectNullSender:         getBoolEnv("REJECT_NULL_SENDER", false),
+
+		EnableVerification:  getBoolEnv("ENABLE_VERIFICATION", false),
+		DNSZoneFile:         getEnv("DNS_ZONE_FILE", ""),
+		VerificationTimeout: getDurationEnv("VERIFICATION_TIMEOUT", 10*time.Second),
+
+		PipelineFile: getEnv("PIPELINE_FILE", ""),
+		RulesFile:    getEnv("RULES_FILE", ""),
+
+		EnableSpamScoring: getBoolEnv("ENABLE_SPAM_SCORING", false),
+		SpamThreshold:     getFloatEnv("SPAM_THRESHOLD", 5.0),
+
+		ResponsesFile: getEnv("RESPONSES_FILE", ""),
+
+		DKIMDomain:           getEnv("DKIM_DOMAIN", ""),
+		DKIMSelector:         getEnv("DKIM_SELECTOR", "default"),
+		DKIMPrivateKeyFile:   getEnv("DKIM_PRIVATE_KEY_FILE", ""),
+		DKIMCanonicalization: getEnv("DKIM_CANONICALIZATION", "relaxed/relaxed"),
+		DKIMHeaders:          getListEnv("DKIM_HEADERS"),
+
+		EnableAuth: getBoolEnv("ENABLE_AUTH", false),
+		EnableCORS: getBoolEnv("ENABLE_CORS", true),
+		RateLimit:  getIntEnv("RATE_LIMIT", 100),
+
+		LogLevel:  getEnv("LOG_LEVEL", "info"),
+		LogFormat: getEnv("LOG_FORMAT", "text"),
 
-		StorageType:   getEnv("STORAGE_TYPE", "memory"),
-		StorageFile:   getEnv("STORAGE_FILE", "emails.json"),
-		MaxEmails:     getIntEnv("MAX_EMAILS", 1000),
+		ServerStarted: time.Now(),
+	}
+}
 
-		EnableAuth:    getBoolEnv("ENABLE_AUTH", false),
-		EnableCORS:    getBoolEnv("ENABLE_CORS", true),
-		RateLimit:     getIntEnv("RATE_LIMIT", 100),
+// CheckCredentials validates a mailbox login against the SMTP credentials.
+// Any login is accepted when none are configured.
+func (c *Config) CheckCredentials(username, password string) bool {
+	if c.SMTPUsername == "" {
+		return true
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(c.SMTPUsername)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(c.SMTPPassword)) == 1
+	return userOK && passOK
+}
 
-		ServerStarted: time.Now(),
+// defaultHostname returns the machine's hostname, or "localhost"
+func defaultHostname() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
 	}
+	return "localhost"
 }
 
 func getEnv(key, defaultValue string) string {
@@ -93,6 +212,15 @@ func getBoolEnv(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+func getFloatEnv(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
 func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		if duration, err := time.ParseDuration(value); err == nil {
@@ -101,3 +229,20 @@ func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
 	}
 	return defaultValue
 }
+
+// getListEnv reads a comma-separated list, dropping empty entries
+func getListEnv(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getFieldsEnv reads a whitespace-separated list. Used for regular
+// expressions, which commonly contain commas.
+func getFieldsEnv(key string) []string {
+	return strings.Fields(os.Getenv(key))
+}
@@ -0,0 +1,128 @@
+// Package dsn implements the SMTP DSN extension (RFC 3461) and builds
+// RFC 3464 delivery status notifications.
+package dsn
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NOTIFY keywords (RFC 3461 section 4.1)
+const (
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+// RET keywords (RFC 3461 section 4.3)
+const (
+	ReturnFull    = "FULL"
+	ReturnHeaders = "HDRS"
+)
+
+// ParseRet validates a RET parameter
+func ParseRet(value string) (string, error) {
+	switch v := strings.ToUpper(value); v {
+	case ReturnFull, ReturnHeaders:
+		return v, nil
+	default:
+		return "", fmt.Errorf("RET must be FULL or HDRS")
+	}
+}
+
+// ParseEnvID decodes an ENVID parameter
+func ParseEnvID(value string) (string, error) {
+	id, err := DecodeXtext(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid ENVID: %v", err)
+	}
+	if len(id) > 100 {
+		return "", errors.New("ENVID is longer than 100 characters")
+	}
+	return id, nil
+}
+
+// ParseNotify validates a NOTIFY parameter, returning its upper-cased
+// keywords. NEVER may not be combined with anything else.
+func ParseNotify(value string) ([]string, error) {
+	keywords := strings.Split(strings.ToUpper(value), ",")
+	seen := make(map[string]bool)
+	for _, k := range keywords {
+		switch k {
+		case NotifyNever, NotifySuccess, NotifyFailure, NotifyDelay:
+		default:
+			return nil, fmt.Errorf("unknown NOTIFY keyword %q", k)
+		}
+		if seen[k] {
+			return nil, fmt.Errorf("duplicate NOTIFY keyword %q", k)
+		}
+		seen[k] = true
+	}
+	if seen[NotifyNever] && len(keywords) > 1 {
+		return nil, errors.New("NOTIFY=NEVER cannot be combined with other keywords")
+	}
+	return keywords, nil
+}
+
+// ParseORCPT splits an ORCPT parameter into its address type and decoded
+// address
+func ParseORCPT(value string) (addrType, addr string, err error) {
+	addrType, encoded, ok := strings.Cut(value, ";")
+	if !ok || addrType == "" || encoded == "" {
+		return "", "", errors.New("ORCPT must be addr-type;address")
+	}
+	if addr, err = DecodeXtext(encoded); err != nil {
+		return "", "", fmt.Errorf("invalid ORCPT: %v", err)
+	}
+	return addrType, addr, nil
+}
+
+// Wants reports whether a recipient's NOTIFY keywords ask for a
+// notification of action. Without NOTIFY, failures and delays are reported.
+func Wants(notify []string, action string) bool {
+	if len(notify) == 0 {
+		return action == ActionFailed || action == ActionDelayed
+	}
+	for _, k := range notify {
+		switch {
+		case k == NotifyFailure && action == ActionFailed,
+			k == NotifyDelay && action == ActionDelayed,
+			k == NotifySuccess && (action == ActionDelivered || action == ActionRelayed || action == ActionExpanded):
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeXtext decodes RFC 3461 xtext, where "+" and two hex digits stand
+// for a byte. Only printable ASCII is accepted, since decoded values are
+// written into notification headers.
+func DecodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+3 > len(s) {
+				return "", errors.New("truncated hex escape")
+			}
+			n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil || strings.ToUpper(s[i+1:i+3]) != s[i+1:i+3] {
+				return "", fmt.Errorf("invalid hex escape %q", s[i:i+3])
+			}
+			if n < ' ' || n > '~' {
+				return "", fmt.Errorf("unprintable character in hex escape %q", s[i:i+3])
+			}
+			b.WriteByte(byte(n))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", fmt.Errorf("invalid character %q", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
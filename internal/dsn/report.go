@@ -0,0 +1,203 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/pkg/utils"
+)
+
+// Delivery actions (RFC 3464 section 2.3.3)
+const (
+	ActionFailed    = "failed"
+	ActionDelayed   = "delayed"
+	ActionDelivered = "delivered"
+	ActionRelayed   = "relayed"
+	ActionExpanded  = "expanded"
+)
+
+var statusPattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+// Recipient is the per-recipient part of a report
+type Recipient struct {
+	Final        string // address the status applies to
+	Original     string // address given in ORCPT, if any
+	OriginalType string // ORCPT address type; defaults to rfc822
+	Action       string
+	Status       string // enhanced status code; defaults by action
+	Diagnostic   string // SMTP reply, such as "550 5.1.1 User unknown"
+}
+
+// Report is a delivery status notification about one message
+type Report struct {
+	ReportingMTA string // host name of the MTA issuing the report
+	EnvelopeID   string // ENVID given with the original message
+	ArrivalDate  time.Time
+	Return       string // RET: FULL returns the message, HDRS only its header
+	Original     []byte
+	Recipients   []Recipient
+}
+
+// defaultStatus is used when a recipient has no status of its own
+var defaultStatus = map[string]string{
+	ActionFailed:    "5.0.0",
+	ActionDelayed:   "4.0.0",
+	ActionDelivered: "2.0.0",
+	ActionRelayed:   "2.0.0",
+	ActionExpanded:  "2.0.0",
+}
+
+// Build returns the report as a multipart/report message from the mailer
+// daemon to the original sender
+func (r *Report) Build(to string) ([]byte, error) {
+	if to == "" {
+		return nil, errors.New("no notification is sent for a null sender")
+	}
+	if !printable(to) || !printable(r.ReportingMTA) || !printable(r.EnvelopeID) {
+		return nil, errors.New("addresses and identifiers must be printable ASCII")
+	}
+	if len(r.Recipients) == 0 {
+		return nil, errors.New("report has no recipients")
+	}
+
+	recipients := make([]Recipient, len(r.Recipients))
+	for i, rcpt := range r.Recipients {
+		want, ok := defaultStatus[rcpt.Action]
+		if !ok {
+			return nil, fmt.Errorf("unknown action %q", rcpt.Action)
+		}
+		if rcpt.Status == "" {
+			rcpt.Status = want
+		}
+		if !statusPattern.MatchString(rcpt.Status) || rcpt.Status[0] != want[0] {
+			return nil, fmt.Errorf("status %q does not fit action %s", rcpt.Status, rcpt.Action)
+		}
+		if !printable(rcpt.Final) || !printable(rcpt.Original) || !printable(rcpt.OriginalType) || !printable(rcpt.Diagnostic) {
+			return nil, fmt.Errorf("recipient %q has unprintable fields", rcpt.Final)
+		}
+		if rcpt.Original != "" && rcpt.OriginalType == "" {
+			rcpt.OriginalType = "rfc822"
+		}
+		recipients[i] = rcpt
+	}
+
+	now := time.Now()
+	boundary := utils.GenerateID()
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", r.ReportingMTA)
+	fmt.Fprintf(&b, "To: <%s>\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject(recipients))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", utils.GenerateID(), r.ReportingMTA)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n", boundary)
+	b.WriteString("\r\nThis is a MIME-encapsulated message.\r\n")
+
+	// Human-readable explanation
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/plain; charset=us-ascii\r\n\r\n")
+	fmt.Fprintf(&b, "This is the mail system at host %s.\r\n\r\n", r.ReportingMTA)
+	for _, rcpt := range recipients {
+		fmt.Fprintf(&b, "<%s>: %s", rcpt.Final, explain(rcpt.Action))
+		if rcpt.Diagnostic != "" {
+			fmt.Fprintf(&b, "\r\n    %s", rcpt.Diagnostic)
+		}
+		b.WriteString("\r\n\r\n")
+	}
+
+	// Machine-readable status
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", r.ReportingMTA)
+	if r.EnvelopeID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", r.EnvelopeID)
+	}
+	if !r.ArrivalDate.IsZero() {
+		fmt.Fprintf(&b, "Arrival-Date: %s\r\n", r.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, rcpt := range recipients {
+		b.WriteString("\r\n")
+		if rcpt.Original != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s; %s\r\n", rcpt.OriginalType, rcpt.Original)
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", rcpt.Final)
+		fmt.Fprintf(&b, "Action: %s\r\n", rcpt.Action)
+		fmt.Fprintf(&b, "Status: %s\r\n", rcpt.Status)
+		if rcpt.Diagnostic != "" {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", rcpt.Diagnostic)
+		}
+		fmt.Fprintf(&b, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+
+	// The original message, or only its header
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	original := crlf(r.Original)
+	if strings.EqualFold(r.Return, ReturnHeaders) {
+		b.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+		if end := bytes.Index(original, []byte("\r\n\r\n")); end >= 0 {
+			original = original[:end+2]
+		}
+	} else {
+		b.WriteString("Content-Type: message/rfc822\r\n\r\n")
+	}
+	b.Write(original)
+	if !bytes.HasSuffix(original, []byte("\r\n")) {
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+
+	return b.Bytes(), nil
+}
+
+// subject describes the most serious outcome in the report
+func subject(recipients []Recipient) string {
+	delayed := false
+	for _, rcpt := range recipients {
+		switch rcpt.Action {
+		case ActionFailed:
+			return "Undelivered Mail Returned to Sender"
+		case ActionDelayed:
+			delayed = true
+		}
+	}
+	if delayed {
+		return "Delayed Mail (still being retried)"
+	}
+	return "Successful Mail Delivery Report"
+}
+
+func explain(action string) string {
+	switch action {
+	case ActionFailed:
+		return "delivery failed permanently."
+	case ActionDelayed:
+		return "delivery is delayed and will be retried."
+	case ActionRelayed:
+		return "relayed to a system that does not send delivery reports."
+	case ActionExpanded:
+		return "delivered and expanded to further recipients."
+	default:
+		return "delivered successfully."
+	}
+}
+
+// printable reports whether s can be written into a header field as is
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// crlf normalises bare LF line endings to CRLF
+func crlf(b []byte) []byte {
+	return bytes.ReplaceAll(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,240 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// internalDateLayout is the format of INTERNALDATE
+const internalDateLayout = "02-Jan-2006 15:04:05 -0700"
+
+// fetchItem is one data item requested by FETCH
+type fetchItem struct {
+	name    string // e.g. FLAGS, BODY[] or RFC822.SIZE, upper-cased
+	section string // for BODY[...], the text between the brackets
+	body    bool   // BODY[...] or BODY.PEEK[...]
+	peek    bool
+	partial bool
+	offset  int
+	count   int
+}
+
+// parseFetchItems expands a FETCH argument into items
+func parseFetchItems(f field) ([]fetchItem, error) {
+	var names []string
+	if f.isList {
+		for _, item := range f.list {
+			if item.isList {
+				return nil, errors.New("invalid fetch item")
+			}
+			names = append(names, item.text)
+		}
+	} else {
+		switch strings.ToUpper(f.text) {
+		case "ALL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}
+		case "FAST":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+		case "FULL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"}
+		default:
+			names = []string{f.text}
+		}
+	}
+
+	items := make([]fetchItem, 0, len(names))
+	for _, name := range names {
+		item, err := parseFetchItem(name)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func parseFetchItem(s string) (fetchItem, error) {
+	upper := strings.ToUpper(s)
+	switch upper {
+	case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODYSTRUCTURE", "BODY",
+		"RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		return fetchItem{name: upper}, nil
+	}
+
+	item := fetchItem{body: true}
+	switch {
+	case strings.HasPrefix(upper, "BODY["):
+	case strings.HasPrefix(upper, "BODY.PEEK["):
+		item.peek = true
+	default:
+		return item, fmt.Errorf("unknown fetch item %q", s)
+	}
+	open := strings.Index(s, "[")
+	end := strings.LastIndex(s, "]")
+	if end < open {
+		return item, fmt.Errorf("invalid section in %q", s)
+	}
+	item.section = s[open+1 : end]
+	item.name = "BODY[" + item.section + "]"
+
+	if rest := s[end+1:]; rest != "" {
+		if !strings.HasPrefix(rest, "<") || !strings.HasSuffix(rest, ">") {
+			return item, fmt.Errorf("invalid partial in %q", s)
+		}
+		offset, count, ok := strings.Cut(rest[1:len(rest)-1], ".")
+		var err1, err2 error
+		item.offset, err1 = strconv.Atoi(offset)
+		item.count, err2 = strconv.Atoi(count)
+		if !ok || err1 != nil || err2 != nil || item.offset < 0 || item.count <= 0 {
+			return item, fmt.Errorf("invalid partial in %q", s)
+		}
+		item.partial = true
+	}
+	return item, nil
+}
+
+// setsSeen reports whether fetching the item marks the message \Seen
+func (item fetchItem) setsSeen() bool {
+	return (item.body && !item.peek) || item.name == "RFC822" || item.name == "RFC822.TEXT"
+}
+
+// sectionData returns the content of a BODY[...] section
+func sectionData(root *part, raw []byte, section string) ([]byte, error) {
+	spec := strings.ToUpper(section)
+	var path []int
+	for spec != "" {
+		num, rest, _ := strings.Cut(spec, ".")
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			break
+		}
+		path = append(path, n)
+		spec = rest
+		section = section[len(num):]
+		section = strings.TrimPrefix(section, ".")
+	}
+
+	target := root
+	if len(path) > 0 {
+		if target = root.find(path); target == nil {
+			return nil, nil
+		}
+		if spec == "" {
+			return target.body, nil
+		}
+		if spec == "MIME" {
+			return target.header, nil
+		}
+		if target.message != nil {
+			target = target.message
+		}
+	} else if spec == "" {
+		return raw, nil
+	}
+
+	switch {
+	case spec == "HEADER":
+		return target.header, nil
+	case spec == "TEXT":
+		return target.body, nil
+	case strings.HasPrefix(spec, "HEADER.FIELDS.NOT"):
+		return headerFields(target.header, fieldNames(section[len("HEADER.FIELDS.NOT"):]), true), nil
+	case strings.HasPrefix(spec, "HEADER.FIELDS"):
+		return headerFields(target.header, fieldNames(section[len("HEADER.FIELDS"):]), false), nil
+	default:
+		return nil, fmt.Errorf("invalid section %q", section)
+	}
+}
+
+// fieldNames parses the " (FROM TO)" list of HEADER.FIELDS
+func fieldNames(s string) []string {
+	s = strings.Trim(strings.TrimSpace(s), "()")
+	names := strings.Fields(s)
+	for i, name := range names {
+		names[i] = strings.Trim(name, `"`)
+	}
+	return names
+}
+
+// fetchResponse formats the requested data items of one message, marking
+// it \Seen when its content is fetched without PEEK
+func (s *session) fetchResponse(m *message, email *models.Email, items []fetchItem, uid bool) (string, error) {
+	raw := crlf([]byte(email.Raw))
+	var root *part
+
+	var out []string
+	hasUID, hasFlags := false, false
+	markSeen := false
+	for _, item := range items {
+		switch item.name {
+		case "UID":
+			hasUID = true
+		case "FLAGS":
+			hasFlags = true
+		}
+		if item.setsSeen() && !s.box.readOnly {
+			markSeen = true
+		}
+	}
+	if uid && !hasUID {
+		out = append(out, fmt.Sprintf("UID %d", m.uid))
+	}
+	if markSeen && !s.state.hasFlag(m.id, flagSeen) {
+		s.state.storeFlags(m.id, '+', []string{flagSeen})
+		if !hasFlags {
+			items = append(items, fetchItem{name: "FLAGS"})
+		}
+	}
+
+	for _, item := range items {
+		if root == nil && item.name != "UID" && item.name != "FLAGS" && item.name != "INTERNALDATE" && item.name != "RFC822.SIZE" {
+			root = parsePart(raw, "text/plain")
+		}
+
+		switch item.name {
+		case "UID":
+			out = append(out, fmt.Sprintf("UID %d", m.uid))
+		case "FLAGS":
+			out = append(out, "FLAGS ("+strings.Join(s.flags(m), " ")+")")
+		case "INTERNALDATE":
+			out = append(out, "INTERNALDATE "+quote(email.ReceivedAt.Format(internalDateLayout)))
+		case "RFC822.SIZE":
+			out = append(out, fmt.Sprintf("RFC822.SIZE %d", len(raw)))
+		case "ENVELOPE":
+			out = append(out, "ENVELOPE "+envelope(root))
+		case "BODYSTRUCTURE":
+			out = append(out, "BODYSTRUCTURE "+bodyStructure(root, true))
+		case "BODY":
+			out = append(out, "BODY "+bodyStructure(root, false))
+		case "RFC822":
+			out = append(out, "RFC822 "+literal(raw))
+		case "RFC822.HEADER":
+			out = append(out, "RFC822.HEADER "+literal(root.header))
+		case "RFC822.TEXT":
+			out = append(out, "RFC822.TEXT "+literal(root.body))
+		default:
+			data, err := sectionData(root, raw, item.section)
+			if err != nil {
+				return "", err
+			}
+			name := item.name
+			if item.partial {
+				name += fmt.Sprintf("<%d>", item.offset)
+				if item.offset > len(data) {
+					data = nil
+				} else {
+					data = data[item.offset:]
+				}
+				if len(data) > item.count {
+					data = data[:item.count]
+				}
+			}
+			out = append(out, name+" "+literal(data))
+		}
+	}
+	return "(" + strings.Join(out, " ") + ")", nil
+}
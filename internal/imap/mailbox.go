@@ -0,0 +1,262 @@
+package imap
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/storage"
+)
+
+// System flags; any other flag is a keyword
+const (
+	flagSeen     = `\Seen`
+	flagAnswered = `\Answered`
+	flagFlagged  = `\Flagged`
+	flagDeleted  = `\Deleted`
+	flagDraft    = `\Draft`
+	flagRecent   = `\Recent`
+)
+
+// inboxName is the mailbox holding emails not routed to a named inbox
+const inboxName = "INBOX"
+
+// state is shared by all sessions: UIDs, flags and which messages have
+// been announced as recent. \Seen and \Flagged are kept on the stored
+// email, where the API sees them; the rest lives in memory, so other
+// flags are lost and UIDVALIDITY changes when the server restarts.
+type state struct {
+	mu       sync.Mutex
+	storage  storage.Storage
+	validity uint32
+	nextUID  uint32
+	uids     map[string]uint32          // email ID to UID
+	flags    map[string]map[string]bool // email ID to flags not stored on the email
+	claimed  map[string]bool            // emails already recent in some session
+}
+
+func newState(store storage.Storage) *state {
+	return &state{
+		storage:  store,
+		validity: uint32(time.Now().Unix()),
+		nextUID:  1,
+		uids:     make(map[string]uint32),
+		flags:    make(map[string]map[string]bool),
+		claimed:  make(map[string]bool),
+	}
+}
+
+// message is one message of a selected mailbox
+type message struct {
+	id     string
+	uid    uint32
+	recent bool
+	gone   bool // deleted from storage, awaiting an EXPUNGE response
+}
+
+// mailboxOf returns the IMAP mailbox an email belongs to
+func mailboxOf(email *models.Email) string {
+	if email.Inbox == "" || strings.EqualFold(email.Inbox, inboxName) {
+		return inboxName
+	}
+	return email.Inbox
+}
+
+// sameMailbox compares mailbox names; INBOX is case-insensitive
+func sameMailbox(a, b string) bool {
+	if strings.EqualFold(a, inboxName) || strings.EqualFold(b, inboxName) {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// scan lists every email in arrival order, assigning UIDs to new ones and
+// forgetting deleted ones
+func (st *state) scan() ([]*models.Email, error) {
+	emails, err := st.storage.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].ReceivedAt.Before(emails[j].ReceivedAt)
+	})
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	present := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		present[email.ID] = true
+		if _, ok := st.uids[email.ID]; !ok {
+			st.uids[email.ID] = st.nextUID
+			st.nextUID++
+		}
+	}
+	for id := range st.uids {
+		if !present[id] {
+			delete(st.uids, id)
+			delete(st.flags, id)
+			delete(st.claimed, id)
+		}
+	}
+
+	sort.SliceStable(emails, func(i, j int) bool {
+		return st.uids[emails[i].ID] < st.uids[emails[j].ID]
+	})
+	return emails, nil
+}
+
+// mailboxes returns the names of all mailboxes, INBOX first
+func (st *state) mailboxes() ([]string, error) {
+	emails, err := st.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{inboxName}
+	seen := map[string]bool{inboxName: true}
+	for _, email := range emails {
+		if name := mailboxOf(email); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names, nil
+}
+
+// messages returns the messages of a mailbox in UID order. With claim,
+// messages not yet seen by any session are marked recent for the caller.
+func (st *state) messages(name string, claim bool) ([]*message, bool, error) {
+	emails, err := st.scan()
+	if err != nil {
+		return nil, false, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	exists := sameMailbox(name, inboxName)
+	var msgs []*message
+	for _, email := range emails {
+		if !sameMailbox(mailboxOf(email), name) {
+			continue
+		}
+		exists = true
+		m := &message{id: email.ID, uid: st.uids[email.ID]}
+		if !st.claimed[email.ID] {
+			m.recent = true
+			if claim {
+				st.claimed[email.ID] = true
+			}
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, exists, nil
+}
+
+// uidNext is the UID the next message will get
+func (st *state) uidNext() uint32 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.nextUID
+}
+
+// getFlags returns the flags of an email, sorted
+func (st *state) getFlags(id string) []string {
+	email, err := st.storage.Get(id)
+	if err != nil {
+		return nil
+	}
+	return sortedFlags(st.flagSet(email))
+}
+
+func (st *state) hasFlag(id, flag string) bool {
+	email, err := st.storage.Get(id)
+	if err != nil {
+		return false
+	}
+	return st.flagSet(email)[flag]
+}
+
+// flagSet combines the flags stored on an email with those in memory
+func (st *state) flagSet(email *models.Email) map[string]bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	set := map[string]bool{}
+	for flag := range st.flags[email.ID] {
+		set[flag] = true
+	}
+	if email.Seen {
+		set[flagSeen] = true
+	}
+	if email.Flagged {
+		set[flagFlagged] = true
+	}
+	return set
+}
+
+// storeFlags replaces (op 0), adds (op '+') or removes (op '-') flags and
+// returns the result
+func (st *state) storeFlags(id string, op byte, flags []string) []string {
+	email, err := st.storage.Get(id)
+	if err != nil {
+		return nil
+	}
+
+	set := st.flagSet(email)
+	if op == 0 {
+		set = map[string]bool{}
+	}
+	for _, flag := range flags {
+		flag = canonicalFlag(flag)
+		if flag == flagRecent {
+			continue // cannot be changed by clients
+		}
+		if op == '-' {
+			delete(set, flag)
+		} else {
+			set[flag] = true
+		}
+	}
+
+	seen, flagged := set[flagSeen], set[flagFlagged]
+	if seen != email.Seen || flagged != email.Flagged {
+		st.storage.Update(id, &models.EmailUpdate{Seen: &seen, Flagged: &flagged})
+	}
+
+	st.mu.Lock()
+	memory := make(map[string]bool, len(set))
+	for flag := range set {
+		if flag != flagSeen && flag != flagFlagged {
+			memory[flag] = true
+		}
+	}
+	st.flags[id] = memory
+	st.mu.Unlock()
+
+	return sortedFlags(set)
+}
+
+func sortedFlags(set map[string]bool) []string {
+	flags := make([]string, 0, len(set))
+	for flag := range set {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// canonicalFlag spells system flags the standard way; they are
+// case-insensitive
+func canonicalFlag(flag string) string {
+	for _, f := range []string{flagSeen, flagAnswered, flagFlagged, flagDeleted, flagDraft, flagRecent} {
+		if strings.EqualFold(flag, f) {
+			return f
+		}
+	}
+	return flag
+}
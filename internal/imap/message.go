@@ -0,0 +1,307 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// part is a MIME entity of a message, kept as raw bytes so sections can
+// be served exactly as received
+type part struct {
+	header   []byte // including the blank line that ends it
+	body     []byte
+	fields   textproto.MIMEHeader
+	mimeType string // lower case, e.g. "text/plain"
+	params   map[string]string
+	children []*part // parts of a multipart
+	message  *part   // the message inside a message/rfc822
+}
+
+// parsePart splits a raw entity into header and body and parses any
+// nested parts. Every message is returned with CRLF line endings.
+func parsePart(raw []byte, defaultType string) *part {
+	p := &part{}
+	if end := bytes.Index(raw, []byte("\r\n\r\n")); end >= 0 {
+		p.header, p.body = raw[:end+4], raw[end+4:]
+	} else if bytes.HasPrefix(raw, []byte("\r\n")) {
+		p.header, p.body = raw[:2], raw[2:]
+	} else {
+		p.header = raw
+	}
+
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(p.header)))
+	p.fields, _ = r.ReadMIMEHeader()
+
+	p.mimeType, p.params = defaultType, map[string]string{}
+	if ct := p.fields.Get("Content-Type"); ct != "" {
+		if mt, params, err := mime.ParseMediaType(ct); err == nil {
+			p.mimeType, p.params = mt, params
+		}
+	}
+	if p.mimeType == "text/plain" && p.params["charset"] == "" {
+		p.params["charset"] = "us-ascii"
+	}
+
+	switch {
+	case strings.HasPrefix(p.mimeType, "multipart/") && p.params["boundary"] != "":
+		childType := "text/plain"
+		if p.mimeType == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+		for _, raw := range splitMultipart(p.body, p.params["boundary"]) {
+			p.children = append(p.children, parsePart(raw, childType))
+		}
+	case p.mimeType == "message/rfc822":
+		p.message = parsePart(p.body, "text/plain")
+	}
+	return p
+}
+
+// splitMultipart returns the raw bytes of each part between boundaries
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for pos := 0; pos < len(body); {
+		end := bytes.Index(body[pos:], []byte("\r\n"))
+		lineEnd := len(body)
+		if end >= 0 {
+			lineEnd = pos + end
+		}
+		line := body[pos:lineEnd]
+		next := lineEnd + 2
+
+		if bytes.HasPrefix(line, delim) {
+			rest := bytes.TrimRight(line[len(delim):], " \t")
+			if len(rest) == 0 || bytes.Equal(rest, []byte("--")) {
+				if start >= 0 {
+					// The CRLF before the delimiter belongs to it
+					stop := pos - 2
+					if stop < start {
+						stop = start
+					}
+					parts = append(parts, body[start:stop])
+				}
+				if len(rest) > 0 {
+					return parts
+				}
+				start = next
+				if start > len(body) {
+					start = len(body)
+				}
+			}
+		}
+		pos = next
+	}
+	if start >= 0 && start < len(body) {
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+// find returns the part at a section path such as [1 2], or nil
+func (p *part) find(path []int) *part {
+	cur := p
+	for _, n := range path {
+		if cur.message != nil {
+			cur = cur.message
+		}
+		switch {
+		case len(cur.children) > 0:
+			if n < 1 || n > len(cur.children) {
+				return nil
+			}
+			cur = cur.children[n-1]
+		case n == 1:
+			// A non-multipart entity is its own part 1
+		default:
+			return nil
+		}
+	}
+	return cur
+}
+
+// headerFields returns the header lines whose names are (or, with not,
+// are not) in names, followed by a blank line
+func headerFields(header []byte, names []string, not bool) []byte {
+	want := make(map[string]bool, len(names))
+	for _, name := range names {
+		want[strings.ToLower(name)] = true
+	}
+
+	var out bytes.Buffer
+	keep := false
+	for _, line := range bytes.SplitAfter(header, []byte("\r\n")) {
+		if len(line) == 0 || bytes.Equal(line, []byte("\r\n")) {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			keep = want[strings.ToLower(strings.TrimSpace(string(name)))] != not
+		}
+		if keep {
+			out.Write(line)
+		}
+	}
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+// envelope formats the ENVELOPE structure of a message
+func envelope(p *part) string {
+	h := p.fields
+	from := addressList(h.Get("From"))
+	sender := addressList(h.Get("Sender"))
+	if sender == "NIL" {
+		sender = from
+	}
+	replyTo := addressList(h.Get("Reply-To"))
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return fmt.Sprintf("(%s %s %s %s %s %s %s %s %s %s)",
+		nstring(h.Get("Date")), nstring(h.Get("Subject")), from, sender, replyTo,
+		addressList(h.Get("To")), addressList(h.Get("Cc")), addressList(h.Get("Bcc")),
+		nstring(h.Get("In-Reply-To")), nstring(h.Get("Message-Id")))
+}
+
+func addressList(value string) string {
+	if value == "" {
+		return "NIL"
+	}
+	addrs, err := mail.ParseAddressList(value)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+
+	var b strings.Builder
+	b.WriteString("(")
+	for _, addr := range addrs {
+		local, domain, _ := strings.Cut(addr.Address, "@")
+		name := addr.Name
+		if name != "" && !isASCII(name) {
+			name = mime.QEncoding.Encode("utf-8", name)
+		}
+		fmt.Fprintf(&b, "(%s NIL %s %s)", nstring(name), quote(local), nstring(domain))
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// bodyStructure formats BODYSTRUCTURE, or BODY without extension data
+func bodyStructure(p *part, extended bool) string {
+	major, minor, _ := strings.Cut(p.mimeType, "/")
+
+	if len(p.children) > 0 {
+		var b strings.Builder
+		b.WriteString("(")
+		for _, child := range p.children {
+			b.WriteString(bodyStructure(child, extended))
+		}
+		fmt.Fprintf(&b, " %s", quote(strings.ToUpper(minor)))
+		if extended {
+			fmt.Fprintf(&b, " %s %s NIL NIL", paramList(p.params), disposition(p))
+		}
+		b.WriteString(")")
+		return b.String()
+	}
+
+	encoding := p.fields.Get("Content-Transfer-Encoding")
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "(%s %s %s %s %s %s %d",
+		quote(strings.ToUpper(major)), quote(strings.ToUpper(minor)), paramList(p.params),
+		nstring(p.fields.Get("Content-Id")), nstring(p.fields.Get("Content-Description")),
+		quote(strings.ToUpper(encoding)), len(p.body))
+	switch {
+	case p.message != nil:
+		fmt.Fprintf(&b, " %s %s %d", envelope(p.message), bodyStructure(p.message, extended), lineCount(p.body))
+	case major == "text":
+		fmt.Fprintf(&b, " %d", lineCount(p.body))
+	}
+	if extended {
+		fmt.Fprintf(&b, " %s %s NIL", nstring(p.fields.Get("Content-Md5")), disposition(p))
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+func paramList(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		items = append(items, quote(strings.ToUpper(k)), quote(params[k]))
+	}
+	return "(" + strings.Join(items, " ") + ")"
+}
+
+func disposition(p *part) string {
+	value := p.fields.Get("Content-Disposition")
+	if value == "" {
+		return "NIL"
+	}
+	disp, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "NIL"
+	}
+	return fmt.Sprintf("(%s %s)", quote(strings.ToUpper(disp)), paramList(params))
+}
+
+func lineCount(body []byte) int {
+	n := bytes.Count(body, []byte("\n"))
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// nstring formats a string, or NIL when empty
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
+
+// quote formats s as a quoted string, or as a literal if it cannot be
+// quoted
+func quote(s string) string {
+	if strings.ContainsAny(s, "\r\n") || !isASCII(s) {
+		return literal([]byte(s))
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func literal(b []byte) string {
+	return "{" + strconv.Itoa(len(b)) + "}\r\n" + string(b)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// crlf normalises bare LF line endings to CRLF
+func crlf(b []byte) []byte {
+	return bytes.ReplaceAll(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,32 @@
+package imap
+
+import (
+	"github.com/baliboy20/smtp_server_go/internal/metrics"
+)
+
+var (
+	sessionsActive = metrics.NewGauge("imap_sessions_active",
+		"IMAP sessions currently open.")
+	commandsTotal = metrics.NewCounterVec("imap_commands_total",
+		"IMAP commands received by name.", "command")
+	authTotal = metrics.NewCounterVec("imap_auth_total",
+		"IMAP logins by result.", "result")
+)
+
+// knownCommands bounds the cardinality of imap_commands_total
+var knownCommands = map[string]bool{
+	"CAPABILITY": true, "NOOP": true, "LOGOUT": true, "STARTTLS": true,
+	"LOGIN": true, "AUTHENTICATE": true, "SELECT": true, "EXAMINE": true,
+	"CREATE": true, "DELETE": true, "RENAME": true, "SUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "LIST": true, "LSUB": true, "STATUS": true,
+	"APPEND": true, "CHECK": true, "CLOSE": true, "EXPUNGE": true,
+	"SEARCH": true, "FETCH": true, "STORE": true, "COPY": true, "MOVE": true,
+	"UID": true, "IDLE": true, "UNSELECT": true,
+}
+
+func observeCommand(cmd string) {
+	if !knownCommands[cmd] {
+		cmd = "unknown"
+	}
+	commandsTotal.WithLabelValues(cmd).Inc()
+}
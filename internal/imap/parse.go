@@ -0,0 +1,256 @@
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxLiteral bounds the size of a literal sent by a client
+const maxLiteral = 1 << 20
+
+// errSyntax reports a malformed command; the rest of the line is discarded
+var errSyntax = errors.New("syntax error")
+
+// field is one element of a command: an atom, a quoted string, a literal
+// or a parenthesized list
+type field struct {
+	text   string
+	list   []field
+	isList bool
+	atom   bool // unquoted, so NIL and keywords can be told apart
+}
+
+func (f field) String() string {
+	if !f.isList {
+		return f.text
+	}
+	parts := make([]string, len(f.list))
+	for i, item := range f.list {
+		parts[i] = item.String()
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// parser reads commands, including literals, from a client
+type parser struct {
+	r *bufio.Reader
+	// cont is called before a synchronizing literal is read
+	cont func() error
+	eol  bool // the end of the current line has been read
+}
+
+// readCommand reads the fields of one command line
+func (p *parser) readCommand() ([]field, error) {
+	p.eol = false
+	fields, err := p.readList(false)
+	if errors.Is(err, errSyntax) && !p.eol {
+		p.r.ReadString('\n')
+	}
+	return fields, err
+}
+
+// readList reads fields up to the end of the line or, inside a list, the
+// closing parenthesis
+func (p *parser) readList(nested bool) ([]field, error) {
+	fields := []field{}
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch c {
+		case ' ':
+		case '\r':
+			if c, err = p.r.ReadByte(); err != nil {
+				return nil, err
+			}
+			if c != '\n' {
+				return nil, errSyntax
+			}
+			fallthrough
+		case '\n':
+			p.eol = true
+			if nested {
+				return nil, errSyntax
+			}
+			return fields, nil
+		case '(':
+			list, err := p.readList(true)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field{list: list, isList: true})
+		case ')':
+			if !nested {
+				return nil, errSyntax
+			}
+			return fields, nil
+		case '"':
+			s, err := p.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field{text: s})
+		case '{':
+			s, err := p.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field{text: s})
+		default:
+			p.r.UnreadByte()
+			s, err := p.readAtom()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field{text: s, atom: true})
+		}
+	}
+}
+
+func (p *parser) readQuoted() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if c, err = p.r.ReadByte(); err != nil {
+				return "", err
+			}
+		case '\r', '\n':
+			p.r.UnreadByte()
+			return "", errSyntax
+		}
+		b.WriteByte(c)
+	}
+}
+
+// readLiteral reads "{n}" CRLF and n bytes, asking the client to go ahead
+// unless the literal is non-synchronizing ("{n+}")
+func (p *parser) readLiteral() (string, error) {
+	spec, err := p.r.ReadString('}')
+	if err != nil {
+		return "", err
+	}
+	spec = strings.TrimSuffix(spec, "}")
+	sync := !strings.HasSuffix(spec, "+")
+	n, err := strconv.Atoi(strings.TrimSuffix(spec, "+"))
+	if err != nil || n < 0 || n > maxLiteral {
+		return "", errSyntax
+	}
+	if line, err := p.r.ReadString('\n'); err != nil || strings.TrimRight(line, "\r\n") != "" {
+		return "", errSyntax
+	}
+
+	if sync && p.cont != nil {
+		if err := p.cont(); err != nil {
+			return "", err
+		}
+	}
+	buf := make([]byte, n)
+	for read := 0; read < n; {
+		m, err := p.r.Read(buf[read:])
+		if err != nil {
+			return "", err
+		}
+		read += m
+	}
+	return string(buf), nil
+}
+
+// readAtom reads an atom. A section such as BODY[HEADER.FIELDS (FROM)]
+// is kept whole, spaces and parentheses included.
+func (p *parser) readAtom() (string, error) {
+	var b strings.Builder
+	depth := 0
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case depth > 0 && c != '\r' && c != '\n':
+		case c == ' ' || c == '(' || c == ')' || c == '\r' || c == '\n':
+			p.r.UnreadByte()
+			if b.Len() == 0 {
+				return "", errSyntax
+			}
+			return b.String(), nil
+		case c == '"' || c == '{' || c < ' ' || c > '~':
+			p.r.UnreadByte()
+			return "", errSyntax
+		}
+		b.WriteByte(c)
+	}
+}
+
+// seqRange is a range of a sequence set; 0 stands for "*"
+type seqRange struct {
+	lo, hi uint32
+}
+
+// seqSet is a parsed sequence set such as "1:4,7,9:*"
+type seqSet []seqRange
+
+func parseSeqSet(s string) (seqSet, error) {
+	var set seqSet
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(part, ":")
+		a, err := parseSeqNumber(lo)
+		if err != nil {
+			return nil, err
+		}
+		b := a
+		if isRange {
+			if b, err = parseSeqNumber(hi); err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, seqRange{a, b})
+	}
+	return set, nil
+}
+
+func parseSeqNumber(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid sequence number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// contains reports whether n is in the set, where "*" stands for max
+func (set seqSet) contains(n, max uint32) bool {
+	for _, r := range set {
+		lo, hi := r.lo, r.hi
+		if lo == 0 {
+			lo = max
+		}
+		if hi == 0 {
+			hi = max
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if n >= lo && n <= hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// searchDateLayout is the format of dates in SEARCH keys
+const searchDateLayout = "2-Jan-2006"
+
+// candidate is a message being matched by SEARCH
+type candidate struct {
+	seq   uint32
+	msg   *message
+	email *models.Email
+	flags map[string]bool
+
+	root *part // parsed on demand
+	raw  []byte
+}
+
+func (c *candidate) parsed() *part {
+	if c.root == nil {
+		c.raw = crlf([]byte(c.email.Raw))
+		c.root = parsePart(c.raw, "text/plain")
+	}
+	return c.root
+}
+
+// header returns the decoded values of a header field, joined
+func (c *candidate) header(name string) string {
+	values := append([]string(nil), c.parsed().fields.Values(name)...)
+	dec := new(mime.WordDecoder)
+	for i, v := range values {
+		if decoded, err := dec.DecodeHeader(v); err == nil {
+			values[i] = decoded
+		}
+	}
+	return strings.Join(values, "\n")
+}
+
+// matcher tests one search key
+type matcher func(c *candidate) bool
+
+// searchContext holds what sequence sets are resolved against
+type searchContext struct {
+	maxSeq uint32
+	maxUID uint32
+}
+
+// parseSearch parses search keys, which are ANDed together
+func parseSearch(fields []field, ctx searchContext) (matcher, error) {
+	var matchers []matcher
+	for len(fields) > 0 {
+		m, rest, err := parseSearchKey(fields, ctx)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+		fields = rest
+	}
+	return func(c *candidate) bool {
+		for _, m := range matchers {
+			if !m(c) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func parseSearchKey(fields []field, ctx searchContext) (matcher, []field, error) {
+	f, rest := fields[0], fields[1:]
+	if f.isList {
+		m, err := parseSearch(f.list, ctx)
+		return m, rest, err
+	}
+
+	// arg takes the next argument of the key
+	arg := func() (string, error) {
+		if len(rest) == 0 || rest[0].isList {
+			return "", fmt.Errorf("%s needs an argument", f.text)
+		}
+		a := rest[0].text
+		rest = rest[1:]
+		return a, nil
+	}
+	flag := func(name string, want bool) matcher {
+		return func(c *candidate) bool { return c.flags[name] == want }
+	}
+	text := func(get func(c *candidate) string) (matcher, error) {
+		needle, err := arg()
+		if err != nil {
+			return nil, err
+		}
+		needle = strings.ToLower(needle)
+		return func(c *candidate) bool {
+			return strings.Contains(strings.ToLower(get(c)), needle)
+		}, nil
+	}
+	date := func(internal bool, cmp func(day, key time.Time) bool) (matcher, error) {
+		a, err := arg()
+		if err != nil {
+			return nil, err
+		}
+		key, err := time.Parse(searchDateLayout, a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q", a)
+		}
+		return func(c *candidate) bool {
+			t := c.email.ReceivedAt
+			if !internal {
+				sent, err := mail.ParseDate(c.parsed().fields.Get("Date"))
+				if err != nil {
+					return false
+				}
+				t = sent
+			}
+			day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+			return cmp(day, key)
+		}, nil
+	}
+	size := func(larger bool) (matcher, error) {
+		a, err := arg()
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q", a)
+		}
+		return func(c *candidate) bool {
+			c.parsed()
+			if larger {
+				return len(c.raw) > n
+			}
+			return len(c.raw) < n
+		}, nil
+	}
+	before := func(day, key time.Time) bool { return day.Before(key) }
+	on := func(day, key time.Time) bool { return day.Equal(key) }
+	since := func(day, key time.Time) bool { return !day.Before(key) }
+
+	var m matcher
+	var err error
+	switch key := strings.ToUpper(f.text); key {
+	case "ALL":
+		m = func(*candidate) bool { return true }
+	case "SEEN", "UNSEEN":
+		m = flag(flagSeen, key == "SEEN")
+	case "ANSWERED", "UNANSWERED":
+		m = flag(flagAnswered, key == "ANSWERED")
+	case "DELETED", "UNDELETED":
+		m = flag(flagDeleted, key == "DELETED")
+	case "FLAGGED", "UNFLAGGED":
+		m = flag(flagFlagged, key == "FLAGGED")
+	case "DRAFT", "UNDRAFT":
+		m = flag(flagDraft, key == "DRAFT")
+	case "RECENT":
+		m = func(c *candidate) bool { return c.msg.recent }
+	case "OLD":
+		m = func(c *candidate) bool { return !c.msg.recent }
+	case "NEW":
+		m = func(c *candidate) bool { return c.msg.recent && !c.flags[flagSeen] }
+	case "KEYWORD", "UNKEYWORD":
+		var kw string
+		if kw, err = arg(); err == nil {
+			want := key == "KEYWORD"
+			m = func(c *candidate) bool { return c.flags[canonicalFlag(kw)] == want }
+		}
+	case "FROM", "TO", "CC", "BCC", "SUBJECT":
+		name := key
+		m, err = text(func(c *candidate) string { return c.header(name) })
+	case "HEADER":
+		var name string
+		if name, err = arg(); err == nil {
+			m, err = text(func(c *candidate) string { return c.header(name) })
+		}
+	case "BODY":
+		m, err = text(func(c *candidate) string { return string(c.parsed().body) })
+	case "TEXT":
+		m, err = text(func(c *candidate) string { c.parsed(); return string(c.raw) })
+	case "BEFORE":
+		m, err = date(true, before)
+	case "ON":
+		m, err = date(true, on)
+	case "SINCE":
+		m, err = date(true, since)
+	case "SENTBEFORE":
+		m, err = date(false, before)
+	case "SENTON":
+		m, err = date(false, on)
+	case "SENTSINCE":
+		m, err = date(false, since)
+	case "LARGER":
+		m, err = size(true)
+	case "SMALLER":
+		m, err = size(false)
+	case "UID":
+		var a string
+		if a, err = arg(); err == nil {
+			var set seqSet
+			if set, err = parseSeqSet(a); err == nil {
+				m = func(c *candidate) bool { return set.contains(c.msg.uid, ctx.maxUID) }
+			}
+		}
+	case "NOT":
+		if len(rest) == 0 {
+			return nil, nil, errors.New("NOT needs a search key")
+		}
+		var inner matcher
+		if inner, rest, err = parseSearchKey(rest, ctx); err == nil {
+			m = func(c *candidate) bool { return !inner(c) }
+		}
+	case "OR":
+		if len(rest) == 0 {
+			return nil, nil, errors.New("OR needs two search keys")
+		}
+		var a, b matcher
+		if a, rest, err = parseSearchKey(rest, ctx); err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			return nil, nil, errors.New("OR needs two search keys")
+		}
+		if b, rest, err = parseSearchKey(rest, ctx); err == nil {
+			m = func(c *candidate) bool { return a(c) || b(c) }
+		}
+	default:
+		set, perr := parseSeqSet(f.text)
+		if perr != nil {
+			return nil, nil, fmt.Errorf("unknown search key %q", f.text)
+		}
+		m = func(c *candidate) bool { return set.contains(c.seq, ctx.maxSeq) }
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, rest, nil
+}
@@ -0,0 +1,836 @@
+// Package imap serves captured mail over IMAP4rev1 (RFC 3501), so that
+// mail clients and IMAP test libraries can read it. INBOX holds emails not
+// routed to a named inbox; each named inbox is a mailbox of its own.
+package imap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/config"
+	"github.com/baliboy20/smtp_server_go/internal/storage"
+	"github.com/baliboy20/smtp_server_go/pkg/utils"
+)
+
+const (
+	// autologoutTimeout is how long a connection may stay silent, IDLE
+	// included (RFC 3501 section 5.4)
+	autologoutTimeout = 30 * time.Minute
+
+	// idlePollInterval is how often an idling client is told of changes
+	idlePollInterval = time.Second
+)
+
+// Server is an IMAP server backed by email storage
+type Server struct {
+	config   *config.Config
+	state    *state
+	mu       sync.Mutex // guards listener
+	listener net.Listener
+}
+
+// NewServer creates a new IMAP server
+func NewServer(cfg *config.Config, store storage.Storage) *Server {
+	return &Server{
+		config: cfg,
+		state:  newState(store),
+	}
+}
+
+// Start starts the IMAP server
+func (s *Server) Start() error {
+	addr := fmt.Sprintf("%s:%s", s.config.SMTPHost, s.config.IMAPPort)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start IMAP server: %w", err)
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	slog.Info("IMAP server listening", "addr", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			slog.Error("Failed to accept IMAP connection", "error", err)
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// Stop stops the IMAP server
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// tlsAvailable reports whether STARTTLS can be offered
+func (s *Server) tlsAvailable() bool {
+	return s.config.EnableTLS && s.config.TLSCertFile != ""
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	sessionsActive.Inc()
+	defer sessionsActive.Dec()
+
+	id := utils.GenerateID()[:12]
+	sess := &session{
+		id:     id,
+		conn:   conn,
+		server: s,
+		state:  s.state,
+		log:    slog.With("imap_session", id, "remote", conn.RemoteAddr().String()),
+	}
+	sess.setConn(conn)
+
+	sess.log.Info("IMAP connection opened")
+	if err := sess.serve(); err != nil && !errors.Is(err, io.EOF) {
+		sess.log.Warn("IMAP session error", "error", err)
+	}
+	sess.log.Info("IMAP connection closed")
+}
+
+// selected is the mailbox a session has selected
+type selected struct {
+	name     string
+	readOnly bool
+	msgs     []*message // in sequence number order
+}
+
+type session struct {
+	id     string
+	log    *slog.Logger
+	conn   net.Conn
+	w      *bufio.Writer
+	p      *parser
+	server *Server
+	state  *state
+	tls    bool
+	user   string // set once authenticated
+	box    *selected
+}
+
+// setConn (re)binds the reader and writer, e.g. after STARTTLS
+func (s *session) setConn(conn net.Conn) {
+	s.conn = conn
+	s.w = bufio.NewWriter(conn)
+	s.p = &parser{
+		r: bufio.NewReader(conn),
+		cont: func() error {
+			s.writeLine("+ Ready for literal data")
+			return s.w.Flush()
+		},
+	}
+}
+
+func (s *session) writeLine(line string) {
+	s.w.WriteString(line)
+	s.w.WriteString("\r\n")
+}
+
+func (s *session) untagged(format string, args ...interface{}) {
+	s.writeLine("* " + fmt.Sprintf(format, args...))
+}
+
+func (s *session) capabilities() string {
+	caps := "IMAP4rev1 LITERAL+ IDLE UIDPLUS UNSELECT"
+	if s.server.tlsAvailable() && !s.tls {
+		caps += " STARTTLS"
+	}
+	return caps + " AUTH=PLAIN"
+}
+
+func (s *session) serve() error {
+	s.writeLine("* OK [CAPABILITY " + s.capabilities() + "] IMAP4rev1 Service Ready")
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		s.conn.SetDeadline(time.Now().Add(autologoutTimeout))
+
+		fields, err := s.p.readCommand()
+		if errors.Is(err, errSyntax) {
+			s.untagged("BAD Syntax error")
+			if err := s.w.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || fields[0].isList || fields[1].isList {
+			s.untagged("BAD Missing command")
+			if err := s.w.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag, cmd, args := fields[0].text, strings.ToUpper(fields[1].text), fields[2:]
+		if cmd == "LOGIN" || cmd == "AUTHENTICATE" {
+			s.log.Debug("Client: " + tag + " " + cmd + " [redacted]")
+		} else {
+			s.log.Debug("Client: " + tag + " " + cmd)
+		}
+		observeCommand(cmd)
+
+		result, err := s.dispatch(tag, cmd, args)
+		if err != nil {
+			return err
+		}
+		if result != "" {
+			s.writeLine(tag + " " + result)
+		}
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+		if cmd == "LOGOUT" {
+			return nil
+		}
+	}
+}
+
+// dispatch runs a command and returns its tagged result, such as
+// "OK FETCH completed"
+func (s *session) dispatch(tag, cmd string, args []field) (string, error) {
+	// Commands valid in any state
+	switch cmd {
+	case "CAPABILITY":
+		s.untagged("CAPABILITY " + s.capabilities())
+		return "OK CAPABILITY completed", nil
+	case "NOOP", "CHECK":
+		if s.box != nil {
+			s.update(true)
+		}
+		return "OK " + cmd + " completed", nil
+	case "LOGOUT":
+		s.untagged("BYE Logging out")
+		return "OK LOGOUT completed", nil
+	}
+
+	if s.user == "" {
+		switch cmd {
+		case "STARTTLS":
+			return s.startTLS(tag)
+		case "LOGIN":
+			return s.login(args)
+		case "AUTHENTICATE":
+			return s.authenticate(args)
+		}
+		return "BAD Not authenticated", nil
+	}
+
+	switch cmd {
+	case "SELECT", "EXAMINE":
+		return s.selectMailbox(cmd, args)
+	case "LIST", "LSUB":
+		return s.list(cmd, args)
+	case "STATUS":
+		return s.status(args)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		return "OK " + cmd + " completed", nil
+	case "CREATE", "DELETE", "RENAME", "APPEND":
+		return "NO [CANNOT] Mailboxes follow the server's inbox routing", nil
+	}
+
+	if s.box == nil {
+		return "BAD No mailbox selected", nil
+	}
+
+	switch cmd {
+	case "FETCH":
+		return s.fetch(args, false)
+	case "STORE":
+		return s.store(args, false)
+	case "SEARCH":
+		return s.search(args, false)
+	case "COPY", "MOVE":
+		return "NO [CANNOT] Mailboxes follow the server's inbox routing", nil
+	case "EXPUNGE":
+		return s.expunge(nil)
+	case "CLOSE":
+		if !s.box.readOnly {
+			s.deleteFlagged(nil)
+		}
+		s.box = nil
+		return "OK CLOSE completed", nil
+	case "UNSELECT":
+		s.box = nil
+		return "OK UNSELECT completed", nil
+	case "IDLE":
+		return s.idle()
+	case "UID":
+		return s.uid(args)
+	}
+	return "BAD Unknown command", nil
+}
+
+func (s *session) login(args []field) (string, error) {
+	if len(args) != 2 || args[0].isList || args[1].isList {
+		return "BAD LOGIN needs a username and password", nil
+	}
+	return s.authorize(args[0].text, args[1].text), nil
+}
+
+// authenticate implements AUTHENTICATE PLAIN, with or without an initial
+// response
+func (s *session) authenticate(args []field) (string, error) {
+	if len(args) == 0 || args[0].isList {
+		return "BAD AUTHENTICATE needs a mechanism", nil
+	}
+	if !strings.EqualFold(args[0].text, "PLAIN") {
+		return "NO Unsupported authentication mechanism", nil
+	}
+
+	response := ""
+	if len(args) > 1 {
+		response = args[1].text
+	} else {
+		s.writeLine("+ ")
+		if err := s.w.Flush(); err != nil {
+			return "", err
+		}
+		line, err := s.p.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		response = strings.TrimRight(line, "\r\n")
+	}
+	if response == "*" {
+		return "BAD Authentication cancelled", nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		authTotal.WithLabelValues("failure").Inc()
+		return "BAD Cannot decode response", nil
+	}
+	// authzid NUL authcid NUL passwd
+	parts := strings.SplitN(string(decoded), "\x00", 3)
+	if len(parts) != 3 {
+		authTotal.WithLabelValues("failure").Inc()
+		return "BAD Malformed PLAIN response", nil
+	}
+	return s.authorize(parts[1], parts[2]), nil
+}
+
+func (s *session) authorize(username, password string) string {
+	if !s.server.config.CheckCredentials(username, password) {
+		authTotal.WithLabelValues("failure").Inc()
+		s.log.Warn("IMAP authentication failed", "user", username)
+		return "NO [AUTHENTICATIONFAILED] Invalid credentials"
+	}
+	authTotal.WithLabelValues("success").Inc()
+	s.user = username
+	s.log = s.log.With("user", username)
+	return "OK [CAPABILITY " + s.capabilities() + "] Logged in"
+}
+
+func (s *session) startTLS(tag string) (string, error) {
+	if !s.server.tlsAvailable() || s.tls {
+		return "NO TLS not available", nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.server.config.TLSCertFile, s.server.config.TLSKeyFile)
+	if err != nil {
+		s.log.Error("Failed to load TLS certificate", "error", err)
+		return "NO TLS not available", nil
+	}
+
+	s.writeLine(tag + " OK Begin TLS negotiation now")
+	if err := s.w.Flush(); err != nil {
+		return "", err
+	}
+
+	tlsConn := tls.Server(s.conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	s.setConn(tlsConn)
+	s.tls = true
+	return "", nil
+}
+
+func (s *session) selectMailbox(cmd string, args []field) (string, error) {
+	s.box = nil
+	if len(args) != 1 || args[0].isList {
+		return "BAD " + cmd + " needs a mailbox name", nil
+	}
+
+	name := args[0].text
+	readOnly := cmd == "EXAMINE"
+	msgs, exists, err := s.state.messages(name, !readOnly)
+	if err != nil {
+		return "NO [SERVERBUG] " + err.Error(), nil
+	}
+	if !exists {
+		return "NO [NONEXISTENT] No such mailbox", nil
+	}
+	if sameMailbox(name, inboxName) {
+		name = inboxName
+	}
+	s.box = &selected{name: name, readOnly: readOnly, msgs: msgs}
+
+	recent, firstUnseen := 0, 0
+	for i, m := range msgs {
+		if m.recent {
+			recent++
+		}
+		if firstUnseen == 0 && !s.state.hasFlag(m.id, flagSeen) {
+			firstUnseen = i + 1
+		}
+	}
+
+	s.untagged(`FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`)
+	if readOnly {
+		s.untagged("OK [PERMANENTFLAGS ()] Read-only mailbox")
+	} else {
+		s.untagged(`OK [PERMANENTFLAGS (\Answered \Flagged \Deleted \Seen \Draft \*)] Flags permitted`)
+	}
+	s.untagged("%d EXISTS", len(msgs))
+	s.untagged("%d RECENT", recent)
+	if firstUnseen > 0 {
+		s.untagged("OK [UNSEEN %d] First unseen message", firstUnseen)
+	}
+	s.untagged("OK [UIDVALIDITY %d] UIDs valid", s.state.validity)
+	s.untagged("OK [UIDNEXT %d] Predicted next UID", s.state.uidNext())
+
+	if readOnly {
+		return "OK [READ-ONLY] EXAMINE completed", nil
+	}
+	return "OK [READ-WRITE] SELECT completed", nil
+}
+
+func (s *session) list(cmd string, args []field) (string, error) {
+	if len(args) != 2 || args[0].isList || args[1].isList {
+		return "BAD " + cmd + " needs a reference and a mailbox pattern", nil
+	}
+	if args[1].text == "" {
+		s.untagged(`%s (\Noselect) "/" ""`, cmd)
+		return "OK " + cmd + " completed", nil
+	}
+
+	names, err := s.state.mailboxes()
+	if err != nil {
+		return "NO [SERVERBUG] " + err.Error(), nil
+	}
+	pattern := args[0].text + args[1].text
+	for _, name := range names {
+		if matchMailbox(pattern, name) {
+			s.untagged(`%s (\HasNoChildren) "/" %s`, cmd, quote(name))
+		}
+	}
+	return "OK " + cmd + " completed", nil
+}
+
+// matchMailbox matches a LIST pattern, where "*" matches anything and "%"
+// anything but the hierarchy delimiter
+func matchMailbox(pattern, name string) bool {
+	if name == inboxName && strings.EqualFold(pattern, inboxName) {
+		return true
+	}
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*', '%':
+			for i := 0; i <= len(name); i++ {
+				if matchMailbox(pattern[1:], name[i:]) {
+					return true
+				}
+				if i < len(name) && pattern[0] == '%' && name[i] == '/' {
+					return false
+				}
+			}
+			return false
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return len(name) == 0
+}
+
+func (s *session) status(args []field) (string, error) {
+	if len(args) != 2 || args[0].isList || !args[1].isList {
+		return "BAD STATUS needs a mailbox name and a list of items", nil
+	}
+
+	name := args[0].text
+	msgs, exists, err := s.state.messages(name, false)
+	if err != nil {
+		return "NO [SERVERBUG] " + err.Error(), nil
+	}
+	if !exists {
+		return "NO [NONEXISTENT] No such mailbox", nil
+	}
+	if sameMailbox(name, inboxName) {
+		name = inboxName
+	}
+
+	var items []string
+	for _, item := range args[1].list {
+		switch key := strings.ToUpper(item.text); key {
+		case "MESSAGES":
+			items = append(items, fmt.Sprintf("MESSAGES %d", len(msgs)))
+		case "RECENT":
+			n := 0
+			for _, m := range msgs {
+				if m.recent {
+					n++
+				}
+			}
+			items = append(items, fmt.Sprintf("RECENT %d", n))
+		case "UIDNEXT":
+			items = append(items, fmt.Sprintf("UIDNEXT %d", s.state.uidNext()))
+		case "UIDVALIDITY":
+			items = append(items, fmt.Sprintf("UIDVALIDITY %d", s.state.validity))
+		case "UNSEEN":
+			n := 0
+			for _, m := range msgs {
+				if !s.state.hasFlag(m.id, flagSeen) {
+					n++
+				}
+			}
+			items = append(items, fmt.Sprintf("UNSEEN %d", n))
+		default:
+			return "BAD Unknown status item " + item.text, nil
+		}
+	}
+	s.untagged("STATUS %s (%s)", quote(name), strings.Join(items, " "))
+	return "OK STATUS completed", nil
+}
+
+func (s *session) uid(args []field) (string, error) {
+	if len(args) == 0 || args[0].isList {
+		return "BAD UID needs a command", nil
+	}
+	switch strings.ToUpper(args[0].text) {
+	case "FETCH":
+		return s.fetch(args[1:], true)
+	case "STORE":
+		return s.store(args[1:], true)
+	case "SEARCH":
+		return s.search(args[1:], true)
+	case "COPY", "MOVE":
+		return "NO [CANNOT] Mailboxes follow the server's inbox routing", nil
+	case "EXPUNGE":
+		if len(args) != 2 || args[1].isList {
+			return "BAD UID EXPUNGE needs a UID set", nil
+		}
+		set, err := parseSeqSet(args[1].text)
+		if err != nil {
+			return "BAD " + err.Error(), nil
+		}
+		return s.expunge(set)
+	}
+	return "BAD Unknown UID command", nil
+}
+
+// number returns a message's sequence number or UID, and the largest
+// value in the mailbox, for matching a sequence set
+func (s *session) number(i int, uid bool) (n, max uint32) {
+	if !uid {
+		return uint32(i + 1), uint32(len(s.box.msgs))
+	}
+	if len(s.box.msgs) > 0 {
+		max = s.box.msgs[len(s.box.msgs)-1].uid
+	}
+	return s.box.msgs[i].uid, max
+}
+
+// flags returns a message's flags, \Recent included
+func (s *session) flags(m *message) []string {
+	flags := s.state.getFlags(m.id)
+	if m.recent {
+		flags = append(flags, flagRecent)
+	}
+	return flags
+}
+
+func (s *session) fetch(args []field, uid bool) (string, error) {
+	if len(args) != 2 || args[0].isList {
+		return "BAD FETCH needs a sequence set and data items", nil
+	}
+	set, err := parseSeqSet(args[0].text)
+	if err != nil {
+		return "BAD " + err.Error(), nil
+	}
+	items, err := parseFetchItems(args[1])
+	if err != nil {
+		return "BAD " + err.Error(), nil
+	}
+
+	for i, m := range s.box.msgs {
+		if n, max := s.number(i, uid); m.gone || !set.contains(n, max) {
+			continue
+		}
+		email, err := s.state.storage.Get(m.id)
+		if err != nil {
+			continue // deleted since the last update
+		}
+		resp, err := s.fetchResponse(m, email, items, uid)
+		if err != nil {
+			return "BAD " + err.Error(), nil
+		}
+		s.untagged("%d FETCH %s", i+1, resp)
+	}
+	s.update(uid)
+	return "OK FETCH completed", nil
+}
+
+func (s *session) store(args []field, uid bool) (string, error) {
+	if len(args) < 3 || args[0].isList || args[1].isList {
+		return "BAD STORE needs a sequence set, an item and flags", nil
+	}
+	if s.box.readOnly {
+		return "NO Mailbox is read-only", nil
+	}
+	set, err := parseSeqSet(args[0].text)
+	if err != nil {
+		return "BAD " + err.Error(), nil
+	}
+
+	item := strings.ToUpper(args[1].text)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	var op byte
+	switch item {
+	case "FLAGS":
+	case "+FLAGS":
+		op = '+'
+	case "-FLAGS":
+		op = '-'
+	default:
+		return "BAD Unknown store item " + args[1].text, nil
+	}
+
+	var flags []string
+	for _, f := range args[2:] {
+		if f.isList {
+			for _, flag := range f.list {
+				flags = append(flags, flag.text)
+			}
+		} else {
+			flags = append(flags, f.text)
+		}
+	}
+
+	for i, m := range s.box.msgs {
+		if n, max := s.number(i, uid); m.gone || !set.contains(n, max) {
+			continue
+		}
+		s.state.storeFlags(m.id, op, flags)
+		if !silent {
+			if uid {
+				s.untagged("%d FETCH (UID %d FLAGS (%s))", i+1, m.uid, strings.Join(s.flags(m), " "))
+			} else {
+				s.untagged("%d FETCH (FLAGS (%s))", i+1, strings.Join(s.flags(m), " "))
+			}
+		}
+	}
+	s.update(uid)
+	return "OK STORE completed", nil
+}
+
+func (s *session) search(args []field, uid bool) (string, error) {
+	// An optional CHARSET comes first
+	if len(args) >= 2 && strings.EqualFold(args[0].text, "CHARSET") && !args[0].isList {
+		switch strings.ToUpper(args[1].text) {
+		case "US-ASCII", "UTF-8":
+		default:
+			return "NO [BADCHARSET (US-ASCII UTF-8)] Unsupported charset", nil
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return "BAD SEARCH needs search keys", nil
+	}
+
+	ctx := searchContext{maxSeq: uint32(len(s.box.msgs))}
+	if len(s.box.msgs) > 0 {
+		ctx.maxUID = s.box.msgs[len(s.box.msgs)-1].uid
+	}
+	match, err := parseSearch(args, ctx)
+	if err != nil {
+		return "BAD " + err.Error(), nil
+	}
+
+	var results []string
+	for i, m := range s.box.msgs {
+		if m.gone {
+			continue
+		}
+		email, err := s.state.storage.Get(m.id)
+		if err != nil {
+			continue
+		}
+		c := &candidate{seq: uint32(i + 1), msg: m, email: email, flags: s.state.flagSet(email)}
+		if match(c) {
+			if uid {
+				results = append(results, fmt.Sprint(m.uid))
+			} else {
+				results = append(results, fmt.Sprint(i+1))
+			}
+		}
+	}
+
+	if len(results) == 0 {
+		s.untagged("SEARCH")
+	} else {
+		s.untagged("SEARCH " + strings.Join(results, " "))
+	}
+	s.update(uid)
+	return "OK SEARCH completed", nil
+}
+
+func (s *session) expunge(set seqSet) (string, error) {
+	if s.box.readOnly {
+		return "NO Mailbox is read-only", nil
+	}
+	if err := s.deleteFlagged(set); err != nil {
+		return "NO [SERVERBUG] " + err.Error(), nil
+	}
+	s.update(true)
+	return "OK EXPUNGE completed", nil
+}
+
+// deleteFlagged deletes from storage the messages marked \Deleted, only
+// those in set if one is given
+func (s *session) deleteFlagged(set seqSet) error {
+	var ids []string
+	for i, m := range s.box.msgs {
+		if m.gone || !s.state.hasFlag(m.id, flagDeleted) {
+			continue
+		}
+		if _, max := s.number(i, true); set != nil && !set.contains(m.uid, max) {
+			continue
+		}
+		ids = append(ids, m.id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// Messages already deleted, e.g. over the API, count as expunged
+	removed, err := s.state.storage.DeleteMany(ids)
+	for _, id := range removed {
+		s.log.Info("Email expunged over IMAP", "id", id)
+	}
+	return err
+}
+
+// update tells the client about messages that arrived or were deleted
+// since it last looked. EXPUNGE responses are held back during FETCH,
+// STORE and SEARCH, which use sequence numbers (RFC 3501 section 7.4.1).
+func (s *session) update(expunge bool) {
+	msgs, _, err := s.state.messages(s.box.name, !s.box.readOnly)
+	if err != nil {
+		s.log.Warn("Failed to list mailbox", "error", err)
+		return
+	}
+	present := make(map[uint32]bool, len(msgs))
+	for _, m := range msgs {
+		present[m.uid] = true
+	}
+
+	for i := len(s.box.msgs) - 1; i >= 0; i-- {
+		m := s.box.msgs[i]
+		if present[m.uid] {
+			continue
+		}
+		if !expunge {
+			m.gone = true
+			continue
+		}
+		s.untagged("%d EXPUNGE", i+1)
+		s.box.msgs = append(s.box.msgs[:i], s.box.msgs[i+1:]...)
+	}
+
+	var last uint32
+	if len(s.box.msgs) > 0 {
+		last = s.box.msgs[len(s.box.msgs)-1].uid
+	}
+	added := false
+	for _, m := range msgs {
+		if m.uid > last {
+			s.box.msgs = append(s.box.msgs, m)
+			added = true
+		}
+	}
+	if added {
+		recent := 0
+		for _, m := range s.box.msgs {
+			if m.recent {
+				recent++
+			}
+		}
+		s.untagged("%d EXISTS", len(s.box.msgs))
+		s.untagged("%d RECENT", recent)
+	}
+}
+
+// idle reports mailbox changes as they happen until the client sends
+// DONE (RFC 2177)
+func (s *session) idle() (string, error) {
+	s.writeLine("+ idling")
+	if err := s.w.Flush(); err != nil {
+		return "", err
+	}
+
+	type result struct {
+		fields []field
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		fields, err := s.p.readCommand()
+		done <- result{fields, err}
+	}()
+
+	ticker := time.NewTicker(idlePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-done:
+			if errors.Is(r.err, errSyntax) || (r.err == nil && (len(r.fields) != 1 || !strings.EqualFold(r.fields[0].text, "DONE"))) {
+				return "BAD Expected DONE", nil
+			}
+			if r.err != nil {
+				return "", r.err
+			}
+			return "OK IDLE terminated", nil
+		case <-ticker.C:
+			s.update(true)
+			if err := s.w.Flush(); err != nil {
+				return "", err
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Package logging configures the process-wide structured logger.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/config"
+)
+
+// New builds a logger writing to w at the given level ("debug", "info",
+// "warn" or "error") in the given format ("text" or "json")
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text", "":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+
+	return slog.New(handler), nil
+}
+
+// Setup installs the configured logger as the slog default. Output from
+// the standard log package is routed through it as well.
+func Setup(cfg *config.Config) error {
+	logger, err := New(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
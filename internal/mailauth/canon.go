@@ -0,0 +1,223 @@
+package mailauth
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Canonicalization algorithms from RFC 6376 section 3.4
+const (
+	Simple  = "simple"
+	Relaxed = "relaxed"
+)
+
+// headerField is one header field exactly as it appeared in the message,
+// including folding and the terminating CRLF
+type headerField struct {
+	name string
+	raw  string
+}
+
+// splitMessage normalises line endings to CRLF and splits a message into
+// its header fields and body
+func splitMessage(raw []byte) ([]headerField, []byte) {
+	msg := normalizeCRLF(raw)
+
+	var headerBlock, body []byte
+	switch {
+	case bytes.HasPrefix(msg, []byte("\r\n")):
+		body = msg[2:]
+	default:
+		if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+			headerBlock, body = msg[:i+2], msg[i+4:]
+		} else {
+			headerBlock = msg
+		}
+	}
+
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(headerBlock), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		fields = append(fields, headerField{name: strings.TrimSpace(name), raw: line})
+	}
+
+	return fields, body
+}
+
+// normalizeCRLF converts bare LF line endings to CRLF
+func normalizeCRLF(b []byte) []byte {
+	if !bytes.Contains(b, []byte("\n")) {
+		return b
+	}
+	var out bytes.Buffer
+	out.Grow(len(b) + len(b)/40)
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(c)
+	}
+	return out.Bytes()
+}
+
+// parseCanonicalization splits a c= tag value into header and body
+// algorithms, applying the RFC 6376 defaults
+func parseCanonicalization(c string) (header, body string, err error) {
+	header, body = Simple, Simple
+	if c != "" {
+		h, b, hasBody := strings.Cut(strings.ToLower(c), "/")
+		header = h
+		if hasBody {
+			body = b
+		}
+	}
+	for _, alg := range []string{header, body} {
+		if alg != Simple && alg != Relaxed {
+			return "", "", fmt.Errorf("unknown canonicalization %q", alg)
+		}
+	}
+	return header, body, nil
+}
+
+// canonicalHeader canonicalises a single header field, keeping its CRLF
+func canonicalHeader(raw, alg string) string {
+	if alg == Simple {
+		return raw
+	}
+
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.TrimSpace(compressWSP(value))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// canonicalBody canonicalises a CRLF-normalised body
+func canonicalBody(body []byte, alg string) []byte {
+	if alg == Relaxed {
+		lines := strings.SplitAfter(string(body), "\r\n")
+		var b strings.Builder
+		b.Grow(len(body))
+		for _, line := range lines {
+			content, hasCRLF := strings.CutSuffix(line, "\r\n")
+			content = strings.TrimRight(compressWSP(content), " ")
+			b.WriteString(content)
+			if hasCRLF {
+				b.WriteString("\r\n")
+			}
+		}
+		body = []byte(b.String())
+	}
+
+	// Both algorithms drop trailing empty lines
+	for bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+		body = body[:len(body)-2]
+	}
+
+	if len(body) > 0 && !bytes.HasSuffix(body, []byte("\r\n")) {
+		body = append(append([]byte(nil), body...), '\r', '\n')
+	}
+	if len(body) == 2 && alg == Relaxed {
+		// A body of only empty lines is empty under relaxed
+		return nil
+	}
+	if len(body) == 0 && alg == Simple {
+		return []byte("\r\n")
+	}
+	return body
+}
+
+// compressWSP replaces runs of spaces and tabs with a single space
+func compressWSP(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || c == '\t' {
+			if !inWSP {
+				b.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// selectHeaders returns the canonicalised fields named in h, choosing
+// repeated fields from the bottom up as RFC 6376 section 5.4.2 requires.
+// Names with no remaining instance contribute nothing.
+func selectHeaders(fields []headerField, names []string, alg string) string {
+	used := make([]bool, len(fields))
+	var b strings.Builder
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				b.WriteString(canonicalHeader(fields[i].raw, alg))
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+// stripSignatureValue removes the value of the b= tag from a raw
+// DKIM-Signature field, leaving everything else byte-for-byte intact
+func stripSignatureValue(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	parts := strings.Split(value, ";")
+	for i, part := range parts {
+		tag, _, ok := strings.Cut(part, "=")
+		if ok && strings.TrimSpace(tag) == "b" {
+			parts[i] = part[:strings.Index(part, "=")+1]
+			// Keep the field's line ending if b= was the last tag
+			if i == len(parts)-1 && strings.HasSuffix(part, "\r\n") {
+				parts[i] += "\r\n"
+			}
+		}
+	}
+	return name + ":" + strings.Join(parts, ";")
+}
+
+// parseTags parses a DKIM tag-value list into a map
+func parseTags(list string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(list, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag %q", part)
+		}
+		name = strings.TrimSpace(name)
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// removeFWS strips all whitespace, as needed for base64 tag values
+func removeFWS(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,294 @@
+package mailauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// DKIM algorithms supported for verification and signing
+const (
+	AlgorithmRSASHA256     = "rsa-sha256"
+	AlgorithmEd25519SHA256 = "ed25519-sha256"
+)
+
+// minRSABits is the smallest RSA key accepted (RFC 8301)
+const minRSABits = 1024
+
+// dkimError classifies a verification failure: permanent errors are
+// "permerror" or "fail", temporary ones "temperror"
+type dkimError struct {
+	result string
+	reason string
+}
+
+func (e *dkimError) Error() string { return e.reason }
+
+func permError(format string, args ...interface{}) error {
+	return &dkimError{"permerror", fmt.Sprintf(format, args...)}
+}
+
+func failure(format string, args ...interface{}) error {
+	return &dkimError{"fail", fmt.Sprintf(format, args...)}
+}
+
+// dkimSignature is a parsed DKIM-Signature header
+type dkimSignature struct {
+	field       headerField
+	algorithm   string
+	domain      string
+	selector    string
+	identity    string
+	headers     []string
+	headerCanon string
+	bodyCanon   string
+	bodyHash    []byte
+	signature   []byte
+	bodyLength  int64 // -1 when l= is absent
+	expires     time.Time
+}
+
+// VerifyDKIM checks every DKIM-Signature header in a raw message. A message
+// without signatures yields a single result of "none".
+func VerifyDKIM(ctx context.Context, resolver Resolver, raw []byte) []models.DKIMResult {
+	fields, body := splitMessage(raw)
+
+	var results []models.DKIMResult
+	for _, field := range fields {
+		if !strings.EqualFold(field.name, "DKIM-Signature") {
+			continue
+		}
+		results = append(results, verifySignature(ctx, resolver, fields, body, field))
+	}
+
+	if len(results) == 0 {
+		return []models.DKIMResult{{Result: "none", Reason: "message not signed"}}
+	}
+	return results
+}
+
+func verifySignature(ctx context.Context, resolver Resolver, fields []headerField, body []byte, field headerField) models.DKIMResult {
+	sig, err := parseSignature(field)
+	result := models.DKIMResult{}
+	if sig != nil {
+		result.Domain = sig.domain
+		result.Selector = sig.selector
+		result.Algorithm = sig.algorithm
+		result.Canonicalization = sig.headerCanon + "/" + sig.bodyCanon
+	}
+	if err == nil {
+		err = sig.verify(ctx, resolver, fields, body)
+	}
+
+	if err == nil {
+		result.Result = "pass"
+		return result
+	}
+
+	var de *dkimError
+	if errors.As(err, &de) {
+		result.Result, result.Reason = de.result, de.reason
+	} else {
+		result.Result, result.Reason = "temperror", err.Error()
+	}
+	return result
+}
+
+func parseSignature(field headerField) (*dkimSignature, error) {
+	_, value, _ := strings.Cut(field.raw, ":")
+	tags, err := parseTags(value)
+	if err != nil {
+		return nil, permError("signature syntax: %v", err)
+	}
+
+	sig := &dkimSignature{
+		field:      field,
+		algorithm:  strings.ToLower(tags["a"]),
+		domain:     strings.ToLower(tags["d"]),
+		selector:   tags["s"],
+		identity:   tags["i"],
+		bodyLength: -1,
+	}
+
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			return sig, permError("signature missing required tag %s=", required)
+		}
+	}
+	if tags["v"] != "1" {
+		return sig, permError("unsupported signature version %q", tags["v"])
+	}
+
+	if sig.headerCanon, sig.bodyCanon, err = parseCanonicalization(tags["c"]); err != nil {
+		return sig, permError("%v", err)
+	}
+
+	for _, h := range strings.Split(tags["h"], ":") {
+		if h = strings.TrimSpace(removeFWS(h)); h != "" {
+			sig.headers = append(sig.headers, h)
+		}
+	}
+	signsFrom := false
+	for _, h := range sig.headers {
+		if strings.EqualFold(h, "From") {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		return sig, permError("From field not signed")
+	}
+
+	if sig.identity == "" {
+		sig.identity = "@" + sig.domain
+	}
+	if at := strings.LastIndex(sig.identity, "@"); at < 0 || !isSubdomain(strings.ToLower(sig.identity[at+1:]), sig.domain) {
+		return sig, permError("identity %q is not within domain %q", sig.identity, sig.domain)
+	}
+
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(removeFWS(tags["bh"])); err != nil {
+		return sig, permError("malformed bh= value")
+	}
+	if sig.signature, err = base64.StdEncoding.DecodeString(removeFWS(tags["b"])); err != nil {
+		return sig, permError("malformed b= value")
+	}
+
+	if l, ok := tags["l"]; ok {
+		if sig.bodyLength, err = strconv.ParseInt(l, 10, 64); err != nil || sig.bodyLength < 0 {
+			return sig, permError("malformed l= value")
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		secs, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return sig, permError("malformed x= value")
+		}
+		sig.expires = time.Unix(secs, 0)
+	}
+
+	return sig, nil
+}
+
+func (sig *dkimSignature) verify(ctx context.Context, resolver Resolver, fields []headerField, body []byte) error {
+	if sig.algorithm != AlgorithmRSASHA256 && sig.algorithm != AlgorithmEd25519SHA256 {
+		return permError("unsupported algorithm %q", sig.algorithm)
+	}
+	if !sig.expires.IsZero() && time.Now().After(sig.expires) {
+		return failure("signature expired")
+	}
+
+	key, err := lookupKey(ctx, resolver, sig.selector, sig.domain)
+	if err != nil {
+		return err
+	}
+
+	// Body hash
+	canonical := canonicalBody(body, sig.bodyCanon)
+	if sig.bodyLength >= 0 {
+		if sig.bodyLength > int64(len(canonical)) {
+			return permError("l= exceeds body length")
+		}
+		canonical = canonical[:sig.bodyLength]
+	}
+	bh := sha256.Sum256(canonical)
+	if subtle.ConstantTimeCompare(bh[:], sig.bodyHash) != 1 {
+		return failure("body hash did not verify")
+	}
+
+	// Header hash, ending with this signature minus its b= value
+	data := selectHeaders(fields, sig.headers, sig.headerCanon)
+	data += strings.TrimSuffix(canonicalHeader(stripSignatureValue(sig.field.raw), sig.headerCanon), "\r\n")
+	digest := sha256.Sum256([]byte(data))
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if sig.algorithm != AlgorithmRSASHA256 {
+			return permError("key type does not match algorithm")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig.signature); err != nil {
+			return failure("signature did not verify")
+		}
+	case ed25519.PublicKey:
+		if sig.algorithm != AlgorithmEd25519SHA256 {
+			return permError("key type does not match algorithm")
+		}
+		if !ed25519.Verify(pub, digest[:], sig.signature) {
+			return failure("signature did not verify")
+		}
+	}
+	return nil
+}
+
+// lookupKey fetches and parses the public key record for selector and domain
+func lookupKey(ctx context.Context, resolver Resolver, selector, domain string) (crypto.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+	records, err := resolver.LookupTXT(ctx, name)
+	if errors.Is(err, ErrNoRecords) {
+		return nil, permError("no key record at %s", name)
+	}
+	if err != nil {
+		return nil, &dkimError{"temperror", fmt.Sprintf("key lookup failed: %v", err)}
+	}
+	if len(records) == 0 {
+		return nil, permError("no key record at %s", name)
+	}
+
+	tags, err := parseTags(records[0])
+	if err != nil {
+		return nil, permError("key record syntax: %v", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, permError("unsupported key version %q", v)
+	}
+
+	p := removeFWS(tags["p"])
+	if p == "" {
+		return nil, permError("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, permError("malformed key data")
+	}
+
+	switch k := strings.ToLower(tags["k"]); k {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// Some publishers use a bare PKCS#1 RSAPublicKey
+			if pub, err = x509.ParsePKCS1PublicKey(der); err != nil {
+				return nil, permError("malformed RSA key")
+			}
+		}
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, permError("key is not RSA")
+		}
+		if rsaKey.N.BitLen() < minRSABits {
+			return nil, permError("RSA key too short (%d bits)", rsaKey.N.BitLen())
+		}
+		return rsaKey, nil
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, permError("malformed Ed25519 key")
+		}
+		return ed25519.PublicKey(der), nil
+	default:
+		return nil, permError("unsupported key type %q", k)
+	}
+}
+
+// isSubdomain reports whether domain equals parent or is beneath it
+func isSubdomain(domain, parent string) bool {
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
@@ -0,0 +1,127 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// multiLabelSuffixes lists common public suffixes of more than one label.
+// Without the full Public Suffix List, the organizational domain is taken
+// as one label below the longest of these, or the last two labels.
+var multiLabelSuffixes = map[string]bool{
+	"co.uk": true, "org.uk": true, "ac.uk": true, "gov.uk": true, "ltd.uk": true, "plc.uk": true,
+	"com.au": true, "net.au": true, "org.au": true, "edu.au": true, "gov.au": true,
+	"co.nz": true, "org.nz": true, "co.jp": true, "ne.jp": true, "or.jp": true, "ac.jp": true,
+	"com.br": true, "com.cn": true, "com.mx": true, "com.tr": true, "com.sg": true,
+	"co.in": true, "co.za": true, "co.kr": true, "com.ar": true, "com.tw": true,
+}
+
+// OrganizationalDomain approximates the RFC 7489 organizational domain
+func OrganizationalDomain(domain string) string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+	if len(labels) <= 2 {
+		return strings.Join(labels, ".")
+	}
+	if multiLabelSuffixes[strings.Join(labels[len(labels)-2:], ".")] {
+		return strings.Join(labels[len(labels)-3:], ".")
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// CheckDMARC evaluates DMARC alignment for the header From domain given
+// the SPF and DKIM results already computed for the message
+func CheckDMARC(ctx context.Context, resolver Resolver, fromDomain string, spf *models.SPFResult, dkim []models.DKIMResult) *models.DMARCResult {
+	fromDomain = strings.ToLower(fromDomain)
+	result := &models.DMARCResult{FromDomain: fromDomain}
+	if fromDomain == "" {
+		result.Result, result.Reason = "permerror", "no single From domain"
+		return result
+	}
+
+	orgDomain := OrganizationalDomain(fromDomain)
+	tags, err := lookupDMARC(ctx, resolver, fromDomain)
+	inherited := false
+	if errors.Is(err, ErrNoRecords) && orgDomain != fromDomain {
+		tags, err = lookupDMARC(ctx, resolver, orgDomain)
+		inherited = true
+	}
+	switch {
+	case errors.Is(err, ErrNoRecords):
+		result.Result, result.Reason = "none", "no DMARC record"
+		return result
+	case err != nil:
+		var de *dkimError
+		if errors.As(err, &de) {
+			result.Result, result.Reason = de.result, de.reason
+		} else {
+			result.Result, result.Reason = "temperror", err.Error()
+		}
+		return result
+	}
+
+	result.Policy = strings.ToLower(tags["p"])
+	if sp, ok := tags["sp"]; ok && inherited {
+		result.Policy = strings.ToLower(sp)
+	}
+
+	strictSPF := strings.EqualFold(tags["aspf"], "s")
+	strictDKIM := strings.EqualFold(tags["adkim"], "s")
+
+	if spf != nil && spf.Result == SPFPass {
+		result.SPFAligned = aligned(spf.Domain, fromDomain, strictSPF)
+	}
+	for _, d := range dkim {
+		if d.Result == "pass" && aligned(d.Domain, fromDomain, strictDKIM) {
+			result.DKIMAligned = true
+			break
+		}
+	}
+
+	if result.SPFAligned || result.DKIMAligned {
+		result.Result = "pass"
+	} else {
+		result.Result, result.Reason = "fail", "no aligned SPF or DKIM pass"
+	}
+	return result
+}
+
+// lookupDMARC returns the tags of the DMARC record for domain
+func lookupDMARC(ctx context.Context, resolver Resolver, domain string) (map[string]string, error) {
+	records, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+	for _, r := range records {
+		if strings.HasPrefix(strings.TrimSpace(r), "v=DMARC1") {
+			found = append(found, r)
+		}
+	}
+	// None, or more than one, means no usable policy (RFC 7489 section 6.6.3)
+	if len(found) != 1 {
+		return nil, ErrNoRecords
+	}
+
+	tags, err := parseTags(found[0])
+	if err != nil {
+		return nil, permError("DMARC record syntax: %v", err)
+	}
+	if _, ok := tags["p"]; !ok {
+		return nil, permError("DMARC record missing p=")
+	}
+	return tags, nil
+}
+
+// aligned compares an authenticated domain with the From domain in strict
+// (exact) or relaxed (same organizational domain) mode
+func aligned(authDomain, fromDomain string, strict bool) bool {
+	authDomain = strings.ToLower(authDomain)
+	if strict {
+		return authDomain == fromDomain
+	}
+	return OrganizationalDomain(authDomain) == OrganizationalDomain(fromDomain)
+}
@@ -0,0 +1,212 @@
+// Package mailauth implements sender authentication for captured mail:
+// DKIM verification and signing, SPF evaluation and DMARC alignment.
+package mailauth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrNoRecords is returned by a Resolver when the name has no records of
+// the requested type. Any other error is treated as temporary.
+var ErrNoRecords = errors.New("no such record")
+
+// Resolver performs the DNS lookups needed by SPF, DKIM and DMARC
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// DNSResolver resolves through the system resolver
+type DNSResolver struct {
+	resolver *net.Resolver
+}
+
+// NewDNSResolver creates a resolver backed by net.DefaultResolver
+func NewDNSResolver() *DNSResolver {
+	return &DNSResolver{resolver: net.DefaultResolver}
+}
+
+func (r *DNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := r.resolver.LookupTXT(ctx, name)
+	return records, translateDNSError(err)
+}
+
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, translateDNSError(err)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+func (r *DNSResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, err := r.resolver.LookupMX(ctx, name)
+	return records, translateDNSError(err)
+}
+
+func translateDNSError(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return ErrNoRecords
+	}
+	return err
+}
+
+// ZoneResolver answers lookups from a static table, so tests can run
+// without network access. Names are matched case-insensitively, with or
+// without a trailing dot.
+type ZoneResolver struct {
+	txt map[string][]string
+	ip  map[string][]net.IP
+	mx  map[string][]*net.MX
+}
+
+// NewZoneResolver creates an empty zone
+func NewZoneResolver() *ZoneResolver {
+	return &ZoneResolver{
+		txt: make(map[string][]string),
+		ip:  make(map[string][]net.IP),
+		mx:  make(map[string][]*net.MX),
+	}
+}
+
+// LoadZoneFile reads a zone from a file with one record per line:
+//
+//	example.com.                 TXT  "v=spf1 ip4:192.0.2.0/24 -all"
+//	sel._domainkey.example.com.  TXT  "v=DKIM1; k=ed25519; " "p=..."
+//	mail.example.com.            A    192.0.2.10
+//	example.com.                 MX   10 mail.example.com.
+//
+// Blank lines and lines starting with ';' or '#' are ignored. Quoted TXT
+// strings on one line are concatenated.
+func LoadZoneFile(path string) (*ZoneResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zone := NewZoneResolver()
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected NAME TYPE VALUE", path, lineNo)
+		}
+		name, typ := fields[0], strings.ToUpper(fields[1])
+
+		switch typ {
+		case "TXT":
+			afterName := strings.TrimSpace(line[len(fields[0]):])
+			zone.AddTXT(name, unquoteTXT(strings.TrimSpace(afterName[len(fields[1]):])))
+		case "A", "AAAA":
+			ip := net.ParseIP(fields[2])
+			if ip == nil {
+				return nil, fmt.Errorf("%s:%d: invalid address %q", path, lineNo, fields[2])
+			}
+			zone.AddIP(name, ip)
+		case "MX":
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("%s:%d: MX needs a preference and a host", path, lineNo)
+			}
+			pref, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid MX preference %q", path, lineNo, fields[2])
+			}
+			zone.AddMX(name, uint16(pref), fields[3])
+		default:
+			return nil, fmt.Errorf("%s:%d: unsupported record type %s", path, lineNo, typ)
+		}
+	}
+
+	return zone, scanner.Err()
+}
+
+// AddTXT adds a TXT record
+func (z *ZoneResolver) AddTXT(name, value string) {
+	key := zoneKey(name)
+	z.txt[key] = append(z.txt[key], value)
+}
+
+// AddIP adds an A or AAAA record
+func (z *ZoneResolver) AddIP(name string, ip net.IP) {
+	key := zoneKey(name)
+	z.ip[key] = append(z.ip[key], ip)
+}
+
+// AddMX adds an MX record
+func (z *ZoneResolver) AddMX(name string, pref uint16, host string) {
+	key := zoneKey(name)
+	z.mx[key] = append(z.mx[key], &net.MX{Host: host, Pref: pref})
+	sort.SliceStable(z.mx[key], func(i, j int) bool { return z.mx[key][i].Pref < z.mx[key][j].Pref })
+}
+
+func (z *ZoneResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := z.txt[zoneKey(name)]; ok {
+		return records, nil
+	}
+	return nil, ErrNoRecords
+}
+
+func (z *ZoneResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ips, ok := z.ip[zoneKey(host)]; ok {
+		return ips, nil
+	}
+	return nil, ErrNoRecords
+}
+
+func (z *ZoneResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if records, ok := z.mx[zoneKey(name)]; ok {
+		return records, nil
+	}
+	return nil, ErrNoRecords
+}
+
+func zoneKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// unquoteTXT joins the quoted character-strings of a TXT value. Unquoted
+// values are returned as they are.
+func unquoteTXT(value string) string {
+	if !strings.HasPrefix(value, `"`) {
+		return value
+	}
+
+	var b strings.Builder
+	inQuote, escaped := false, false
+	for _, r := range value {
+		switch {
+		case escaped:
+			b.WriteRune(r)
+			escaped = false
+		case r == '\\' && inQuote:
+			escaped = true
+		case r == '"':
+			inQuote = !inQuote
+		case inQuote:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,465 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// SPF results (RFC 7208 section 2.6)
+const (
+	SPFNone      = "none"
+	SPFNeutral   = "neutral"
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFTempError = "temperror"
+	SPFPermError = "permerror"
+)
+
+// spfLookupLimit is the maximum number of DNS-querying terms per check
+const spfLookupLimit = 10
+
+// CheckSPF evaluates SPF for a client IP. The MAIL FROM identity is used,
+// falling back to postmaster@helo for the null sender.
+func CheckSPF(ctx context.Context, resolver Resolver, ip net.IP, helo, mailFrom string) *models.SPFResult {
+	sender, scope := mailFrom, "mailfrom"
+	if sender == "" {
+		sender, scope = "postmaster@"+helo, "helo"
+	}
+
+	domain := sender[strings.LastIndex(sender, "@")+1:]
+	result := &models.SPFResult{Domain: strings.ToLower(domain), Scope: scope, ClientIP: ip.String()}
+
+	if domain == "" || !strings.Contains(domain, ".") {
+		result.Result, result.Reason = SPFNone, "no valid domain to check"
+		return result
+	}
+
+	c := &spfChecker{ctx: ctx, resolver: resolver, ip: ip, sender: sender, helo: helo}
+	result.Result, result.Reason = c.checkHost(domain, 0)
+	return result
+}
+
+type spfChecker struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+}
+
+// checkHost implements the check_host() function of RFC 7208 section 4
+func (c *spfChecker) checkHost(domain string, depth int) (string, string) {
+	if depth > spfLookupLimit {
+		return SPFPermError, "include loop"
+	}
+
+	record, err := c.fetchRecord(domain)
+	if err != nil {
+		if errors.Is(err, ErrNoRecords) {
+			return SPFNone, "no SPF record for " + domain
+		}
+		var se *spfError
+		if errors.As(err, &se) {
+			return se.result, se.reason
+		}
+		return SPFTempError, err.Error()
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers are name=value; mechanisms may contain ':' or '/' first
+		if name, value, ok := strings.Cut(term, "="); ok && !strings.ContainsAny(name, ":/") {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+
+		matched, err := c.matchMechanism(term, domain, depth)
+		if err != nil {
+			var se *spfError
+			if errors.As(err, &se) {
+				return se.result, se.reason
+			}
+			return SPFTempError, err.Error()
+		}
+		if matched {
+			return qualifier, "matched " + term + " in " + domain
+		}
+	}
+
+	if redirect != "" {
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return SPFPermError, err.Error()
+		}
+		if err := c.countLookup(); err != nil {
+			return SPFPermError, err.Error()
+		}
+		result, reason := c.checkHost(target, depth+1)
+		if result == SPFNone {
+			return SPFPermError, "redirect target " + target + " has no SPF record"
+		}
+		return result, reason
+	}
+
+	return SPFNeutral, "no mechanism matched in " + domain
+}
+
+type spfError struct {
+	result string
+	reason string
+}
+
+func (e *spfError) Error() string { return e.reason }
+
+func spfPermError(format string, args ...interface{}) error {
+	return &spfError{SPFPermError, fmt.Sprintf(format, args...)}
+}
+
+// fetchRecord returns the single v=spf1 record published for domain
+func (c *spfChecker) fetchRecord(domain string) (string, error) {
+	records, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		return "", err
+	}
+
+	var found []string
+	for _, r := range records {
+		lower := strings.ToLower(r)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			found = append(found, r)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", ErrNoRecords
+	case 1:
+		return found[0], nil
+	default:
+		return "", spfPermError("multiple SPF records for %s", domain)
+	}
+}
+
+func (c *spfChecker) countLookup() error {
+	c.lookups++
+	if c.lookups > spfLookupLimit {
+		return spfPermError("too many DNS lookups")
+	}
+	return nil
+}
+
+func (c *spfChecker) matchMechanism(term, domain string, depth int) (bool, error) {
+	name, arg, _ := strings.Cut(term, ":")
+	if i := strings.Index(name, "/"); i >= 0 {
+		// a/24 or mx/24 without a domain
+		name, arg = name[:i], term[i:]
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		return true, nil
+
+	case "include":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		result, reason := c.checkHost(target, depth+1)
+		switch result {
+		case SPFPass:
+			return true, nil
+		case SPFTempError:
+			return false, &spfError{SPFTempError, reason}
+		case SPFPermError, SPFNone:
+			return false, spfPermError("include:%s: %s", target, reason)
+		}
+		return false, nil
+
+	case "a":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		host, cidr4, cidr6, err := c.domainAndCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		return c.matchHost(host, cidr4, cidr6)
+
+	case "mx":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		host, cidr4, cidr6, err := c.domainAndCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := c.resolver.LookupMX(c.ctx, host)
+		if errors.Is(err, ErrNoRecords) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if len(mxs) > spfLookupLimit {
+			return false, spfPermError("too many MX records for %s", host)
+		}
+		for _, mx := range mxs {
+			if ok, err := c.matchHost(mx.Host, cidr4, cidr6); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		// PTR is deprecated (RFC 7208 section 5.5) and never matches here
+		return false, c.countLookup()
+
+	case "ip4", "ip6":
+		network := arg
+		if !strings.Contains(network, "/") {
+			if name == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, spfPermError("invalid network %q", arg)
+		}
+		return ipnet.Contains(c.ip), nil
+
+	case "exists":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := c.resolver.LookupIP(c.ctx, target)
+		if errors.Is(err, ErrNoRecords) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, spfPermError("unknown mechanism %q", term)
+}
+
+// domainAndCIDR parses the "[:domain][/cidr4][//cidr6]" suffix of a and mx
+func (c *spfChecker) domainAndCIDR(arg, domain string) (string, int, int, error) {
+	cidr4, cidr6 := 32, 128
+	spec := arg
+	if i := strings.Index(arg, "/"); i >= 0 {
+		spec = arg[:i]
+		lengths := arg[i+1:]
+		v4, v6, dual := strings.Cut(lengths, "//")
+		if strings.HasPrefix(lengths, "/") {
+			v4, v6, dual = "", lengths[1:], true
+		}
+		var err error
+		if v4 != "" {
+			if cidr4, err = strconv.Atoi(v4); err != nil || cidr4 > 32 {
+				return "", 0, 0, spfPermError("invalid CIDR length %q", v4)
+			}
+		}
+		if dual && v6 != "" {
+			if cidr6, err = strconv.Atoi(v6); err != nil || cidr6 > 128 {
+				return "", 0, 0, spfPermError("invalid CIDR length %q", v6)
+			}
+		}
+	}
+
+	if spec == "" {
+		return domain, cidr4, cidr6, nil
+	}
+	host, err := c.expand(spec, domain)
+	return host, cidr4, cidr6, err
+}
+
+// matchHost reports whether the client IP is within the given prefix of
+// any address of host
+func (c *spfChecker) matchHost(host string, cidr4, cidr6 int) (bool, error) {
+	ips, err := c.resolver.LookupIP(c.ctx, host)
+	if errors.Is(err, ErrNoRecords) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	client4 := c.ip.To4()
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if client4 != nil && (&net.IPNet{IP: ip4, Mask: net.CIDRMask(cidr4, 32)}).Contains(client4) {
+				return true, nil
+			}
+		} else if client4 == nil && (&net.IPNet{IP: ip, Mask: net.CIDRMask(cidr6, 128)}).Contains(c.ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// expand performs macro expansion on a domain-spec (RFC 7208 section 7)
+func (c *spfChecker) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", spfPermError("truncated macro in %q", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", spfPermError("invalid macro in %q", spec)
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 0 {
+			return "", spfPermError("unterminated macro in %q", spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		value, err := c.macroValue(macro, domain)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+func (c *spfChecker) macroValue(macro, domain string) (string, error) {
+	if macro == "" {
+		return "", spfPermError("empty macro")
+	}
+
+	letter := macro[0]
+	local, senderDomain, _ := strings.Cut(c.sender, "@")
+	var value string
+	switch letter | 0x20 { // lower-case
+	case 's':
+		value = c.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = senderDomain
+	case 'd':
+		value = domain
+	case 'h':
+		value = c.helo
+	case 'p':
+		value = "unknown"
+	case 'v':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'i':
+		if ip4 := c.ip.To4(); ip4 != nil {
+			value = ip4.String()
+		} else {
+			nibbles := make([]string, 0, 32)
+			for _, octet := range c.ip.To16() {
+				nibbles = append(nibbles, strconv.FormatInt(int64(octet>>4), 16), strconv.FormatInt(int64(octet&0xf), 16))
+			}
+			value = strings.Join(nibbles, ".")
+		}
+	default:
+		return "", spfPermError("unknown macro letter %q", letter)
+	}
+
+	// Transformers: digits, optional 'r', then delimiters
+	rest := macro[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		keep, _ = strconv.Atoi(rest[:digits])
+		if keep == 0 {
+			return "", spfPermError("invalid macro transformer in %q", macro)
+		}
+	}
+	rest = rest[digits:]
+	reverse := strings.HasPrefix(rest, "r") || strings.HasPrefix(rest, "R")
+	if reverse {
+		rest = rest[1:]
+	}
+	delimiters := rest
+	if delimiters == "" {
+		delimiters = "."
+	}
+
+	if keep > 0 || reverse || rest != "" {
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+		if reverse {
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		value = strings.Join(parts, ".")
+	}
+
+	if letter >= 'A' && letter <= 'Z' {
+		value = url.QueryEscape(value)
+	}
+	return value, nil
+}
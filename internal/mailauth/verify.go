@@ -0,0 +1,118 @@
+package mailauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// Input describes a received message for verification
+type Input struct {
+	Raw      []byte // message as received, before any trace headers
+	ClientIP net.IP
+	Helo     string
+	MailFrom string
+}
+
+// Verifier runs DKIM, SPF and DMARC checks against a resolver
+type Verifier struct {
+	resolver Resolver
+}
+
+// NewVerifier creates a verifier using resolver for all DNS lookups
+func NewVerifier(resolver Resolver) *Verifier {
+	return &Verifier{resolver: resolver}
+}
+
+// Verify authenticates a message
+func (v *Verifier) Verify(ctx context.Context, in Input) *models.AuthResults {
+	results := &models.AuthResults{
+		DKIM: VerifyDKIM(ctx, v.resolver, in.Raw),
+		SPF:  CheckSPF(ctx, v.resolver, in.ClientIP, in.Helo, in.MailFrom),
+	}
+	results.DMARC = CheckDMARC(ctx, v.resolver, fromDomain(in.Raw), results.SPF, results.DKIM)
+	return results
+}
+
+// fromDomain returns the domain of the single author in the From header,
+// or "" if there is not exactly one
+func fromDomain(raw []byte) string {
+	fields, _ := splitMessage(raw)
+
+	var from []headerField
+	for _, f := range fields {
+		if strings.EqualFold(f.name, "From") {
+			from = append(from, f)
+		}
+	}
+	if len(from) != 1 {
+		return ""
+	}
+
+	_, value, _ := strings.Cut(from[0].raw, ":")
+	addrs, err := mail.ParseAddressList(strings.TrimSpace(value))
+	if err != nil || len(addrs) != 1 {
+		return ""
+	}
+	at := strings.LastIndex(addrs[0].Address, "@")
+	if at < 0 {
+		return ""
+	}
+	return addrs[0].Address[at+1:]
+}
+
+// AuthenticationResults formats results as the value of an RFC 8601
+// Authentication-Results header, one method per folded line
+func AuthenticationResults(authservID string, results *models.AuthResults) string {
+	parts := []string{authservID}
+
+	for _, d := range results.DKIM {
+		part := "dkim=" + d.Result + comment(d.Reason)
+		if d.Domain != "" {
+			part += " header.d=" + d.Domain
+		}
+		if d.Selector != "" {
+			part += " header.s=" + d.Selector
+		}
+		if d.Algorithm != "" {
+			part += " header.a=" + d.Algorithm
+		}
+		parts = append(parts, part)
+	}
+
+	if spf := results.SPF; spf != nil {
+		property := "smtp.mailfrom"
+		if spf.Scope == "helo" {
+			property = "smtp.helo"
+		}
+		parts = append(parts, fmt.Sprintf("spf=%s (client-ip %s)%s %s=%s",
+			spf.Result, spf.ClientIP, comment(spf.Reason), property, spf.Domain))
+	}
+
+	if dmarc := results.DMARC; dmarc != nil {
+		part := "dmarc=" + dmarc.Result
+		if dmarc.Policy != "" {
+			part += " (p=" + dmarc.Policy + ")"
+		}
+		part += comment(dmarc.Reason)
+		if dmarc.FromDomain != "" {
+			part += " header.from=" + dmarc.FromDomain
+		}
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, ";\r\n\t")
+}
+
+// comment renders a reason as an RFC 5322 comment, or nothing
+func comment(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	reason = strings.NewReplacer("(", "[", ")", "]", "\r", "", "\n", " ").Replace(reason)
+	return " (" + reason + ")"
+}
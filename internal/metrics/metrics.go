@@ -0,0 +1,427 @@
+// Package metrics implements counters, gauges and histograms exported in
+// the Prometheus text exposition format, without external dependencies.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are histogram buckets in seconds suitable for request latencies
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is anything the registry can expose
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds named metrics for exposition
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// Default is the registry used by the package-level constructors
+var Default = NewRegistry()
+
+// register adds c under name, replacing any previous metric of that name
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors[name] = c
+}
+
+// WriteTo writes every metric in text exposition format, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make(map[string]collector, len(r.collectors))
+	for k, v := range r.collectors {
+		collectors[k] = v
+	}
+	r.mu.Unlock()
+
+	sort.Strings(names)
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, name := range names {
+		collectors[name].write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the registry at a /metrics style endpoint
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// Handler serves the default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// desc is the metadata shared by every metric family
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	bits atomic.Uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add adds v, which must not be negative, to the counter
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	addFloat(&c.bits, v)
+}
+
+// Value returns the current count
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set replaces the gauge value
+func (g *Gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+
+// Inc adds one to the gauge
+func (g *Gauge) Inc() { addFloat(&g.bits, 1) }
+
+// Dec subtracts one from the gauge
+func (g *Gauge) Dec() { addFloat(&g.bits, -1) }
+
+// Add adds v to the gauge
+func (g *Gauge) Add(v float64) { addFloat(&g.bits, v) }
+
+// Value returns the current gauge value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Histogram samples observations into cumulative buckets
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	upper := append([]float64(nil), buckets...)
+	sort.Float64s(upper)
+	return &Histogram{upper: upper, counts: make([]atomic.Uint64, len(upper))}
+}
+
+// Observe records a single value
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.upper, v); i < len(h.upper) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	addFloat(&h.sum, v)
+}
+
+// vec is a family of metrics partitioned by label values
+type vec[T any] struct {
+	desc
+	mu       sync.RWMutex
+	children map[string]*vecChild[T]
+	newChild func() *T
+}
+
+type vecChild[T any] struct {
+	values []string
+	metric *T
+}
+
+func (v *vec[T]) with(values ...string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	child, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return child.metric
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if child, ok = v.children[key]; !ok {
+		child = &vecChild[T]{values: append([]string(nil), values...), metric: v.newChild()}
+		v.children[key] = child
+	}
+	return child.metric
+}
+
+// sorted returns the children ordered by label values for stable output
+func (v *vec[T]) sorted() []*vecChild[T] {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := make([]*vecChild[T], 0, len(keys))
+	for _, key := range keys {
+		out = append(out, v.children[key])
+	}
+	return out
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	vec[Counter]
+}
+
+// NewCounterVec registers a labelled counter on the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec[Counter]{
+		desc:     desc{name: name, help: help, typ: "counter", labels: labels},
+		children: make(map[string]*vecChild[Counter]),
+		newChild: func() *Counter { return &Counter{} },
+	}}
+	Default.register(name, c)
+	return c
+}
+
+// WithLabelValues returns the counter for the given label values
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	return c.with(values...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	for _, child := range c.sorted() {
+		writeSample(w, c.name, c.labels, child.values, child.metric.Value())
+	}
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+// NewGaugeVec registers a labelled gauge on the default registry
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec[Gauge]{
+		desc:     desc{name: name, help: help, typ: "gauge", labels: labels},
+		children: make(map[string]*vecChild[Gauge]),
+		newChild: func() *Gauge { return &Gauge{} },
+	}}
+	Default.register(name, g)
+	return g
+}
+
+// WithLabelValues returns the gauge for the given label values
+func (g *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return g.with(values...)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	for _, child := range g.sorted() {
+		writeSample(w, g.name, g.labels, child.values, child.metric.Value())
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+// NewHistogramVec registers a labelled histogram on the default registry.
+// A nil buckets slice selects DefaultBuckets.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{vec[Histogram]{
+		desc:     desc{name: name, help: help, typ: "histogram", labels: labels},
+		children: make(map[string]*vecChild[Histogram]),
+		newChild: func() *Histogram { return newHistogram(buckets) },
+	}}
+	Default.register(name, h)
+	return h
+}
+
+// WithLabelValues returns the histogram for the given label values
+func (h *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return h.with(values...)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, child := range h.sorted() {
+		hist := child.metric
+		values := append(append([]string(nil), child.values...), "")
+		var cumulative uint64
+		for i, upper := range hist.upper {
+			cumulative += hist.counts[i].Load()
+			values[len(values)-1] = formatFloat(upper)
+			writeSample(w, h.name+"_bucket", labels, values, float64(cumulative))
+		}
+		count := hist.count.Load()
+		values[len(values)-1] = "+Inf"
+		writeSample(w, h.name+"_bucket", labels, values, float64(count))
+		writeSample(w, h.name+"_sum", h.labels, child.values, math.Float64frombits(hist.sum.Load()))
+		writeSample(w, h.name+"_count", h.labels, child.values, float64(count))
+	}
+}
+
+// singleCounter exposes a Counter without labels
+type singleCounter struct {
+	desc
+	*Counter
+}
+
+// NewCounter registers an unlabelled counter on the default registry
+func NewCounter(name, help string) *Counter {
+	c := &singleCounter{desc{name: name, help: help, typ: "counter"}, &Counter{}}
+	Default.register(name, c)
+	return c.Counter
+}
+
+func (c *singleCounter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	writeSample(w, c.name, nil, nil, c.Value())
+}
+
+// singleGauge exposes a Gauge without labels
+type singleGauge struct {
+	desc
+	*Gauge
+}
+
+// NewGauge registers an unlabelled gauge on the default registry
+func NewGauge(name, help string) *Gauge {
+	g := &singleGauge{desc{name: name, help: help, typ: "gauge"}, &Gauge{}}
+	Default.register(name, g)
+	return g.Gauge
+}
+
+func (g *singleGauge) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	writeSample(w, g.name, nil, nil, g.Value())
+}
+
+// gaugeFunc evaluates a callback at scrape time
+type gaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is computed on every scrape.
+// Registering the same name again replaces the previous callback.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.register(name, &gaugeFunc{desc{name: name, help: help, typ: "gauge"}, fn})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	writeSample(w, g.name, nil, nil, g.fn())
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabel(values[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+// addFloat atomically adds delta to a float64 stored as bits
+func addFloat(bits *atomic.Uint64, delta float64) {
+	for {
+		old := bits.Load()
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if bits.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
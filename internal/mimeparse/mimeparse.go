@@ -0,0 +1,138 @@
+// Package mimeparse splits a MIME message into its text body, HTML body
+// and attachments.
+package mimeparse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// maxDepth bounds the nesting of multipart messages
+const maxDepth = 10
+
+// Header is the subset of a message or part header Parse needs;
+// mail.Header and textproto.MIMEHeader both satisfy it
+type Header interface {
+	Get(key string) string
+}
+
+// Content is the decoded content of a message
+type Content struct {
+	Text        string // first text/plain part that is not an attachment
+	HTML        string // first text/html part that is not an attachment
+	Attachments []models.Attachment
+}
+
+var wordDecoder = &mime.WordDecoder{}
+
+// Parse decodes a message body given its header. Parts marked as
+// attachments, or carrying a file name, become attachments; so do inline
+// parts other than text, such as images referenced by Content-ID.
+func Parse(header Header, body []byte) *Content {
+	c := &Content{}
+	c.walk(header, body, 0)
+	return c
+}
+
+func (c *Content) walk(header Header, body []byte, depth int) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && depth < maxDepth {
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			data, _ := io.ReadAll(p)
+			c.walk(p.Header, data, depth+1)
+		}
+	}
+
+	data := decodeTransfer(header.Get("Content-Transfer-Encoding"), body)
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := decodeWord(dispParams["filename"])
+	if filename == "" {
+		filename = decodeWord(params["name"])
+	}
+	contentID := strings.Trim(strings.TrimSpace(header.Get("Content-ID")), "<>")
+
+	isText := mediaType == "text/plain" || mediaType == "text/html"
+	if disposition != "attachment" && filename == "" && isText {
+		text := decodeCharset(params["charset"], data)
+		if mediaType == "text/html" && c.HTML == "" {
+			c.HTML = text
+			return
+		}
+		if mediaType == "text/plain" && c.Text == "" {
+			c.Text = text
+			return
+		}
+	}
+
+	if disposition == "" && filename == "" && contentID == "" && isText {
+		return // a further alternative, such as a second text part
+	}
+	c.Attachments = append(c.Attachments, models.Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		ContentID:   contentID,
+		Inline:      disposition == "inline" || (disposition == "" && contentID != ""),
+		Size:        int64(len(data)),
+		Data:        data,
+	})
+}
+
+func decodeWord(s string) string {
+	if decoded, err := wordDecoder.DecodeHeader(s); err == nil {
+		return decoded
+	}
+	return s
+}
+
+// decodeTransfer undoes a Content-Transfer-Encoding, returning the body
+// unchanged if it cannot be decoded
+func decodeTransfer(encoding string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		if data, err := base64.StdEncoding.DecodeString(string(clean)); err == nil {
+			return data
+		}
+	case "quoted-printable":
+		if data, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body))); err == nil {
+			return data
+		}
+	}
+	return body
+}
+
+// decodeCharset converts Latin-1 text to UTF-8; other charsets are kept
+// as they are
+func decodeCharset(charset string, data []byte) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "us-ascii":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return string(data)
+}
@@ -0,0 +1,24 @@
+package models
+
+// ChaosConfig describes faults injected into SMTP sessions to simulate a
+// misbehaving server
+type ChaosConfig struct {
+	Enabled         bool         `json:"enabled"`
+	GreetingDelayMS int          `json:"greeting_delay_ms,omitempty"` // wait before the 220 banner
+	LatencyMS       int          `json:"latency_ms,omitempty"`        // added before every reply
+	JitterMS        int          `json:"jitter_ms,omitempty"`         // random extra latency up to this
+	Faults          []ChaosFault `json:"faults,omitempty"`
+}
+
+// ChaosFault fails a stage of the conversation, optionally only for some
+// messages or recipients. The first matching fault for a stage applies.
+type ChaosFault struct {
+	Stage      string   `json:"stage"`             // connect, mail, rcpt or data
+	Code       int      `json:"code,omitempty"`    // 4xx or 5xx reply code
+	Message    string   `json:"message,omitempty"` // reply text
+	Percent    *float64 `json:"percent,omitempty"` // chance of applying; omitted means always
+	Recipients []string `json:"recipients,omitempty"`
+	DelayMS    int      `json:"delay_ms,omitempty"`         // wait before the fault reply
+	Drop       bool     `json:"drop,omitempty"`             // close the connection instead of replying
+	DropAfter  int      `json:"drop_after_bytes,omitempty"` // with drop at data: bytes read first
+}
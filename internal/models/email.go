@@ -10,12 +10,68 @@ type Email struct {
 	From        string       `json:"from"`
 	To          []string     `json:"to"`
 	Subject     string       `json:"subject"`
+	MessageID   string       `json:"message_id,omitempty"`  // without angle brackets
+	InReplyTo   string       `json:"in_reply_to,omitempty"` // first ID of In-Reply-To
+	References  []string     `json:"references,omitempty"`
 	Body        string       `json:"body"`
 	HTML        string       `json:"html,omitempty"`
 	Headers     []Header     `json:"headers"`
 	Attachments []Attachment `json:"attachments,omitempty"`
 	ReceivedAt  time.Time    `json:"received_at"`
 	Size        int64        `json:"size"`
+	Raw         string       `json:"raw,omitempty"`
+	Tags        []string     `json:"tags,omitempty"`
+	Inbox       string       `json:"inbox,omitempty"`
+	Seen        bool         `json:"seen"`
+	Flagged     bool         `json:"flagged"`
+	Notes       string       `json:"notes,omitempty"`
+	ExpiresAt   *time.Time   `json:"expires_at,omitempty"`
+	Envelope    *Envelope    `json:"envelope,omitempty"`
+	Session     *Session     `json:"session,omitempty"`
+	Auth        *AuthResults `json:"authentication,omitempty"`
+	Spam        *SpamReport  `json:"spam,omitempty"`
+	Transcript  *Transcript  `json:"transcript,omitempty"`
+}
+
+// EmailUpdate changes the mutable state of a stored email. Nil fields are
+// left alone; Tags replaces the tag list, AddTags and RemoveTags edit it.
+type EmailUpdate struct {
+	Seen       *bool     `json:"seen,omitempty"`
+	Flagged    *bool     `json:"flagged,omitempty"`
+	Tags       *[]string `json:"tags,omitempty"`
+	AddTags    []string  `json:"add_tags,omitempty"`
+	RemoveTags []string  `json:"remove_tags,omitempty"`
+	Notes      *string   `json:"notes,omitempty"`
+}
+
+// Envelope holds the SMTP envelope of a message alongside the addresses
+// claimed in its headers, which may differ
+type Envelope struct {
+	MailFrom   string            `json:"mail_from"`
+	MailParams map[string]string `json:"mail_params,omitempty"`
+	Recipients []Recipient       `json:"recipients"`
+	HeaderFrom string            `json:"header_from,omitempty"`
+	HeaderTo   []string          `json:"header_to,omitempty"`
+	HeaderCc   []string          `json:"header_cc,omitempty"`
+}
+
+// Recipient is one RCPT TO address with its ESMTP parameters
+type Recipient struct {
+	Address string            `json:"address"`
+	Params  map[string]string `json:"params,omitempty"`
+}
+
+// Session describes the SMTP connection a message arrived on
+type Session struct {
+	ID           string `json:"id"`
+	Helo         string `json:"helo"`
+	ESMTP        bool   `json:"esmtp"`
+	RemoteIP     string `json:"remote_ip"`
+	RemotePort   int    `json:"remote_port"`
+	TLS          bool   `json:"tls"`
+	TLSVersion   string `json:"tls_version,omitempty"`
+	TLSCipher    string `json:"tls_cipher,omitempty"`
+	AuthUsername string `json:"auth_username,omitempty"`
 }
 
 // Header represents an email header
@@ -28,21 +84,101 @@ type Header struct {
 type Attachment struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"` // without angle brackets
+	Inline      bool   `json:"inline,omitempty"`
 	Size        int64  `json:"size"`
 	Data        []byte `json:"data,omitempty"`
 }
 
+// AuthResults holds the sender authentication checks run on receipt
+type AuthResults struct {
+	SPF   *SPFResult   `json:"spf,omitempty"`
+	DKIM  []DKIMResult `json:"dkim"`
+	DMARC *DMARCResult `json:"dmarc,omitempty"`
+}
+
+// SPFResult is the outcome of evaluating SPF for the connecting IP. Scope is
+// "mailfrom", or "helo" for the null sender.
+type SPFResult struct {
+	Result   string `json:"result"`
+	Domain   string `json:"domain"`
+	Scope    string `json:"scope"`
+	ClientIP string `json:"client_ip"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// DKIMResult is the outcome of verifying one DKIM-Signature header
+type DKIMResult struct {
+	Result           string `json:"result"`
+	Domain           string `json:"domain,omitempty"`
+	Selector         string `json:"selector,omitempty"`
+	Algorithm        string `json:"algorithm,omitempty"`
+	Canonicalization string `json:"canonicalization,omitempty"`
+	Reason           string `json:"reason,omitempty"`
+}
+
+// DMARCResult is the DMARC evaluation for the header From domain
+type DMARCResult struct {
+	Result      string `json:"result"`
+	FromDomain  string `json:"from_domain"`
+	Policy      string `json:"policy,omitempty"`
+	SPFAligned  bool   `json:"spf_aligned"`
+	DKIMAligned bool   `json:"dkim_aligned"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// SpamReport scores a message on deliverability heuristics, in the
+// manner of SpamAssassin: each rule that hits adds its score
+type SpamReport struct {
+	Score     float64    `json:"score"`
+	Threshold float64    `json:"threshold"`
+	IsSpam    bool       `json:"is_spam"`
+	Rules     []SpamRule `json:"rules"`
+}
+
+// SpamRule is a heuristic that hit
+type SpamRule struct {
+	Name        string  `json:"name"`
+	Score       float64 `json:"score"`
+	Description string  `json:"description"`
+}
+
+// Transcript is the recorded SMTP dialogue of one session
+type Transcript struct {
+	SessionID  string            `json:"session_id"`
+	RemoteAddr string            `json:"remote_addr"`
+	StartedAt  time.Time         `json:"started_at"`
+	EndedAt    *time.Time        `json:"ended_at,omitempty"`
+	Entries    []TranscriptEntry `json:"entries"`
+}
+
+// TranscriptEntry is a single line of an SMTP session. Direction is
+// "client", "server" or "event" (for things such as TLS handshakes).
+type TranscriptEntry struct {
+	Time      time.Time `json:"time"`
+	ElapsedMS int64     `json:"elapsed_ms"`
+	Direction string    `json:"direction"`
+	Line      string    `json:"line"`
+	TLS       bool      `json:"tls"`
+}
+
 // Stats represents server statistics
 type Stats struct {
 	TotalEmails   int       `json:"total_emails"`
 	TotalSize     int64     `json:"total_size_bytes"`
 	LastEmailAt   time.Time `json:"last_email_at,omitempty"`
 	ServerStarted time.Time `json:"server_started"`
+	UnreadEmails  int       `json:"unread_emails"`
+	FlaggedEmails int       `json:"flagged_emails"`
+
+	// Envelope addresses refused by the SMTP acceptance policy
+	RejectedSenders    int64 `json:"rejected_senders"`
+	RejectedRecipients int64 `json:"rejected_recipients"`
 }
 
 // Webhook represents webhook configuration
 type Webhook struct {
-	URL    string            `json:"url"`
-	Method string            `json:"method"`
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
 	Headers map[string]string `json:"headers,omitempty"`
 }
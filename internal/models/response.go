@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// ResponseRule scripts the server's reply to matching senders or
+// recipients, so tests get the same answer every time
+type ResponseRule struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	Disabled  bool           `json:"disabled,omitempty"`
+	Priority  int            `json:"priority"`         // lower is checked first
+	Stage     string         `json:"stage,omitempty"`  // mail, rcpt (default) or data
+	Sender    string         `json:"sender,omitempty"` // pattern for MAIL FROM
+	Recipient string         `json:"recipient,omitempty"`
+	Code      int            `json:"code,omitempty"` // 4xx or 5xx reply code
+	Message   string         `json:"message,omitempty"`
+	Greylist  *GreylistRules `json:"greylist,omitempty"` // greylist instead of a fixed reply
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// GreylistRules defers the first attempt of each (client IP, sender,
+// recipient) triplet and accepts retries made after Delay
+type GreylistRules struct {
+	Delay    string `json:"delay,omitempty"`    // minimum wait before a retry passes, e.g. "30s"
+	Lifetime string `json:"lifetime,omitempty"` // how long a triplet is remembered; default 24h
+}
+
+// GreylistEntry is a remembered triplet
+type GreylistEntry struct {
+	RemoteIP  string    `json:"remote_ip"`
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	FirstSeen time.Time `json:"first_seen"`
+	Attempts  int       `json:"attempts"`
+	Passed    bool      `json:"passed"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Rule tags, routes or expires emails matching its conditions when they
+// are saved
+type Rule struct {
+	ID         string         `json:"id"`
+	Name       string         `json:"name"`
+	Disabled   bool           `json:"disabled,omitempty"`
+	Priority   int            `json:"priority"` // lower runs first
+	Conditions RuleConditions `json:"conditions"`
+	Actions    RuleActions    `json:"actions"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+// RuleConditions are case-insensitive regular expressions; every set
+// condition must match
+type RuleConditions struct {
+	From    string            `json:"from,omitempty"` // envelope sender or header From
+	To      string            `json:"to,omitempty"`   // any recipient, envelope or header
+	Subject string            `json:"subject,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"` // any value of each named header
+	Tag     string            `json:"tag,omitempty"`     // any tag already on the email
+}
+
+// RuleActions are applied in order of rule priority
+type RuleActions struct {
+	Tags        []string `json:"tags,omitempty"`
+	Inbox       string   `json:"inbox,omitempty"`        // route to a named inbox
+	DeleteAfter string   `json:"delete_after,omitempty"` // duration such as "1h"
+	Delete      bool     `json:"delete,omitempty"`       // accept but do not store
+	Webhook     *Webhook `json:"webhook,omitempty"`
+	Stop        bool     `json:"stop,omitempty"` // skip lower priority rules
+}
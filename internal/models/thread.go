@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+// Thread is a conversation rebuilt from the Message-ID, In-Reply-To and
+// References headers of stored emails
+type Thread struct {
+	ID           string          `json:"id"`      // email ID of the first message
+	Subject      string          `json:"subject"` // without Re: and Fwd: prefixes
+	Participants []string        `json:"participants"`
+	MessageCount int             `json:"message_count"`
+	UnreadCount  int             `json:"unread_count"`
+	FirstAt      time.Time       `json:"first_at"`
+	LastAt       time.Time       `json:"last_at"`
+	Messages     []ThreadMessage `json:"messages,omitempty"` // in thread order
+}
+
+// ThreadMessage places one email within its thread
+type ThreadMessage struct {
+	EmailID    string    `json:"email_id"`
+	MessageID  string    `json:"message_id,omitempty"`
+	ParentID   string    `json:"parent_id,omitempty"` // email ID of the message replied to
+	Depth      int       `json:"depth"`
+	From       string    `json:"from"`
+	Subject    string    `json:"subject"`
+	ReceivedAt time.Time `json:"received_at"`
+	Seen       bool      `json:"seen"`
+}
@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Match selects messages by case-insensitive regular expressions on the
+// envelope and header. All given conditions must hold; a nil Match
+// matches everything.
+type Match struct {
+	From    *regexp.Regexp            // envelope sender
+	To      *regexp.Regexp            // any envelope recipient
+	Subject *regexp.Regexp            // Subject header
+	Headers map[string]*regexp.Regexp // any instance of each named field
+}
+
+// Matches reports whether msg satisfies every condition
+func (m *Match) Matches(msg *Message) bool {
+	if m == nil {
+		return true
+	}
+	if m.From != nil && !m.From.MatchString(msg.MailFrom) {
+		return false
+	}
+	if m.To != nil && !anyMatch(m.To, msg.Recipients) {
+		return false
+	}
+	if m.Subject != nil && !m.Subject.MatchString(msg.Header("Subject")) {
+		return false
+	}
+	for name, re := range m.Headers {
+		if !anyMatch(re, msg.HeaderValues(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func anyMatch(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// HeaderRewrite replaces matches of Pattern in every value of a field
+type HeaderRewrite struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Replace string // may refer to capture groups as $1
+}
+
+// HeaderProcessor removes, rewrites and adds header fields on matching
+// messages, in that order
+type HeaderProcessor struct {
+	Base
+	name    string
+	match   *Match
+	remove  []string
+	rewrite []HeaderRewrite
+	add     []Field
+}
+
+// NewHeaderProcessor creates a header rewriting processor
+func NewHeaderProcessor(name string, match *Match, remove []string, rewrite []HeaderRewrite, add []Field) *HeaderProcessor {
+	return &HeaderProcessor{name: name, match: match, remove: remove, rewrite: rewrite, add: add}
+}
+
+func (p *HeaderProcessor) Name() string { return p.name }
+
+func (p *HeaderProcessor) OnData(s *Session, msg *Message) Verdict {
+	if !p.match.Matches(msg) {
+		return Verdict{}
+	}
+
+	for _, name := range p.remove {
+		msg.RemoveHeader(name)
+	}
+
+	for _, rw := range p.rewrite {
+		n := 0
+		for _, f := range msg.Fields() {
+			if !strings.EqualFold(f.Name, rw.Name) {
+				continue
+			}
+			n++
+			old := f.Text()
+			if updated := rw.Pattern.ReplaceAllString(old, rw.Replace); updated != old {
+				if updated == "" {
+					// An empty value would delete the field; keep it present
+					updated = " "
+				}
+				msg.ChangeHeader(rw.Name, n, updated)
+			}
+		}
+	}
+
+	for _, f := range p.add {
+		msg.AddHeader(f.Name, expand(f.Value, s, msg))
+	}
+	return Verdict{}
+}
+
+// expand substitutes {queue_id}, {session_id}, {helo}, {remote_ip},
+// {hostname} and {tags} in an added header value
+func expand(value string, s *Session, msg *Message) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+	return strings.NewReplacer(
+		"{queue_id}", msg.QueueID,
+		"{session_id}", s.ID,
+		"{helo}", s.Helo,
+		"{remote_ip}", s.RemoteIP,
+		"{hostname}", s.Hostname,
+		"{tags}", strings.Join(msg.Tags, ", "),
+	).Replace(value)
+}
+
+// TagProcessor tags matching messages and can optionally refuse them
+type TagProcessor struct {
+	Base
+	name  string
+	match *Match
+	tags  []string
+	then  Verdict
+}
+
+// NewTagProcessor creates a processor adding tags to matching messages and
+// then returning then, which is usually the zero Verdict
+func NewTagProcessor(name string, match *Match, tags []string, then Verdict) *TagProcessor {
+	return &TagProcessor{name: name, match: match, tags: tags, then: then}
+}
+
+func (p *TagProcessor) Name() string { return p.name }
+
+func (p *TagProcessor) OnData(s *Session, msg *Message) Verdict {
+	if !p.match.Matches(msg) {
+		return Verdict{}
+	}
+	msg.Tag(p.tags...)
+	return p.then
+}
+
+// compileMatchPattern compiles a case-insensitive match expression
+func compileMatchPattern(field, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s pattern %q: %w", field, pattern, err)
+	}
+	return re, nil
+}
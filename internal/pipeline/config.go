@@ -0,0 +1,207 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// fileConfig is the JSON layout of a pipeline file
+type fileConfig struct {
+	Processors []processorConfig `json:"processors"`
+}
+
+type processorConfig struct {
+	Type  string       `json:"type"` // "headers", "tag" or "milter"
+	Name  string       `json:"name"`
+	Match *matchConfig `json:"match"`
+
+	// headers
+	Remove  []string        `json:"remove"`
+	Rewrite []rewriteConfig `json:"rewrite"`
+	Add     []headerConfig  `json:"add"`
+
+	// tag
+	Tags    []string `json:"tags"`
+	Action  string   `json:"action"` // optional "reject", "tempfail" or "discard" after tagging
+	Code    int      `json:"code"`
+	Message string   `json:"message"`
+
+	// milter
+	Address string `json:"address"`
+	Timeout string `json:"timeout"`
+	OnError string `json:"on_error"` // "tempfail" (default), "reject" or "continue"
+}
+
+type matchConfig struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Subject string            `json:"subject"`
+	Headers map[string]string `json:"headers"`
+}
+
+type rewriteConfig struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
+type headerConfig struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// LoadFile builds a pipeline from a JSON file listing processors in order:
+//
+//	{"processors": [
+//	  {"type": "headers", "add": [{"name": "X-Captured-By", "value": "{hostname}"}]},
+//	  {"type": "tag", "tags": ["newsletter"], "match": {"headers": {"List-Id": "."}}},
+//	  {"type": "milter", "address": "inet:11332@127.0.0.1", "on_error": "continue"}
+//	]}
+func LoadFile(path string) (*Pipeline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg fileConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	processors := make([]Processor, 0, len(cfg.Processors))
+	names := make(map[string]bool)
+	for i, pc := range cfg.Processors {
+		if pc.Name == "" {
+			pc.Name = fmt.Sprintf("%s-%d", pc.Type, i+1)
+		}
+		if names[pc.Name] {
+			return nil, fmt.Errorf("%s: duplicate processor name %q", path, pc.Name)
+		}
+		names[pc.Name] = true
+
+		proc, err := pc.build()
+		if err != nil {
+			return nil, fmt.Errorf("%s: processor %q: %w", path, pc.Name, err)
+		}
+		processors = append(processors, proc)
+	}
+	return New(processors...), nil
+}
+
+func (pc processorConfig) build() (Processor, error) {
+	match, err := pc.Match.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	switch pc.Type {
+	case "headers":
+		rewrites := make([]HeaderRewrite, 0, len(pc.Rewrite))
+		for _, rw := range pc.Rewrite {
+			if rw.Name == "" {
+				return nil, fmt.Errorf("rewrite needs a header name")
+			}
+			re, err := regexp.Compile(rw.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rewrite pattern %q: %w", rw.Pattern, err)
+			}
+			rewrites = append(rewrites, HeaderRewrite{Name: rw.Name, Pattern: re, Replace: rw.Replace})
+		}
+		add := make([]Field, 0, len(pc.Add))
+		for _, h := range pc.Add {
+			if h.Name == "" || strings.ContainsAny(h.Name, ": \t") {
+				return nil, fmt.Errorf("invalid header name %q", h.Name)
+			}
+			add = append(add, Field{Name: h.Name, Value: h.Value})
+		}
+		return NewHeaderProcessor(pc.Name, match, pc.Remove, rewrites, add), nil
+
+	case "tag":
+		then, err := parseAction(pc.Action, pc.Code, pc.Message)
+		if err != nil {
+			return nil, err
+		}
+		if len(pc.Tags) == 0 && then.Action == Continue {
+			return nil, fmt.Errorf("tag processor needs tags or an action")
+		}
+		return NewTagProcessor(pc.Name, match, pc.Tags, then), nil
+
+	case "milter":
+		if match != nil {
+			return nil, fmt.Errorf("milter processors do not support match")
+		}
+		timeout := time.Duration(0)
+		if pc.Timeout != "" {
+			if timeout, err = time.ParseDuration(pc.Timeout); err != nil {
+				return nil, fmt.Errorf("invalid timeout %q", pc.Timeout)
+			}
+		}
+		onError := pc.OnError
+		if onError == "" {
+			onError = "tempfail"
+		}
+		verdict, err := parseAction(onError, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		return NewMilterProcessor(pc.Name, pc.Address, timeout, verdict)
+
+	default:
+		return nil, fmt.Errorf("unknown processor type %q", pc.Type)
+	}
+}
+
+// parseAction turns a configured action name into a verdict
+func parseAction(action string, code int, message string) (Verdict, error) {
+	var v Verdict
+	switch strings.ToLower(action) {
+	case "", "continue":
+		return Verdict{}, nil
+	case "reject":
+		v.Action = Reject
+	case "tempfail":
+		v.Action = TempFail
+	case "discard":
+		return Verdict{Action: Discard}, nil
+	default:
+		return v, fmt.Errorf("unknown action %q", action)
+	}
+	if code != 0 {
+		if (v.Action == Reject && (code < 500 || code > 599)) || (v.Action == TempFail && (code < 400 || code > 499)) {
+			return v, fmt.Errorf("reply code %d does not match action %s", code, action)
+		}
+	}
+	v.Code, v.Message = code, message
+	return v, nil
+}
+
+func (mc *matchConfig) compile() (*Match, error) {
+	if mc == nil {
+		return nil, nil
+	}
+
+	m := &Match{Headers: make(map[string]*regexp.Regexp)}
+	var err error
+	if m.From, err = compileMatchPattern("from", mc.From); err != nil {
+		return nil, err
+	}
+	if m.To, err = compileMatchPattern("to", mc.To); err != nil {
+		return nil, err
+	}
+	if m.Subject, err = compileMatchPattern("subject", mc.Subject); err != nil {
+		return nil, err
+	}
+	for name, pattern := range mc.Headers {
+		if pattern == "" {
+			pattern = "^" // presence only
+		}
+		if m.Headers[name], err = compileMatchPattern(name, pattern); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
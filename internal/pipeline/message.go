@@ -0,0 +1,216 @@
+package pipeline
+
+import (
+	"bytes"
+	"net/textproto"
+	"strings"
+)
+
+// Field is one header field. Value is the text after the colon with
+// leading whitespace removed; folded values keep their CRLF line breaks.
+type Field struct {
+	Name  string
+	Value string
+
+	raw string // original bytes, kept so untouched fields round-trip exactly
+}
+
+// Text returns the value unfolded and trimmed
+func (f Field) Text() string {
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(f.Value))
+}
+
+// Message is a received message as seen by OnData hooks. Header edits are
+// tracked so that an unmodified message is stored byte-for-byte.
+type Message struct {
+	QueueID    string
+	MailFrom   string   // envelope sender; processors may change it
+	Recipients []string // envelope recipients; processors may change them
+	Tags       []string
+
+	fields   []Field
+	body     []byte
+	modified bool
+}
+
+// ParseMessage splits a raw message into header fields and body
+func ParseMessage(raw []byte) *Message {
+	msg := &Message{}
+
+	rest := raw
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			end = len(rest) - 1
+		}
+		line := string(rest[:end+1])
+		if strings.TrimRight(line, "\r\n") == "" {
+			rest = rest[end+1:]
+			break
+		}
+		rest = rest[end+1:]
+
+		if (line[0] == ' ' || line[0] == '\t') && len(msg.fields) > 0 {
+			last := &msg.fields[len(msg.fields)-1]
+			last.raw += line
+			last.Value = foldedValue(last.raw)
+			continue
+		}
+
+		name, _, ok := strings.Cut(line, ":")
+		if !ok {
+			// Not a header: the message has no header section
+			msg.fields = nil
+			rest = raw
+			break
+		}
+		msg.fields = append(msg.fields, Field{
+			Name:  strings.TrimSpace(name),
+			Value: foldedValue(line),
+			raw:   line,
+		})
+	}
+	msg.body = rest
+	return msg
+}
+
+// foldedValue extracts the value from a raw header field
+func foldedValue(raw string) string {
+	_, value, _ := strings.Cut(raw, ":")
+	value = strings.TrimRight(value, "\r\n")
+	return strings.TrimLeft(value, " \t")
+}
+
+// Fields returns a copy of the header fields in order
+func (m *Message) Fields() []Field {
+	return append([]Field(nil), m.fields...)
+}
+
+// Header returns the first value of the named field, unfolded, or ""
+func (m *Message) Header(name string) string {
+	for _, f := range m.fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Text()
+		}
+	}
+	return ""
+}
+
+// HeaderValues returns every value of the named field, unfolded
+func (m *Message) HeaderValues(name string) []string {
+	var values []string
+	for _, f := range m.fields {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Text())
+		}
+	}
+	return values
+}
+
+// AddHeader appends a field to the end of the header
+func (m *Message) AddHeader(name, value string) {
+	m.InsertHeader(len(m.fields), name, value)
+}
+
+// InsertHeader inserts a field before position index (0 is the top)
+func (m *Message) InsertHeader(index int, name, value string) {
+	if index < 0 {
+		index = 0
+	}
+	if index > len(m.fields) {
+		index = len(m.fields)
+	}
+	f := Field{Name: textproto.CanonicalMIMEHeaderKey(name), Value: value}
+	m.fields = append(m.fields[:index], append([]Field{f}, m.fields[index:]...)...)
+	m.modified = true
+}
+
+// ChangeHeader replaces the value of the nth (1-based) occurrence of the
+// named field. An empty value removes that occurrence; a missing
+// occurrence is added.
+func (m *Message) ChangeHeader(name string, n int, value string) {
+	seen := 0
+	for i, f := range m.fields {
+		if !strings.EqualFold(f.Name, name) {
+			continue
+		}
+		seen++
+		if seen != n {
+			continue
+		}
+		if value == "" {
+			m.fields = append(m.fields[:i], m.fields[i+1:]...)
+		} else {
+			m.fields[i] = Field{Name: f.Name, Value: value}
+		}
+		m.modified = true
+		return
+	}
+	if value != "" {
+		m.AddHeader(name, value)
+	}
+}
+
+// RemoveHeader removes every occurrence of the named field
+func (m *Message) RemoveHeader(name string) {
+	kept := m.fields[:0]
+	for _, f := range m.fields {
+		if strings.EqualFold(f.Name, name) {
+			m.modified = true
+			continue
+		}
+		kept = append(kept, f)
+	}
+	m.fields = kept
+}
+
+// Body returns the message body
+func (m *Message) Body() []byte {
+	return m.body
+}
+
+// SetBody replaces the message body
+func (m *Message) SetBody(body []byte) {
+	m.body = body
+	m.modified = true
+}
+
+// Tag adds tags to the message, ignoring duplicates
+func (m *Message) Tag(tags ...string) {
+	for _, tag := range tags {
+		if tag == "" || m.HasTag(tag) {
+			continue
+		}
+		m.Tags = append(m.Tags, tag)
+	}
+}
+
+// HasTag reports whether the message carries tag
+func (m *Message) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Modified reports whether the header or body was changed
+func (m *Message) Modified() bool {
+	return m.modified
+}
+
+// Bytes reassembles the message with CRLF line endings for changed fields
+func (m *Message) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, f := range m.fields {
+		if f.raw != "" {
+			buf.WriteString(f.raw)
+			continue
+		}
+		buf.WriteString(f.Name + ": " + f.Value + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(m.body)
+	return buf.Bytes()
+}
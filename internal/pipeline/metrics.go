@@ -0,0 +1,12 @@
+package pipeline
+
+import (
+	"github.com/baliboy20/smtp_server_go/internal/metrics"
+)
+
+var (
+	verdictsTotal = metrics.NewCounterVec("pipeline_verdicts_total",
+		"Processor verdicts by processor, stage and action.", "processor", "stage", "action")
+	processorDuration = metrics.NewHistogramVec("pipeline_processor_duration_seconds",
+		"Time spent in each processor hook.", nil, "processor", "stage")
+)
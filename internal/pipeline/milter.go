@@ -0,0 +1,591 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Milter protocol version 6, as spoken by Sendmail 8.14+ and Postfix
+const milterVersion = 6
+
+// Commands sent to the filter
+const (
+	smficAbort   = 'A'
+	smficBody    = 'B'
+	smficConnect = 'C'
+	smficMacro   = 'D'
+	smficBodyEOB = 'E'
+	smficHelo    = 'H'
+	smficHeader  = 'L'
+	smficMail    = 'M'
+	smficEOH     = 'N'
+	smficOptNeg  = 'O'
+	smficQuit    = 'Q'
+	smficRcpt    = 'R'
+	smficData    = 'T'
+)
+
+// Replies and modification requests from the filter
+const (
+	smfirAddRcpt    = '+'
+	smfirDelRcpt    = '-'
+	smfirAddRcptPar = '2'
+	smfirAccept     = 'a'
+	smfirReplBody   = 'b'
+	smfirContinue   = 'c'
+	smfirDiscard    = 'd'
+	smfirChgFrom    = 'e'
+	smfirAddHeader  = 'h'
+	smfirInsHeader  = 'i'
+	smfirChgHeader  = 'm'
+	smfirProgress   = 'p'
+	smfirQuarantine = 'q'
+	smfirReject     = 'r'
+	smfirSkip       = 's'
+	smfirTempFail   = 't'
+	smfirReplyCode  = 'y'
+)
+
+// Actions a filter may take at end of message
+const (
+	smfifAddHdrs    = 0x01
+	smfifChgBody    = 0x02
+	smfifAddRcpt    = 0x04
+	smfifDelRcpt    = 0x08
+	smfifChgHdrs    = 0x10
+	smfifQuarantine = 0x20
+	smfifChgFrom    = 0x40
+	smfifAddRcptPar = 0x80
+)
+
+// Protocol steps a filter may ask to skip or not answer
+const (
+	smfipNoConnect = 0x01
+	smfipNoHelo    = 0x02
+	smfipNoMail    = 0x04
+	smfipNoRcpt    = 0x08
+	smfipNoBody    = 0x10
+	smfipNoHdrs    = 0x20
+	smfipNoEOH     = 0x40
+	smfipNRHdr     = 0x80
+	smfipNoData    = 0x200
+	smfipSkip      = 0x400
+	smfipNRConn    = 0x1000
+	smfipNRHelo    = 0x2000
+	smfipNRMail    = 0x4000
+	smfipNRRcpt    = 0x8000
+	smfipNRData    = 0x10000
+	smfipNREOH     = 0x40000
+	smfipNRBody    = 0x80000
+	smfipHdrLeadSp = 0x100000
+)
+
+const (
+	milterActions = smfifAddHdrs | smfifChgBody | smfifAddRcpt | smfifDelRcpt |
+		smfifChgHdrs | smfifQuarantine | smfifChgFrom | smfifAddRcptPar
+	milterProtocol = smfipNoConnect | smfipNoHelo | smfipNoMail | smfipNoRcpt |
+		smfipNoBody | smfipNoHdrs | smfipNoEOH | smfipNRHdr | smfipNoData | smfipSkip |
+		smfipNRConn | smfipNRHelo | smfipNRMail | smfipNRRcpt | smfipNRData |
+		smfipNREOH | smfipNRBody | smfipHdrLeadSp
+
+	// maxBodyChunk is the largest body packet libmilter accepts
+	maxBodyChunk = 65535
+	// maxPacket guards against a corrupt length prefix
+	maxPacket = 64 << 20
+)
+
+// QuarantineTag is added to messages a milter asks to quarantine
+const QuarantineTag = "quarantine"
+
+// MilterProcessor hands each session to an external filter speaking the
+// Sendmail milter protocol, such as rspamd, OpenDKIM or a test double
+type MilterProcessor struct {
+	name    string
+	network string
+	address string
+	timeout time.Duration
+	onError Verdict // returned when the filter cannot be reached
+}
+
+// milterSession is one connection to the filter, held for a whole SMTP
+// session as Sendmail does
+type milterSession struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	actions   uint32
+	protocol  uint32
+	done      bool // filter accepted the connection or failed; skip it
+	inMessage bool // MAIL sent and end of message not yet reached
+	skipMsg   bool // filter accepted the current message
+}
+
+// NewMilterProcessor creates a milter client. address is "unix:/path",
+// "inet:port@host", "inet6:port@host", "tcp:host:port" or "host:port".
+// onError is the verdict used when the filter fails, typically TempFail
+// or the zero Verdict to ignore the filter.
+func NewMilterProcessor(name, address string, timeout time.Duration, onError Verdict) (*MilterProcessor, error) {
+	network, addr, err := parseMilterAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &MilterProcessor{name: name, network: network, address: addr, timeout: timeout, onError: onError}, nil
+}
+
+func parseMilterAddress(address string) (network, addr string, err error) {
+	kind, rest, ok := strings.Cut(address, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid milter address %q", address)
+	}
+	switch strings.ToLower(kind) {
+	case "unix", "local":
+		return "unix", rest, nil
+	case "inet", "inet6":
+		port, host, ok := strings.Cut(rest, "@")
+		if !ok {
+			host = "localhost"
+		}
+		return "tcp", net.JoinHostPort(host, port), nil
+	case "tcp":
+		return "tcp", rest, nil
+	default:
+		if _, _, err := net.SplitHostPort(address); err == nil {
+			return "tcp", address, nil
+		}
+		return "", "", fmt.Errorf("invalid milter address %q", address)
+	}
+}
+
+func (p *MilterProcessor) Name() string { return p.name }
+
+func (p *MilterProcessor) session(s *Session) *milterSession {
+	ms, _ := s.State(p).(*milterSession)
+	return ms
+}
+
+// fail closes the filter connection and applies the on_error verdict
+func (p *MilterProcessor) fail(s *Session, ms *milterSession, err error) Verdict {
+	s.Log.Warn("Milter failed", "milter", p.name, "error", err)
+	if ms != nil {
+		ms.done = true
+		if ms.conn != nil {
+			ms.conn.Close()
+			ms.conn = nil
+		}
+	}
+	return p.onError
+}
+
+func (p *MilterProcessor) OnConnect(s *Session) Verdict {
+	ms := &milterSession{}
+	s.SetState(p, ms)
+
+	conn, err := net.DialTimeout(p.network, p.address, p.timeout)
+	if err != nil {
+		return p.fail(s, ms, err)
+	}
+	ms.conn = conn
+	ms.reader = bufio.NewReader(conn)
+
+	// Option negotiation
+	var opt [12]byte
+	binary.BigEndian.PutUint32(opt[0:], milterVersion)
+	binary.BigEndian.PutUint32(opt[4:], milterActions)
+	binary.BigEndian.PutUint32(opt[8:], milterProtocol)
+	cmd, data, err := p.exchange(ms, smficOptNeg, opt[:])
+	if err != nil {
+		return p.fail(s, ms, err)
+	}
+	if cmd != smficOptNeg || len(data) < 12 {
+		return p.fail(s, ms, fmt.Errorf("unexpected negotiation reply %q", cmd))
+	}
+	if version := binary.BigEndian.Uint32(data[0:]); version < 2 {
+		return p.fail(s, ms, fmt.Errorf("unsupported milter version %d", version))
+	}
+	ms.actions = binary.BigEndian.Uint32(data[4:]) & milterActions
+	ms.protocol = binary.BigEndian.Uint32(data[8:]) & milterProtocol
+
+	if ms.protocol&smfipNoConnect != 0 {
+		return Verdict{}
+	}
+
+	p.sendMacros(ms, smficConnect,
+		"j", s.Hostname,
+		"{daemon_name}", "smtp_server_go",
+		"{client_addr}", s.RemoteIP,
+		"{client_port}", strconv.Itoa(s.RemotePort),
+		"{client_name}", "["+s.RemoteIP+"]")
+
+	var buf bytes.Buffer
+	buf.WriteString("[" + s.RemoteIP + "]\x00")
+	if ip := net.ParseIP(s.RemoteIP); ip != nil {
+		family := byte('4')
+		if ip.To4() == nil {
+			family = '6'
+		}
+		buf.WriteByte(family)
+		binary.Write(&buf, binary.BigEndian, uint16(s.RemotePort))
+		buf.WriteString(s.RemoteIP + "\x00")
+	} else {
+		buf.WriteByte('U') // unknown family
+	}
+	return p.step(s, ms, smficConnect, buf.Bytes(), smfipNRConn)
+}
+
+func (p *MilterProcessor) OnHelo(s *Session, name string) Verdict {
+	ms := p.session(s)
+	if ms == nil || ms.done || ms.protocol&smfipNoHelo != 0 {
+		return Verdict{}
+	}
+	return p.step(s, ms, smficHelo, []byte(name+"\x00"), smfipNRHelo)
+}
+
+func (p *MilterProcessor) OnMail(s *Session, from string, params map[string]string) Verdict {
+	ms := p.session(s)
+	if ms == nil || ms.done {
+		return Verdict{}
+	}
+	// A previous MAIL may have been refused after the filter saw it
+	p.OnReset(s)
+	ms.inMessage, ms.skipMsg = true, false
+	if ms.protocol&smfipNoMail != 0 {
+		return Verdict{}
+	}
+
+	p.sendMacros(ms, smficMail,
+		"{mail_addr}", from,
+		"{auth_authen}", s.AuthUsername,
+		"{tls_version}", s.TLSVersion,
+		"{cipher}", s.TLSCipher)
+	return p.step(s, ms, smficMail, pathArgs(from, params), smfipNRMail)
+}
+
+func (p *MilterProcessor) OnRcpt(s *Session, rcpt string, params map[string]string) Verdict {
+	ms := p.session(s)
+	if ms == nil || ms.done || ms.skipMsg || ms.protocol&smfipNoRcpt != 0 {
+		return Verdict{}
+	}
+	p.sendMacros(ms, smficRcpt, "{rcpt_addr}", rcpt)
+	return p.step(s, ms, smficRcpt, pathArgs(rcpt, params), smfipNRRcpt)
+}
+
+func (p *MilterProcessor) OnData(s *Session, msg *Message) Verdict {
+	ms := p.session(s)
+	if ms == nil || ms.done || ms.skipMsg {
+		return Verdict{}
+	}
+	defer func() { ms.inMessage = false }()
+
+	if ms.protocol&smfipNoData == 0 {
+		if v := p.step(s, ms, smficData, nil, smfipNRData); v.Action != Continue || ms.done || ms.skipMsg {
+			return v
+		}
+	}
+
+	p.sendMacros(ms, smficEOH, "i", msg.QueueID)
+
+	if ms.protocol&smfipNoHdrs == 0 {
+		for _, f := range msg.Fields() {
+			value := f.Value
+			if ms.protocol&smfipHdrLeadSp != 0 && f.raw != "" {
+				_, value, _ = strings.Cut(strings.TrimRight(f.raw, "\r\n"), ":")
+			}
+			data := []byte(f.Name + "\x00" + value + "\x00")
+			if v := p.step(s, ms, smficHeader, data, smfipNRHdr); v.Action != Continue || ms.done || ms.skipMsg {
+				return v
+			}
+		}
+	}
+
+	if ms.protocol&smfipNoEOH == 0 {
+		if v := p.step(s, ms, smficEOH, nil, smfipNREOH); v.Action != Continue || ms.done || ms.skipMsg {
+			return v
+		}
+	}
+
+	if ms.protocol&smfipNoBody == 0 {
+		body := msg.Body()
+	chunks:
+		for len(body) > 0 {
+			n := len(body)
+			if n > maxBodyChunk {
+				n = maxBodyChunk
+			}
+			if ms.protocol&smfipNRBody != 0 {
+				if err := p.send(ms, smficBody, body[:n]); err != nil {
+					return p.fail(s, ms, err)
+				}
+			} else {
+				cmd, data, err := p.exchange(ms, smficBody, body[:n])
+				if err != nil {
+					return p.fail(s, ms, err)
+				}
+				if cmd == smfirSkip {
+					break chunks
+				}
+				if v := p.verdict(s, ms, cmd, data); v.Action != Continue || ms.done || ms.skipMsg {
+					return v
+				}
+			}
+			body = body[n:]
+		}
+	}
+
+	// End of message: read modifications until the final decision
+	if err := p.send(ms, smficBodyEOB, nil); err != nil {
+		return p.fail(s, ms, err)
+	}
+	var newBody []byte
+	replacedBody := false
+	for {
+		cmd, data, err := p.read(ms)
+		if err != nil {
+			return p.fail(s, ms, err)
+		}
+		switch cmd {
+		case smfirProgress:
+			continue
+		case smfirAddHeader:
+			if name, value, ok := nulPair(data); ok && ms.actions&smfifAddHdrs != 0 {
+				msg.AddHeader(name, strings.TrimLeft(value, " "))
+			}
+			continue
+		case smfirInsHeader:
+			if len(data) > 4 && ms.actions&smfifAddHdrs != 0 {
+				if name, value, ok := nulPair(data[4:]); ok {
+					msg.InsertHeader(int(binary.BigEndian.Uint32(data)), name, strings.TrimLeft(value, " "))
+				}
+			}
+			continue
+		case smfirChgHeader:
+			if len(data) > 4 && ms.actions&smfifChgHdrs != 0 {
+				if name, value, ok := nulPair(data[4:]); ok {
+					index := int(binary.BigEndian.Uint32(data))
+					if index == 0 {
+						index = 1
+					}
+					msg.ChangeHeader(name, index, strings.TrimLeft(value, " "))
+				}
+			}
+			continue
+		case smfirReplBody:
+			if ms.actions&smfifChgBody != 0 {
+				newBody = append(newBody, data...)
+				replacedBody = true
+			}
+			continue
+		case smfirAddRcpt, smfirAddRcptPar:
+			if ms.actions&(smfifAddRcpt|smfifAddRcptPar) != 0 {
+				rcpt, _, _ := strings.Cut(string(data), "\x00")
+				msg.Recipients = append(msg.Recipients, strings.Trim(rcpt, "<>"))
+			}
+			continue
+		case smfirDelRcpt:
+			if ms.actions&smfifDelRcpt != 0 {
+				rcpt, _, _ := strings.Cut(string(data), "\x00")
+				msg.Recipients = removeAddress(msg.Recipients, strings.Trim(rcpt, "<>"))
+			}
+			continue
+		case smfirChgFrom:
+			if ms.actions&smfifChgFrom != 0 {
+				from, _, _ := strings.Cut(string(data), "\x00")
+				msg.MailFrom = strings.Trim(from, "<>")
+			}
+			continue
+		case smfirQuarantine:
+			if ms.actions&smfifQuarantine != 0 {
+				msg.Tag(QuarantineTag)
+				reason, _, _ := strings.Cut(string(data), "\x00")
+				s.Log.Info("Milter quarantined message", "milter", p.name, "reason", reason)
+			}
+			continue
+		}
+
+		if replacedBody {
+			msg.SetBody(normalizeBody(newBody))
+		}
+		return p.verdict(s, ms, cmd, data)
+	}
+}
+
+func (p *MilterProcessor) OnReset(s *Session) {
+	ms := p.session(s)
+	if ms == nil || ms.done || !ms.inMessage {
+		return
+	}
+	ms.inMessage, ms.skipMsg = false, false
+	if err := p.send(ms, smficAbort, nil); err != nil {
+		p.fail(s, ms, err)
+	}
+}
+
+func (p *MilterProcessor) OnClose(s *Session) {
+	ms := p.session(s)
+	if ms == nil || ms.conn == nil {
+		return
+	}
+	p.send(ms, smficQuit, nil)
+	ms.conn.Close()
+	ms.conn = nil
+}
+
+// step sends a command and, unless the filter asked for no reply, turns
+// its answer into a verdict
+func (p *MilterProcessor) step(s *Session, ms *milterSession, cmd byte, data []byte, noReply uint32) Verdict {
+	if ms.protocol&noReply != 0 {
+		if err := p.send(ms, cmd, data); err != nil {
+			return p.fail(s, ms, err)
+		}
+		return Verdict{}
+	}
+	reply, payload, err := p.exchange(ms, cmd, data)
+	if err != nil {
+		return p.fail(s, ms, err)
+	}
+	return p.verdict(s, ms, reply, payload)
+}
+
+// verdict maps a filter's reply to a pipeline verdict
+func (p *MilterProcessor) verdict(s *Session, ms *milterSession, cmd byte, data []byte) Verdict {
+	switch cmd {
+	case smfirContinue, smfirSkip:
+		return Verdict{}
+	case smfirAccept:
+		// The filter wants nothing more of this message, or of the whole
+		// connection if no transaction has started
+		if ms.inMessage {
+			ms.skipMsg = true
+		} else {
+			ms.done = true
+		}
+		return Verdict{}
+	case smfirReject:
+		return Verdict{Action: Reject}
+	case smfirTempFail:
+		return Verdict{Action: TempFail}
+	case smfirDiscard:
+		return Verdict{Action: Discard}
+	case smfirReplyCode:
+		text := strings.TrimRight(string(data), "\x00")
+		code, message, _ := strings.Cut(text, " ")
+		n, err := strconv.Atoi(code)
+		if err != nil || n < 400 || n > 599 {
+			return p.fail(s, ms, fmt.Errorf("invalid reply code %q", text))
+		}
+		return Rejected(n, strings.ReplaceAll(message, "\r\n", " "))
+	default:
+		return p.fail(s, ms, fmt.Errorf("unexpected reply %q", cmd))
+	}
+}
+
+// exchange sends a command and reads the reply, skipping progress packets
+func (p *MilterProcessor) exchange(ms *milterSession, cmd byte, data []byte) (byte, []byte, error) {
+	if err := p.send(ms, cmd, data); err != nil {
+		return 0, nil, err
+	}
+	for {
+		reply, payload, err := p.read(ms)
+		if err != nil || reply != smfirProgress {
+			return reply, payload, err
+		}
+	}
+}
+
+func (p *MilterProcessor) send(ms *milterSession, cmd byte, data []byte) error {
+	if ms.conn == nil {
+		return errors.New("not connected")
+	}
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = cmd
+	copy(packet[5:], data)
+
+	ms.conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	_, err := ms.conn.Write(packet)
+	return err
+}
+
+func (p *MilterProcessor) read(ms *milterSession) (byte, []byte, error) {
+	if ms.conn == nil {
+		return 0, nil, errors.New("not connected")
+	}
+	ms.conn.SetReadDeadline(time.Now().Add(p.timeout))
+
+	var length [4]byte
+	if _, err := io.ReadFull(ms.reader, length[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 || n > maxPacket {
+		return 0, nil, fmt.Errorf("invalid packet length %d", n)
+	}
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(ms.reader, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// sendMacros defines macros for the command that follows. Macros are
+// informational, so errors surface on the command itself.
+func (p *MilterProcessor) sendMacros(ms *milterSession, cmd byte, pairs ...string) {
+	var buf bytes.Buffer
+	buf.WriteByte(cmd)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		buf.WriteString(pairs[i] + "\x00" + pairs[i+1] + "\x00")
+	}
+	p.send(ms, smficMacro, buf.Bytes())
+}
+
+// pathArgs encodes a MAIL or RCPT argument list: the path then each ESMTP
+// parameter, NUL terminated
+func pathArgs(addr string, params map[string]string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("<" + addr + ">\x00")
+	for key, value := range params {
+		if value != "" {
+			key += "=" + value
+		}
+		buf.WriteString(key + "\x00")
+	}
+	return buf.Bytes()
+}
+
+// nulPair splits "name\0value\0"
+func nulPair(data []byte) (string, string, bool) {
+	name, rest, ok := strings.Cut(string(data), "\x00")
+	if !ok {
+		return "", "", false
+	}
+	value, _, _ := strings.Cut(rest, "\x00")
+	return name, value, true
+}
+
+// normalizeBody converts a replacement body's line endings to CRLF
+func normalizeBody(body []byte) []byte {
+	body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n"))
+}
+
+func removeAddress(list []string, addr string) []string {
+	kept := list[:0]
+	for _, a := range list {
+		if !strings.EqualFold(a, addr) {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,258 @@
+// Package pipeline runs received mail through an ordered list of
+// processors, each of which may accept, reject, tag or modify a message at
+// every stage of the SMTP conversation, in the manner of Sendmail milters.
+package pipeline
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// Stages of the SMTP conversation at which processors are consulted
+const (
+	StageConnect = "connect"
+	StageHelo    = "helo"
+	StageMail    = "mail"
+	StageRcpt    = "rcpt"
+	StageData    = "data"
+)
+
+// Action is a processor's decision
+type Action int
+
+const (
+	// Continue passes the command on to the next processor
+	Continue Action = iota
+	// Accept accepts the command without consulting later processors
+	Accept
+	// Reject refuses the command with a permanent (5xx) reply
+	Reject
+	// TempFail refuses the command with a temporary (4xx) reply
+	TempFail
+	// Discard accepts the message but silently drops it
+	Discard
+)
+
+func (a Action) String() string {
+	switch a {
+	case Accept:
+		return "accept"
+	case Reject:
+		return "reject"
+	case TempFail:
+		return "tempfail"
+	case Discard:
+		return "discard"
+	default:
+		return "continue"
+	}
+}
+
+// Verdict is returned by every processor hook. The zero value continues.
+type Verdict struct {
+	Action    Action
+	Code      int    // SMTP reply code; defaults to 550 or 451
+	Message   string // reply text, optionally starting with an enhanced status code
+	Processor string // set by the pipeline to the deciding processor's name
+}
+
+// Rejected returns a verdict refusing the command with a custom reply. A
+// 4xx code is a temporary failure, anything else permanent.
+func Rejected(code int, message string) Verdict {
+	if code >= 400 && code < 500 {
+		return Verdict{Action: TempFail, Code: code, Message: message}
+	}
+	return Verdict{Action: Reject, Code: code, Message: message}
+}
+
+// Refused reports whether the verdict refuses the command
+func (v Verdict) Refused() bool {
+	return v.Action == Reject || v.Action == TempFail
+}
+
+// Reply formats the SMTP reply for a refusing verdict
+func (v Verdict) Reply() string {
+	code, message := v.Code, v.Message
+	if v.Action == TempFail {
+		if code == 0 {
+			code = 451
+		}
+		if message == "" {
+			message = "4.7.1 Temporarily rejected, try again later"
+		}
+	} else {
+		if code == 0 {
+			code = 550
+		}
+		if message == "" {
+			message = "5.7.1 Rejected by policy"
+		}
+	}
+	return fmt.Sprintf("%d %s", code, message)
+}
+
+// Processor inspects each stage of an SMTP session. Embed Base to provide
+// the hooks a processor does not need.
+type Processor interface {
+	Name() string
+	OnConnect(s *Session) Verdict
+	OnHelo(s *Session, name string) Verdict
+	OnMail(s *Session, from string, params map[string]string) Verdict
+	OnRcpt(s *Session, rcpt string, params map[string]string) Verdict
+	OnData(s *Session, msg *Message) Verdict
+}
+
+// Resetter is implemented by processors that must be told when a mail
+// transaction is abandoned before DATA completes
+type Resetter interface {
+	OnReset(s *Session)
+}
+
+// Closer is implemented by processors holding per-session resources
+type Closer interface {
+	OnClose(s *Session)
+}
+
+// Base implements every Processor hook as Continue
+type Base struct{}
+
+func (Base) OnConnect(*Session) Verdict                         { return Verdict{} }
+func (Base) OnHelo(*Session, string) Verdict                    { return Verdict{} }
+func (Base) OnMail(*Session, string, map[string]string) Verdict { return Verdict{} }
+func (Base) OnRcpt(*Session, string, map[string]string) Verdict { return Verdict{} }
+func (Base) OnData(*Session, *Message) Verdict                  { return Verdict{} }
+
+// Session is the per-connection state shared by all processors
+type Session struct {
+	*models.Session              // connection details, refreshed before each stage
+	Hostname        string       // our host name, as used in Received headers
+	Log             *slog.Logger // session logger
+
+	state   map[Processor]interface{}
+	discard bool // a processor discarded the current transaction
+}
+
+// NewSession creates the pipeline state for one SMTP connection
+func NewSession(hostname string, log *slog.Logger) *Session {
+	return &Session{
+		Session:  &models.Session{},
+		Hostname: hostname,
+		Log:      log,
+		state:    make(map[Processor]interface{}),
+	}
+}
+
+// State returns the value stored by p for this session, or nil
+func (s *Session) State(p Processor) interface{} {
+	return s.state[p]
+}
+
+// SetState stores a per-session value for p
+func (s *Session) SetState(p Processor, v interface{}) {
+	s.state[p] = v
+}
+
+// Pipeline is an ordered list of processors. A nil *Pipeline continues at
+// every stage.
+type Pipeline struct {
+	processors []Processor
+}
+
+// New creates a pipeline running processors in order
+func New(processors ...Processor) *Pipeline {
+	return &Pipeline{processors: processors}
+}
+
+// Processors returns the processors in order
+func (p *Pipeline) Processors() []Processor {
+	if p == nil {
+		return nil
+	}
+	return p.processors
+}
+
+// Connect runs the OnConnect hooks
+func (p *Pipeline) Connect(s *Session) Verdict {
+	return p.run(StageConnect, s, func(proc Processor) Verdict { return proc.OnConnect(s) })
+}
+
+// Helo runs the OnHelo hooks
+func (p *Pipeline) Helo(s *Session, name string) Verdict {
+	return p.run(StageHelo, s, func(proc Processor) Verdict { return proc.OnHelo(s, name) })
+}
+
+// Mail runs the OnMail hooks
+func (p *Pipeline) Mail(s *Session, from string, params map[string]string) Verdict {
+	return p.run(StageMail, s, func(proc Processor) Verdict { return proc.OnMail(s, from, params) })
+}
+
+// Rcpt runs the OnRcpt hooks
+func (p *Pipeline) Rcpt(s *Session, rcpt string, params map[string]string) Verdict {
+	return p.run(StageRcpt, s, func(proc Processor) Verdict { return proc.OnRcpt(s, rcpt, params) })
+}
+
+// Data runs the OnData hooks. Processors may modify msg; a transaction
+// discarded at an earlier stage yields Discard without running them.
+func (p *Pipeline) Data(s *Session, msg *Message) Verdict {
+	if p != nil && s.discard {
+		return Verdict{Action: Discard, Processor: "pipeline"}
+	}
+	return p.run(StageData, s, func(proc Processor) Verdict { return proc.OnData(s, msg) })
+}
+
+// Reset ends the current transaction, notifying processors if it was
+// abandoned
+func (p *Pipeline) Reset(s *Session) {
+	if p == nil {
+		return
+	}
+	s.discard = false
+	for _, proc := range p.processors {
+		if r, ok := proc.(Resetter); ok {
+			r.OnReset(s)
+		}
+	}
+}
+
+// Close releases per-session resources at the end of the connection
+func (p *Pipeline) Close(s *Session) {
+	if p == nil {
+		return
+	}
+	for _, proc := range p.processors {
+		if c, ok := proc.(Closer); ok {
+			c.OnClose(s)
+		}
+	}
+}
+
+// run calls hook for each processor until one returns something other than
+// Continue. Once a transaction is discarded, later stages are skipped.
+func (p *Pipeline) run(stage string, s *Session, hook func(Processor) Verdict) Verdict {
+	if p == nil || s.discard {
+		return Verdict{}
+	}
+
+	for _, proc := range p.processors {
+		start := time.Now()
+		v := hook(proc)
+		processorDuration.WithLabelValues(proc.Name(), stage).Observe(time.Since(start).Seconds())
+		verdictsTotal.WithLabelValues(proc.Name(), stage, v.Action.String()).Inc()
+
+		if v.Action == Continue {
+			continue
+		}
+
+		v.Processor = proc.Name()
+		s.Log.Info("Pipeline verdict", "processor", proc.Name(), "stage", stage,
+			"action", v.Action.String(), "code", v.Code, "message", v.Message)
+		if v.Action == Discard {
+			s.discard = true
+		}
+		return v
+	}
+	return Verdict{}
+}
@@ -0,0 +1,28 @@
+package pop3
+
+import (
+	"github.com/baliboy20/smtp_server_go/internal/metrics"
+)
+
+var (
+	sessionsActive = metrics.NewGauge("pop3_sessions_active",
+		"POP3 sessions currently open.")
+	commandsTotal = metrics.NewCounterVec("pop3_commands_total",
+		"POP3 commands received by name.", "command")
+	authTotal = metrics.NewCounterVec("pop3_auth_total",
+		"POP3 logins by result.", "result")
+)
+
+// knownCommands bounds the cardinality of pop3_commands_total
+var knownCommands = map[string]bool{
+	"CAPA": true, "USER": true, "PASS": true, "STLS": true, "QUIT": true,
+	"STAT": true, "LIST": true, "RETR": true, "DELE": true, "NOOP": true,
+	"RSET": true, "TOP": true, "UIDL": true,
+}
+
+func observeCommand(cmd string) {
+	if !knownCommands[cmd] {
+		cmd = "unknown"
+	}
+	commandsTotal.WithLabelValues(cmd).Inc()
+}
@@ -0,0 +1,462 @@
+// Package pop3 serves captured mail over POP3 (RFC 1939) with the CAPA,
+// STLS, TOP and UIDL extensions. Every client sees the whole maildrop, in
+// order of arrival.
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/config"
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/storage"
+	"github.com/baliboy20/smtp_server_go/pkg/utils"
+)
+
+// autologoutTimeout is how long a connection may stay silent (RFC 1939
+// section 3)
+const autologoutTimeout = 10 * time.Minute
+
+// Server is a POP3 server backed by email storage
+type Server struct {
+	config   *config.Config
+	storage  storage.Storage
+	mu       sync.Mutex // guards listener
+	listener net.Listener
+}
+
+// NewServer creates a new POP3 server
+func NewServer(cfg *config.Config, store storage.Storage) *Server {
+	return &Server{
+		config:  cfg,
+		storage: store,
+	}
+}
+
+// Start starts the POP3 server
+func (s *Server) Start() error {
+	addr := fmt.Sprintf("%s:%s", s.config.SMTPHost, s.config.POP3Port)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start POP3 server: %w", err)
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	slog.Info("POP3 server listening", "addr", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			slog.Error("Failed to accept POP3 connection", "error", err)
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// Stop stops the POP3 server
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// tlsAvailable reports whether STLS can be offered
+func (s *Server) tlsAvailable() bool {
+	return s.config.EnableTLS && s.config.TLSCertFile != ""
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	sessionsActive.Inc()
+	defer sessionsActive.Dec()
+
+	id := utils.GenerateID()[:12]
+	sess := &session{
+		server: s,
+		log:    slog.With("pop3_session", id, "remote", conn.RemoteAddr().String()),
+	}
+	sess.setConn(conn)
+
+	sess.log.Info("POP3 connection opened")
+	if err := sess.serve(); err != nil && !errors.Is(err, io.EOF) {
+		sess.log.Warn("POP3 session error", "error", err)
+	}
+	sess.log.Info("POP3 connection closed")
+}
+
+// message is one message of a session's maildrop
+type message struct {
+	id      string
+	raw     []byte // CRLF line endings
+	deleted bool
+}
+
+type session struct {
+	server *Server
+	log    *slog.Logger
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	tls    bool
+	user   string     // from USER, awaiting PASS
+	msgs   []*message // set once authenticated
+}
+
+// setConn (re)binds the reader and writer, e.g. after STLS
+func (s *session) setConn(conn net.Conn) {
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	s.writer = bufio.NewWriter(conn)
+}
+
+func (s *session) writeLine(line string) error {
+	s.writer.WriteString(line)
+	s.writer.WriteString("\r\n")
+	return s.writer.Flush()
+}
+
+// writeMulti sends a multi-line response, byte-stuffing lines that start
+// with the termination octet
+func (s *session) writeMulti(status string, lines [][]byte) error {
+	s.writer.WriteString(status + "\r\n")
+	for _, line := range lines {
+		if len(line) > 0 && line[0] == '.' {
+			s.writer.WriteByte('.')
+		}
+		s.writer.Write(line)
+		s.writer.WriteString("\r\n")
+	}
+	s.writer.WriteString(".\r\n")
+	return s.writer.Flush()
+}
+
+func (s *session) capabilities() []string {
+	caps := []string{"TOP", "USER", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING"}
+	if s.server.tlsAvailable() && !s.tls && s.msgs == nil {
+		caps = append(caps, "STLS")
+	}
+	return append(caps, "IMPLEMENTATION smtp_server_go")
+}
+
+func (s *session) serve() error {
+	if err := s.writeLine("+OK POP3 server ready"); err != nil {
+		return err
+	}
+
+	for {
+		s.conn.SetDeadline(time.Now().Add(autologoutTimeout))
+
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		cmd = strings.ToUpper(cmd)
+		if cmd == "PASS" {
+			s.log.Debug("Client: PASS [redacted]")
+		} else {
+			s.log.Debug("Client: " + line)
+		}
+		observeCommand(cmd)
+
+		if cmd == "QUIT" {
+			return s.quit()
+		}
+		if s.msgs == nil {
+			err = s.authorization(cmd, arg)
+		} else {
+			err = s.transaction(cmd, strings.Fields(arg))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// authorization handles commands before the maildrop is open
+func (s *session) authorization(cmd, arg string) error {
+	switch cmd {
+	case "CAPA":
+		caps := s.capabilities()
+		lines := make([][]byte, len(caps))
+		for i, c := range caps {
+			lines[i] = []byte(c)
+		}
+		return s.writeMulti("+OK Capability list follows", lines)
+
+	case "USER":
+		if arg == "" {
+			return s.writeLine("-ERR USER needs a name")
+		}
+		s.user = arg
+		return s.writeLine("+OK Send PASS")
+
+	case "PASS":
+		if s.user == "" {
+			return s.writeLine("-ERR Send USER first")
+		}
+		user := s.user
+		s.user = ""
+		if !s.server.config.CheckCredentials(user, arg) {
+			authTotal.WithLabelValues("failure").Inc()
+			s.log.Warn("POP3 authentication failed", "user", user)
+			return s.writeLine("-ERR [AUTH] Invalid credentials")
+		}
+		if err := s.open(); err != nil {
+			s.log.Error("Failed to open maildrop", "error", err)
+			return s.writeLine("-ERR [SYS/TEMP] Cannot open maildrop")
+		}
+		authTotal.WithLabelValues("success").Inc()
+		s.log = s.log.With("user", user)
+		count, size := s.stat()
+		return s.writeLine(fmt.Sprintf("+OK Maildrop has %d messages (%d octets)", count, size))
+
+	case "STLS":
+		return s.startTLS()
+	}
+	return s.writeLine("-ERR Unknown command or not authenticated")
+}
+
+// open loads the maildrop, oldest message first
+func (s *session) open() error {
+	emails, err := s.server.storage.List()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].ReceivedAt.Before(emails[j].ReceivedAt)
+	})
+
+	s.msgs = make([]*message, 0, len(emails))
+	for _, email := range emails {
+		s.msgs = append(s.msgs, newMessage(email))
+	}
+	return nil
+}
+
+func newMessage(email *models.Email) *message {
+	raw := bytes.ReplaceAll([]byte(email.Raw), []byte("\r\n"), []byte("\n"))
+	raw = bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+	if len(raw) > 0 && !bytes.HasSuffix(raw, []byte("\r\n")) {
+		raw = append(raw, '\r', '\n')
+	}
+	return &message{id: email.ID, raw: raw}
+}
+
+func (s *session) startTLS() error {
+	if !s.server.tlsAvailable() || s.tls {
+		return s.writeLine("-ERR TLS not available")
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.server.config.TLSCertFile, s.server.config.TLSKeyFile)
+	if err != nil {
+		s.log.Error("Failed to load TLS certificate", "error", err)
+		return s.writeLine("-ERR TLS not available")
+	}
+
+	if err := s.writeLine("+OK Begin TLS negotiation"); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(s.conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	s.setConn(tlsConn)
+	s.tls = true
+	s.user = ""
+	return nil
+}
+
+// transaction handles commands once the maildrop is open
+func (s *session) transaction(cmd string, args []string) error {
+	switch cmd {
+	case "CAPA":
+		return s.authorization(cmd, "")
+
+	case "NOOP":
+		return s.writeLine("+OK")
+
+	case "STAT":
+		count, size := s.stat()
+		return s.writeLine(fmt.Sprintf("+OK %d %d", count, size))
+
+	case "LIST", "UIDL":
+		if len(args) > 0 {
+			n, m, err := s.message(args[0])
+			if err != nil {
+				return s.writeLine("-ERR " + err.Error())
+			}
+			return s.writeLine(fmt.Sprintf("+OK %d %s", n, s.listing(cmd, m)))
+		}
+		var lines [][]byte
+		for i, m := range s.msgs {
+			if !m.deleted {
+				lines = append(lines, []byte(fmt.Sprintf("%d %s", i+1, s.listing(cmd, m))))
+			}
+		}
+		if cmd == "UIDL" {
+			return s.writeMulti("+OK Unique-ID listing follows", lines)
+		}
+		count, size := s.stat()
+		return s.writeMulti(fmt.Sprintf("+OK %d messages (%d octets)", count, size), lines)
+
+	case "RETR":
+		if len(args) != 1 {
+			return s.writeLine("-ERR RETR needs a message number")
+		}
+		_, m, err := s.message(args[0])
+		if err != nil {
+			return s.writeLine("-ERR " + err.Error())
+		}
+		return s.writeMulti(fmt.Sprintf("+OK %d octets", len(m.raw)), splitLines(m.raw))
+
+	case "TOP":
+		if len(args) != 2 {
+			return s.writeLine("-ERR TOP needs a message number and a line count")
+		}
+		_, m, err := s.message(args[0])
+		if err != nil {
+			return s.writeLine("-ERR " + err.Error())
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return s.writeLine("-ERR Invalid line count")
+		}
+		return s.writeMulti("+OK Top of message follows", top(m.raw, n))
+
+	case "DELE":
+		if len(args) != 1 {
+			return s.writeLine("-ERR DELE needs a message number")
+		}
+		n, m, err := s.message(args[0])
+		if err != nil {
+			return s.writeLine("-ERR " + err.Error())
+		}
+		m.deleted = true
+		return s.writeLine(fmt.Sprintf("+OK Message %d deleted", n))
+
+	case "RSET":
+		for _, m := range s.msgs {
+			m.deleted = false
+		}
+		count, size := s.stat()
+		return s.writeLine(fmt.Sprintf("+OK Maildrop has %d messages (%d octets)", count, size))
+	}
+	return s.writeLine("-ERR Unknown command")
+}
+
+// quit ends the session, first deleting the messages marked by DELE when
+// the maildrop is open
+func (s *session) quit() error {
+	if s.msgs == nil {
+		return s.writeLine("+OK Bye")
+	}
+
+	var ids []string
+	for _, m := range s.msgs {
+		if m.deleted {
+			ids = append(ids, m.id)
+		}
+	}
+
+	failed := 0
+	if len(ids) > 0 {
+		removed, err := s.server.storage.DeleteMany(ids)
+		if err != nil {
+			s.log.Error("Failed to delete emails", "error", err)
+			failed = len(ids) - len(removed)
+		}
+		// On success, IDs not removed were already gone, e.g. deleted
+		// over the API, which is not a failure
+		for _, id := range removed {
+			s.log.Info("Email deleted over POP3", "id", id)
+		}
+	}
+	if failed > 0 {
+		return s.writeLine(fmt.Sprintf("-ERR [SYS/TEMP] %d deleted messages not removed", failed))
+	}
+	count, _ := s.stat()
+	return s.writeLine(fmt.Sprintf("+OK Bye (%d messages left)", count))
+}
+
+// message looks up a message that is not marked deleted by its number
+func (s *session) message(arg string) (int, *message, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(s.msgs) {
+		return 0, nil, errors.New("no such message")
+	}
+	m := s.msgs[n-1]
+	if m.deleted {
+		return 0, nil, fmt.Errorf("message %d already deleted", n)
+	}
+	return n, m, nil
+}
+
+// listing is a message's size for LIST or its unique ID for UIDL
+func (s *session) listing(cmd string, m *message) string {
+	if cmd == "UIDL" {
+		return m.id
+	}
+	return strconv.Itoa(len(m.raw))
+}
+
+// stat counts the messages not marked deleted and their total size
+func (s *session) stat() (count, size int) {
+	for _, m := range s.msgs {
+		if !m.deleted {
+			count++
+			size += len(m.raw)
+		}
+	}
+	return count, size
+}
+
+// splitLines splits CRLF-terminated content into lines
+func splitLines(raw []byte) [][]byte {
+	lines := bytes.Split(raw, []byte("\r\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// top returns a message's header, the blank line after it and the first
+// n lines of its body
+func top(raw []byte, n int) [][]byte {
+	lines := splitLines(raw)
+	for i, line := range lines {
+		if len(line) == 0 {
+			end := i + 1 + n
+			if end > len(lines) {
+				end = len(lines)
+			}
+			return lines[:end]
+		}
+	}
+	return lines
+}
@@ -0,0 +1,84 @@
+package responses
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// triplet identifies a delivery attempt for greylisting
+type triplet struct {
+	remoteIP  string
+	sender    string
+	recipient string
+}
+
+// greylist remembers the triplets seen recently
+type greylist struct {
+	mu       sync.Mutex
+	triplets map[triplet]*models.GreylistEntry
+}
+
+func newGreylist() *greylist {
+	return &greylist{triplets: make(map[triplet]*models.GreylistEntry)}
+}
+
+// pass records an attempt and reports whether it may proceed: the first
+// attempt is deferred, and retries pass once delay has elapsed
+func (g *greylist) pass(key triplet, delay, lifetime time.Duration, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prune(now)
+
+	e, seen := g.triplets[key]
+	if !seen {
+		e = &models.GreylistEntry{
+			RemoteIP:  key.remoteIP,
+			Sender:    key.sender,
+			Recipient: key.recipient,
+			FirstSeen: now,
+			ExpiresAt: now.Add(lifetime),
+		}
+		g.triplets[key] = e
+	}
+	e.Attempts++
+
+	if seen && !e.Passed && now.Sub(e.FirstSeen) >= delay {
+		e.Passed = true
+	}
+	if e.Passed {
+		// Senders that keep retrying correctly stay known
+		e.ExpiresAt = now.Add(lifetime)
+	}
+	return e.Passed
+}
+
+// prune drops expired triplets. The caller holds the lock.
+func (g *greylist) prune(now time.Time) {
+	for key, e := range g.triplets {
+		if now.After(e.ExpiresAt) {
+			delete(g.triplets, key)
+		}
+	}
+}
+
+func (g *greylist) list(now time.Time) []models.GreylistEntry {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prune(now)
+
+	entries := make([]models.GreylistEntry, 0, len(g.triplets))
+	for _, e := range g.triplets {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].FirstSeen.Before(entries[j].FirstSeen) })
+	return entries
+}
+
+func (g *greylist) clear() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.triplets = make(map[triplet]*models.GreylistEntry)
+}
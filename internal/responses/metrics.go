@@ -0,0 +1,8 @@
+package responses
+
+import (
+	"github.com/baliboy20/smtp_server_go/internal/metrics"
+)
+
+var scriptedReplies = metrics.NewCounterVec("scripted_responses_total",
+	"Commands answered by response rules, by rule name and result (reply, greylisted or passed).", "rule", "result")
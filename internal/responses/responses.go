@@ -0,0 +1,284 @@
+// Package responses scripts the SMTP replies given to chosen senders and
+// recipients, including greylisting, so that client behavior can be tested
+// deterministically.
+package responses
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/ruleset"
+	"github.com/baliboy20/smtp_server_go/pkg/utils"
+)
+
+// Stages at which scripted replies are given
+const (
+	StageMail = "mail"
+	StageRcpt = "rcpt"
+	StageData = "data"
+)
+
+// defaultLifetime is how long a greylisted triplet is remembered
+const defaultLifetime = 24 * time.Hour
+
+// ErrNotFound is returned for an unknown rule ID
+var ErrNotFound = errors.New("response rule not found")
+
+// ErrInvalid is wrapped by errors for rules that cannot be used
+var ErrInvalid = errors.New("invalid response rule")
+
+// Table holds the response rules, optionally persisted to a JSON file, and
+// the greylisting state
+type Table struct {
+	rules    *ruleset.Set[models.ResponseRule, *compiled]
+	greylist *greylist
+}
+
+// compiled is a rule with its patterns parsed
+type compiled struct {
+	rule      models.ResponseRule
+	sender    *regexp.Regexp
+	recipient *regexp.Regexp
+	delay     time.Duration
+	lifetime  time.Duration
+}
+
+// Attempt describes the command a reply is scripted for
+type Attempt struct {
+	Stage      string
+	RemoteIP   string
+	Sender     string
+	Recipients []string // the recipient at RCPT, every recipient at DATA
+}
+
+// Reply is a scripted SMTP reply
+type Reply struct {
+	RuleID     string
+	Rule       string
+	Code       int
+	Message    string
+	Greylisted bool
+}
+
+// String formats the reply as sent to the client
+func (r *Reply) String() string {
+	return fmt.Sprintf("%d %s", r.Code, r.Message)
+}
+
+// NewTable creates a response table. With a file, existing rules are
+// loaded from it and every change is written back.
+func NewTable(file string) (*Table, error) {
+	now := time.Now()
+	rules, err := ruleset.Open(file, ErrNotFound, func(rule models.ResponseRule) (*compiled, error) {
+		// Hand-written files may leave out IDs and timestamps
+		if rule.ID == "" {
+			rule.ID = utils.GenerateID()
+		}
+		if rule.CreatedAt.IsZero() {
+			rule.CreatedAt, rule.UpdatedAt = now, now
+		}
+		c, err := compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("response rule %q: %w", rule.Name, err)
+		}
+		return c, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Table{rules: rules, greylist: newGreylist()}, nil
+}
+
+// List returns all rules in evaluation order
+func (t *Table) List() []models.ResponseRule {
+	return t.rules.List()
+}
+
+// Get returns a rule by ID
+func (t *Table) Get(id string) (models.ResponseRule, error) {
+	return t.rules.Get(id)
+}
+
+// Create validates and adds a rule, assigning its ID
+func (t *Table) Create(rule models.ResponseRule) (models.ResponseRule, error) {
+	now := time.Now()
+	rule.ID = utils.GenerateID()
+	rule.CreatedAt, rule.UpdatedAt = now, now
+
+	c, err := compile(rule)
+	if err != nil {
+		return models.ResponseRule{}, err
+	}
+	if err := t.rules.Add(c); err != nil {
+		return models.ResponseRule{}, err
+	}
+	return c.rule, nil
+}
+
+// Update replaces a rule, keeping its ID and creation time
+func (t *Table) Update(id string, rule models.ResponseRule) (models.ResponseRule, error) {
+	c, err := t.rules.Replace(id, func(existing *compiled) (*compiled, error) {
+		rule.ID = id
+		rule.CreatedAt = existing.rule.CreatedAt
+		rule.UpdatedAt = time.Now()
+		return compile(rule)
+	})
+	if err != nil {
+		return models.ResponseRule{}, err
+	}
+	return c.rule, nil
+}
+
+// Delete removes a rule
+func (t *Table) Delete(id string) error {
+	return t.rules.Delete(id)
+}
+
+// Check returns the scripted reply for an attempt, or nil to carry on as
+// usual. The first enabled rule matching the stage, sender and recipients
+// decides; a greylisting rule returns nil once the triplet has passed.
+func (t *Table) Check(a Attempt) *Reply {
+	c := t.match(a)
+	if c == nil {
+		return nil
+	}
+
+	rule := c.rule
+	if rule.Greylist == nil {
+		scriptedReplies.WithLabelValues(rule.Name, "reply").Inc()
+		return &Reply{RuleID: rule.ID, Rule: rule.Name, Code: rule.Code, Message: rule.Message}
+	}
+
+	recipients := append([]string(nil), a.Recipients...)
+	sort.Strings(recipients)
+	key := triplet{
+		remoteIP:  a.RemoteIP,
+		sender:    strings.ToLower(a.Sender),
+		recipient: strings.ToLower(strings.Join(recipients, ",")),
+	}
+	if t.greylist.pass(key, c.delay, c.lifetime, time.Now()) {
+		scriptedReplies.WithLabelValues(rule.Name, "passed").Inc()
+		return nil
+	}
+
+	scriptedReplies.WithLabelValues(rule.Name, "greylisted").Inc()
+	return &Reply{RuleID: rule.ID, Rule: rule.Name, Code: rule.Code, Message: rule.Message, Greylisted: true}
+}
+
+// match returns the first rule applying to a
+func (t *Table) match(a Attempt) *compiled {
+	for _, c := range t.rules.Entries() {
+		if c.rule.Disabled || c.rule.Stage != a.Stage {
+			continue
+		}
+		if c.sender != nil && !c.sender.MatchString(a.Sender) {
+			continue
+		}
+		if c.recipient != nil && !ruleset.MatchAny(c.recipient, a.Recipients...) {
+			continue
+		}
+		return c
+	}
+	return nil
+}
+
+// Greylist returns the remembered triplets
+func (t *Table) Greylist() []models.GreylistEntry {
+	return t.greylist.list(time.Now())
+}
+
+// ClearGreylist forgets every triplet, so the next attempt is deferred again
+func (t *Table) ClearGreylist() {
+	t.greylist.clear()
+}
+
+// Rule and Meta make compiled a ruleset.Entry
+func (c *compiled) Rule() models.ResponseRule { return c.rule }
+
+func (c *compiled) Meta() ruleset.Meta {
+	return ruleset.Meta{ID: c.rule.ID, Priority: c.rule.Priority, CreatedAt: c.rule.CreatedAt}
+}
+
+// compile validates a rule and parses its patterns
+func compile(rule models.ResponseRule) (*compiled, error) {
+	c, err := compileRule(rule)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return c, nil
+}
+
+func compileRule(rule models.ResponseRule) (*compiled, error) {
+	if strings.TrimSpace(rule.Name) == "" {
+		return nil, errors.New("rule name is required")
+	}
+
+	rule.Stage = strings.ToLower(rule.Stage)
+	switch rule.Stage {
+	case "":
+		rule.Stage = StageRcpt
+	case StageMail:
+		if rule.Recipient != "" {
+			return nil, errors.New("recipient patterns do not apply at the mail stage")
+		}
+	case StageRcpt, StageData:
+	default:
+		return nil, fmt.Errorf("unknown stage %q", rule.Stage)
+	}
+
+	c := &compiled{}
+	var err error
+	if rule.Greylist != nil {
+		if rule.Code == 0 {
+			rule.Code = 451
+		}
+		if rule.Code < 400 || rule.Code > 499 {
+			return nil, errors.New("greylisting needs a 4xx reply code")
+		}
+		if rule.Message == "" {
+			rule.Message = "4.7.1 Greylisted, please try again later"
+		}
+		if c.delay, err = parseDuration("delay", rule.Greylist.Delay, 0); err != nil {
+			return nil, err
+		}
+		if c.lifetime, err = parseDuration("lifetime", rule.Greylist.Lifetime, defaultLifetime); err != nil {
+			return nil, err
+		}
+	} else {
+		if rule.Code < 400 || rule.Code > 599 {
+			return nil, errors.New("code must be a 4xx or 5xx reply code")
+		}
+		if rule.Message == "" {
+			if rule.Code < 500 {
+				rule.Message = "4.0.0 Scripted temporary failure"
+			} else {
+				rule.Message = "5.0.0 Scripted permanent failure"
+			}
+		}
+	}
+
+	if c.sender, err = ruleset.CompilePattern("sender", rule.Sender); err != nil {
+		return nil, err
+	}
+	if c.recipient, err = ruleset.CompilePattern("recipient", rule.Recipient); err != nil {
+		return nil, err
+	}
+	c.rule = rule
+	return c, nil
+}
+
+func parseDuration(field, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid greylist %s %q", field, value)
+	}
+	return d, nil
+}
@@ -0,0 +1,8 @@
+package rules
+
+import (
+	"github.com/baliboy20/smtp_server_go/internal/metrics"
+)
+
+var rulesMatched = metrics.NewCounterVec("rules_matched_total",
+	"Emails matched by each rule, by rule name.", "rule")
@@ -0,0 +1,302 @@
+// Package rules evaluates user-defined rules that tag, route, expire or
+// drop emails as they are saved.
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/ruleset"
+	"github.com/baliboy20/smtp_server_go/pkg/utils"
+)
+
+// ErrNotFound is returned for an unknown rule ID
+var ErrNotFound = errors.New("rule not found")
+
+// ErrInvalid wraps every validation failure
+var ErrInvalid = errors.New("invalid rule")
+
+// Engine holds the rule set, optionally persisted to a JSON file
+type Engine struct {
+	rules *ruleset.Set[models.Rule, *compiled]
+}
+
+// compiled is a rule with its patterns parsed
+type compiled struct {
+	rule        models.Rule
+	from        *regexp.Regexp
+	to          *regexp.Regexp
+	subject     *regexp.Regexp
+	body        *regexp.Regexp
+	tag         *regexp.Regexp
+	headers     map[string]*regexp.Regexp
+	deleteAfter time.Duration
+}
+
+// Match identifies a rule that matched an email
+type Match struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Result is the combined effect of every matching rule
+type Result struct {
+	Matched   []Match          `json:"matched"`
+	Tags      []string         `json:"tags,omitempty"`
+	Inbox     string           `json:"inbox,omitempty"`
+	ExpiresAt *time.Time       `json:"expires_at,omitempty"`
+	Delete    bool             `json:"delete"`
+	Webhooks  []models.Webhook `json:"webhooks,omitempty"`
+}
+
+// NewEngine creates a rule engine. With a file, existing rules are loaded
+// from it and every change is written back.
+func NewEngine(file string) (*Engine, error) {
+	rules, err := ruleset.Open(file, ErrNotFound, func(rule models.Rule) (*compiled, error) {
+		c, err := compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		return c, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Engine{rules: rules}, nil
+}
+
+// List returns all rules in evaluation order
+func (e *Engine) List() []models.Rule {
+	return e.rules.List()
+}
+
+// Get returns a rule by ID
+func (e *Engine) Get(id string) (models.Rule, error) {
+	return e.rules.Get(id)
+}
+
+// Create validates and adds a rule, assigning its ID
+func (e *Engine) Create(rule models.Rule) (models.Rule, error) {
+	now := time.Now()
+	rule.ID = utils.GenerateID()
+	rule.CreatedAt, rule.UpdatedAt = now, now
+
+	c, err := compile(rule)
+	if err != nil {
+		return models.Rule{}, err
+	}
+	if err := e.rules.Add(c); err != nil {
+		return models.Rule{}, err
+	}
+	return c.rule, nil
+}
+
+// Update replaces a rule, keeping its ID and creation time
+func (e *Engine) Update(id string, rule models.Rule) (models.Rule, error) {
+	c, err := e.rules.Replace(id, func(existing *compiled) (*compiled, error) {
+		rule.ID = id
+		rule.CreatedAt = existing.rule.CreatedAt
+		rule.UpdatedAt = time.Now()
+		return compile(rule)
+	})
+	if err != nil {
+		return models.Rule{}, err
+	}
+	return c.rule, nil
+}
+
+// Delete removes a rule
+func (e *Engine) Delete(id string) error {
+	return e.rules.Delete(id)
+}
+
+// Apply evaluates the enabled rules against email and applies their tags,
+// inbox and expiry to it. The caller acts on Delete and Webhooks.
+func (e *Engine) Apply(email *models.Email) Result {
+	result := evaluate(e.rules.Entries(), email, time.Now())
+
+	for _, m := range result.Matched {
+		rulesMatched.WithLabelValues(m.Name).Inc()
+	}
+
+	email.Tags = addTags(email.Tags, result.Tags...)
+	if result.Inbox != "" {
+		email.Inbox = result.Inbox
+	}
+	if result.ExpiresAt != nil {
+		email.ExpiresAt = result.ExpiresAt
+	}
+	return result
+}
+
+// Evaluate reports what the enabled rules would do to email without
+// changing it
+func (e *Engine) Evaluate(email *models.Email) Result {
+	return evaluate(e.rules.Entries(), email, time.Now())
+}
+
+// Test reports what a single, possibly unsaved, rule would do to email.
+// Disabled rules are evaluated too.
+func Test(rule models.Rule, email *models.Email) (Result, error) {
+	c, err := compile(rule)
+	if err != nil {
+		return Result{}, err
+	}
+	c.rule.Disabled = false
+	return evaluate([]*compiled{c}, email, time.Now()), nil
+}
+
+func evaluate(rules []*compiled, email *models.Email, now time.Time) Result {
+	result := Result{Matched: []Match{}}
+	for _, c := range rules {
+		if c.rule.Disabled || !c.matches(email) {
+			continue
+		}
+		result.Matched = append(result.Matched, Match{ID: c.rule.ID, Name: c.rule.Name})
+
+		actions := c.rule.Actions
+		result.Tags = addTags(result.Tags, actions.Tags...)
+		if actions.Inbox != "" {
+			result.Inbox = actions.Inbox
+		}
+		if actions.DeleteAfter != "" {
+			expires := now.Add(c.deleteAfter)
+			if result.ExpiresAt == nil || expires.Before(*result.ExpiresAt) {
+				result.ExpiresAt = &expires
+			}
+		}
+		if actions.Delete {
+			result.Delete = true
+		}
+		if actions.Webhook != nil {
+			result.Webhooks = append(result.Webhooks, *actions.Webhook)
+		}
+		if actions.Stop {
+			break
+		}
+	}
+	return result
+}
+
+// Rule and Meta make compiled a ruleset.Entry
+func (c *compiled) Rule() models.Rule { return c.rule }
+
+func (c *compiled) Meta() ruleset.Meta {
+	return ruleset.Meta{ID: c.rule.ID, Priority: c.rule.Priority, CreatedAt: c.rule.CreatedAt}
+}
+
+func (c *compiled) matches(email *models.Email) bool {
+	env := email.Envelope
+	if env == nil {
+		env = &models.Envelope{}
+	}
+
+	if c.from != nil && !ruleset.MatchAny(c.from, email.From, env.HeaderFrom) {
+		return false
+	}
+	if c.to != nil {
+		recipients := append(append(append([]string(nil), email.To...), env.HeaderTo...), env.HeaderCc...)
+		if !ruleset.MatchAny(c.to, recipients...) {
+			return false
+		}
+	}
+	if c.subject != nil && !c.subject.MatchString(email.Subject) {
+		return false
+	}
+	if c.body != nil && !ruleset.MatchAny(c.body, email.Body, email.HTML) {
+		return false
+	}
+	if c.tag != nil && !ruleset.MatchAny(c.tag, email.Tags...) {
+		return false
+	}
+	for name, re := range c.headers {
+		var values []string
+		for _, h := range email.Headers {
+			if strings.EqualFold(h.Key, name) {
+				values = append(values, h.Value)
+			}
+		}
+		if !ruleset.MatchAny(re, values...) {
+			return false
+		}
+	}
+	return true
+}
+
+// compile validates a rule and parses its patterns
+func compile(rule models.Rule) (*compiled, error) {
+	c, err := compileRule(rule)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return c, nil
+}
+
+func compileRule(rule models.Rule) (*compiled, error) {
+	if strings.TrimSpace(rule.Name) == "" {
+		return nil, errors.New("rule name is required")
+	}
+
+	cond, actions := rule.Conditions, rule.Actions
+	if len(actions.Tags) == 0 && actions.Inbox == "" && actions.DeleteAfter == "" &&
+		!actions.Delete && actions.Webhook == nil {
+		return nil, errors.New("rule has no actions")
+	}
+
+	c := &compiled{rule: rule, headers: make(map[string]*regexp.Regexp)}
+	var err error
+	for _, p := range []struct {
+		field   string
+		pattern string
+		dst     **regexp.Regexp
+	}{
+		{"from", cond.From, &c.from},
+		{"to", cond.To, &c.to},
+		{"subject", cond.Subject, &c.subject},
+		{"body", cond.Body, &c.body},
+		{"tag", cond.Tag, &c.tag},
+	} {
+		if *p.dst, err = ruleset.CompilePattern(p.field, p.pattern); err != nil {
+			return nil, err
+		}
+	}
+	for name, pattern := range cond.Headers {
+		if pattern == "" {
+			pattern = "^" // presence only
+		}
+		if c.headers[name], err = ruleset.CompilePattern(name, pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	if actions.DeleteAfter != "" {
+		if c.deleteAfter, err = time.ParseDuration(actions.DeleteAfter); err != nil || c.deleteAfter <= 0 {
+			return nil, fmt.Errorf("invalid delete_after %q", actions.DeleteAfter)
+		}
+	}
+	if actions.Webhook != nil && actions.Webhook.URL == "" {
+		return nil, errors.New("webhook URL is required")
+	}
+	return c, nil
+}
+
+// addTags appends tags not already present
+func addTags(tags []string, add ...string) []string {
+	for _, tag := range add {
+		found := false
+		for _, t := range tags {
+			if strings.EqualFold(t, tag) {
+				found = true
+				break
+			}
+		}
+		if !found && tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
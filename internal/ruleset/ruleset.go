@@ -0,0 +1,211 @@
+// Package ruleset keeps a priority-ordered set of compiled rules, optionally
+// persisted to a JSON file. The rule engine and the scripted SMTP responses
+// both store their rules this way.
+package ruleset
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is a compiled rule of type R
+type Entry[R any] interface {
+	Rule() R
+	Meta() Meta
+}
+
+// Meta is what a Set needs to know to find and order a rule
+type Meta struct {
+	ID        string
+	Priority  int // lower comes first
+	CreatedAt time.Time
+}
+
+// Set holds compiled rules in priority order. Changes build a new slice
+// and replace the old one only once it is saved, so a slice returned by
+// Entries is never modified.
+type Set[R any, E Entry[R]] struct {
+	mu       sync.RWMutex
+	entries  []E
+	file     string
+	notFound error
+}
+
+// Open creates a set. With a file, existing rules are compiled from it
+// and every change is written back. notFound is returned for unknown IDs.
+func Open[R any, E Entry[R]](file string, notFound error, compile func(R) (E, error)) (*Set[R, E], error) {
+	s := &Set[R, E]{file: file, notFound: notFound}
+	if file == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []R
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for _, rule := range rules {
+		e, err := compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		s.entries = append(s.entries, e)
+	}
+	sortEntries(s.entries)
+	return s, nil
+}
+
+// Entries returns the compiled rules in evaluation order
+func (s *Set[R, E]) Entries() []E {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.entries
+}
+
+// List returns all rules in evaluation order
+func (s *Set[R, E]) List() []R {
+	entries := s.Entries()
+	rules := make([]R, 0, len(entries))
+	for _, e := range entries {
+		rules = append(rules, e.Rule())
+	}
+	return rules
+}
+
+// Get returns a rule by ID
+func (s *Set[R, E]) Get(id string) (R, error) {
+	for _, e := range s.Entries() {
+		if e.Meta().ID == id {
+			return e.Rule(), nil
+		}
+	}
+	var zero R
+	return zero, s.notFound
+}
+
+// Add saves a set with e added
+func (s *Set[R, E]) Add(e E) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit(append(append([]E(nil), s.entries...), e))
+}
+
+// Replace swaps the entry with the given ID for the one replace builds
+// from it
+func (s *Set[R, E]) Replace(id string, replace func(E) (E, error)) (E, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var zero E
+	for i, existing := range s.entries {
+		if existing.Meta().ID != id {
+			continue
+		}
+		e, err := replace(existing)
+		if err != nil {
+			return zero, err
+		}
+		entries := append([]E(nil), s.entries...)
+		entries[i] = e
+		if err := s.commit(entries); err != nil {
+			return zero, err
+		}
+		return e, nil
+	}
+	return zero, s.notFound
+}
+
+// Delete removes a rule
+func (s *Set[R, E]) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, e := range s.entries {
+		if e.Meta().ID == id {
+			return s.commit(append(append([]E(nil), s.entries[:i]...), s.entries[i+1:]...))
+		}
+	}
+	return s.notFound
+}
+
+// commit sorts and saves a changed set, replacing the entries in use only
+// once it is saved. The caller holds the lock.
+func (s *Set[R, E]) commit(entries []E) error {
+	sortEntries(entries)
+	if err := s.save(entries); err != nil {
+		return err
+	}
+	s.entries = entries
+	return nil
+}
+
+// sortEntries orders entries by priority, then creation time
+func sortEntries[E interface{ Meta() Meta }](entries []E) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].Meta(), entries[j].Meta()
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+}
+
+// save writes entries to the file, if any
+func (s *Set[R, E]) save(entries []E) error {
+	if s.file == "" {
+		return nil
+	}
+
+	rules := make([]R, 0, len(entries))
+	for _, e := range entries {
+		rules = append(rules, e.Rule())
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a truncated file
+	tmp := filepath.Join(filepath.Dir(s.file), "."+filepath.Base(s.file)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// CompilePattern parses a case-insensitive pattern for the named field.
+// An empty pattern gives nil, matching anything.
+func CompilePattern(field, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s pattern %q: %v", field, pattern, err)
+	}
+	return re, nil
+}
+
+// MatchAny reports whether re matches any of values
+func MatchAny(re *regexp.Regexp, values ...string) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package search
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// Indexed fields
+const (
+	FieldSubject    = "subject"
+	FieldFrom       = "from"
+	FieldTo         = "to" // To and Cc
+	FieldBody       = "body"
+	FieldHTML       = "html" // text of HTML parts
+	FieldHeader     = "header"
+	FieldAttachment = "attachment" // file names and text-like content
+)
+
+var allFields = []string{FieldSubject, FieldFrom, FieldTo, FieldBody, FieldHTML, FieldHeader, FieldAttachment}
+
+// fieldWeights rank a match in the subject above one in the body
+var fieldWeights = map[string]float64{
+	FieldSubject:    3,
+	FieldFrom:       2,
+	FieldTo:         1.5,
+	FieldBody:       1,
+	FieldHTML:       1,
+	FieldHeader:     0.5,
+	FieldAttachment: 0.8,
+}
+
+// fieldPrefixes maps query prefixes such as "from:" to the fields they
+// search
+var fieldPrefixes = map[string][]string{
+	"subject":    {FieldSubject},
+	"from":       {FieldFrom},
+	"to":         {FieldTo},
+	"cc":         {FieldTo},
+	"body":       {FieldBody, FieldHTML},
+	"html":       {FieldHTML},
+	"header":     {FieldHeader},
+	"attachment": {FieldAttachment},
+}
+
+// skipHeaders are not indexed: trace and signature headers are noise, and
+// the others have fields of their own
+var skipHeaders = map[string]bool{
+	"received":                  true,
+	"dkim-signature":            true,
+	"authentication-results":    true,
+	"subject":                   true,
+	"from":                      true,
+	"to":                        true,
+	"cc":                        true,
+	"content-type":              true,
+	"content-transfer-encoding": true,
+	"mime-version":              true,
+}
+
+// maxPartDepth bounds the nesting of multipart messages
+const maxPartDepth = 10
+
+var wordDecoder = &mime.WordDecoder{}
+
+// decodeHeader decodes RFC 2047 encoded words, keeping the value as it is
+// when that fails
+func decodeHeader(value string) string {
+	if decoded, err := wordDecoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// Fields extracts the searchable text of an email, field by field. The
+// values of a field are kept apart so that phrases do not span them.
+func Fields(email *models.Email) map[string][]string {
+	fields := map[string][]string{}
+	add := func(field, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			fields[field] = append(fields[field], value)
+		}
+	}
+
+	add(FieldSubject, decodeHeader(email.Subject))
+	add(FieldFrom, email.From)
+	for _, to := range email.To {
+		add(FieldTo, to)
+	}
+	for _, h := range email.Headers {
+		switch key := strings.ToLower(h.Key); {
+		case key == "from":
+			add(FieldFrom, decodeHeader(h.Value))
+		case key == "to" || key == "cc":
+			add(FieldTo, decodeHeader(h.Value))
+		case !skipHeaders[key]:
+			add(FieldHeader, decodeHeader(h.Value))
+		}
+	}
+
+	if email.Raw != "" {
+		if msg, err := mail.ReadMessage(strings.NewReader(email.Raw)); err == nil {
+			body, _ := io.ReadAll(msg.Body)
+			walkPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"),
+				msg.Header.Get("Content-Disposition"), body, 0, add)
+			return fields
+		}
+	}
+
+	// Emails without a raw message, e.g. posted through the API
+	add(FieldBody, email.Body)
+	add(FieldHTML, htmlText(email.HTML))
+	for _, a := range email.Attachments {
+		add(FieldAttachment, a.Filename)
+		if textLike(a.ContentType) {
+			add(FieldAttachment, string(a.Data))
+		}
+	}
+	return fields
+}
+
+// walkPart adds the text of a MIME part and its children
+func walkPart(contentType, encoding, disposition string, body []byte, depth int, add func(field, value string)) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && depth < maxPartDepth:
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			data, _ := io.ReadAll(p)
+			walkPart(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"),
+				p.Header.Get("Content-Disposition"), data, depth+1, add)
+		}
+
+	case mediaType == "message/rfc822" && depth < maxPartDepth:
+		msg, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		add(FieldBody, decodeHeader(msg.Header.Get("Subject")))
+		data, _ := io.ReadAll(msg.Body)
+		walkPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"),
+			msg.Header.Get("Content-Disposition"), data, depth+1, add)
+		return
+	}
+
+	data := decodeTransfer(encoding, body)
+
+	dispType, dispParams, _ := mime.ParseMediaType(disposition)
+	filename := decodeHeader(dispParams["filename"])
+	if filename == "" {
+		filename = decodeHeader(params["name"])
+	}
+	if dispType == "attachment" || filename != "" {
+		add(FieldAttachment, filename)
+		if textLike(mediaType) {
+			add(FieldAttachment, string(data))
+		}
+		return
+	}
+
+	switch {
+	case mediaType == "text/html":
+		add(FieldHTML, htmlText(string(data)))
+	case strings.HasPrefix(mediaType, "text/"):
+		add(FieldBody, string(data))
+	}
+}
+
+func decodeTransfer(encoding string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		if data, err := base64.StdEncoding.DecodeString(string(clean)); err == nil {
+			return data
+		}
+	case "quoted-printable":
+		if data, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body))); err == nil {
+			return data
+		}
+	}
+	return body
+}
+
+// textLike reports whether an attachment's content is worth indexing
+func textLike(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/xml",
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	return false
+}
+
+var (
+	htmlHidden = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>|<!--.*?-->`)
+	htmlTag    = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// htmlText returns the visible text of an HTML document
+func htmlText(doc string) string {
+	text := htmlHidden.ReplaceAllString(doc, " ")
+	text = htmlTag.ReplaceAllString(text, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+}
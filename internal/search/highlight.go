@@ -0,0 +1,126 @@
+package search
+
+import (
+	"html"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// snippetContext is roughly how much text a snippet shows before the
+// first match and in total, in bytes
+const (
+	snippetContext = 60
+	snippetLength  = 200
+)
+
+// Highlight returns a snippet of each field of email that matches one of
+// the query's terms, HTML-escaped, with matching words wrapped in <mark>.
+// Of a field's values, the one with the most matches is shown.
+func Highlight(email *models.Email, q *Query) map[string]string {
+	snippets := map[string]string{}
+	for field, values := range Fields(email) {
+		best := 0
+		for _, value := range values {
+			if snippet, n := q.snippet(field, value); n > best {
+				snippets[field], best = snippet, n
+			}
+		}
+	}
+	return snippets
+}
+
+// matches reports whether a word of the given field matches a term
+func (q *Query) matches(field, word string) bool {
+	for _, t := range q.terms {
+		if t.fields != nil && !containsString(t.fields, field) {
+			continue
+		}
+		for _, w := range t.words {
+			if w == word || (t.prefix && strings.HasPrefix(word, w)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// snippet highlights text and returns the number of matching words
+func (q *Query) snippet(field, text string) (string, int) {
+	var marked []token
+	for _, t := range tokenize(text) {
+		if q.matches(field, t.text) {
+			marked = append(marked, t)
+		}
+	}
+	if len(marked) == 0 {
+		return "", 0
+	}
+
+	start := wordBoundary(text, marked[0].start-snippetContext, false)
+	end := wordBoundary(text, start+snippetLength, true)
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, t := range marked {
+		if t.start < pos || t.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(collapse(text[pos:t.start])))
+		b.WriteString("<mark>" + html.EscapeString(text[t.start:t.end]) + "</mark>")
+		pos = t.end
+	}
+	b.WriteString(html.EscapeString(collapse(text[pos:end])))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return strings.TrimSpace(b.String()), len(marked)
+}
+
+// wordBoundary moves i to a space at or after (forward) or before it,
+// clamped to the text
+func wordBoundary(text string, i int, forward bool) int {
+	if i <= 0 {
+		return 0
+	}
+	if i >= len(text) {
+		return len(text)
+	}
+	if forward {
+		if j := strings.IndexAny(text[i:], " \t\r\n"); j >= 0 && j < snippetContext {
+			return i + j
+		}
+	} else if j := strings.LastIndexAny(text[:i], " \t\r\n"); j >= 0 && i-j < snippetContext {
+		return j + 1
+	}
+	// No nearby space; stay on a UTF-8 boundary
+	for i < len(text) && i > 0 && text[i]&0xC0 == 0x80 {
+		i--
+	}
+	return i
+}
+
+// collapse squeezes runs of whitespace, such as line breaks, into spaces
+func collapse(s string) string {
+	fields := strings.Fields(s)
+	out := strings.Join(fields, " ")
+	if len(s) > 0 && strings.ContainsRune(" \t\r\n", rune(s[0])) && out != "" {
+		out = " " + out
+	}
+	if len(s) > 0 && strings.ContainsRune(" \t\r\n", rune(s[len(s)-1])) {
+		out += " "
+	}
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
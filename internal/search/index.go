@@ -0,0 +1,374 @@
+// Package search keeps an in-process inverted index of stored emails for
+// ranked full-text queries.
+package search
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// BM25 parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// valueGap separates the positions of a field's values, so that phrases
+// do not match across them
+const valueGap = 100
+
+// indexVersion changes when the persisted format does
+const indexVersion = 1
+
+// Index is an inverted index from words to the emails containing them.
+// It is safe for concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	postings map[string]map[string][]int // "field:word" to email ID to positions
+	docs     map[string]*document
+	fieldLen map[string]int // total words per field, for length normalization
+}
+
+// document records what was indexed for one email
+type document struct {
+	Keys       []string       // postings keys, for removal
+	Lengths    map[string]int // words per field
+	ReceivedAt int64          // for ordering equal scores, newest first
+}
+
+// Hit is one search result
+type Hit struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+}
+
+// New creates an empty index
+func New() *Index {
+	return &Index{
+		postings: make(map[string]map[string][]int),
+		docs:     make(map[string]*document),
+		fieldLen: make(map[string]int),
+	}
+}
+
+func postingKey(field, word string) string {
+	return field + ":" + word
+}
+
+// Add indexes an email, replacing any earlier version of it
+func (ix *Index) Add(email *models.Email) {
+	fields := Fields(email)
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.remove(email.ID)
+	doc := &document{Lengths: map[string]int{}, ReceivedAt: email.ReceivedAt.UnixNano()}
+	for field, values := range fields {
+		pos := 0
+		for _, value := range values {
+			for _, t := range tokenize(value) {
+				key := postingKey(field, t.text)
+				docs := ix.postings[key]
+				if docs == nil {
+					docs = make(map[string][]int)
+					ix.postings[key] = docs
+				}
+				if docs[email.ID] == nil {
+					doc.Keys = append(doc.Keys, key)
+				}
+				docs[email.ID] = append(docs[email.ID], pos)
+				doc.Lengths[field]++
+				pos++
+			}
+			pos += valueGap
+		}
+		ix.fieldLen[field] += doc.Lengths[field]
+	}
+	ix.docs[email.ID] = doc
+}
+
+// Remove drops an email from the index
+func (ix *Index) Remove(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(id)
+}
+
+func (ix *Index) remove(id string) {
+	doc := ix.docs[id]
+	if doc == nil {
+		return
+	}
+	for _, key := range doc.Keys {
+		delete(ix.postings[key], id)
+		if len(ix.postings[key]) == 0 {
+			delete(ix.postings, key)
+		}
+	}
+	for field, n := range doc.Lengths {
+		ix.fieldLen[field] -= n
+	}
+	delete(ix.docs, id)
+}
+
+// Reset empties the index
+func (ix *Index) Reset() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.postings = make(map[string]map[string][]int)
+	ix.docs = make(map[string]*document)
+	ix.fieldLen = make(map[string]int)
+}
+
+// Len returns the number of indexed emails
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// Has reports whether an email is indexed
+func (ix *Index) Has(id string) bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.docs[id] != nil
+}
+
+// Search returns the emails matching a query, best first
+func (ix *Index) Search(q *Query) []Hit {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	scores := q.root.eval(ix)
+	hits := make([]Hit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, Hit{ID: id, Score: math.Round(score*1000) / 1000})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return ix.docs[hits[i].ID].ReceivedAt > ix.docs[hits[j].ID].ReceivedAt
+	})
+	return hits
+}
+
+func (n *andNode) eval(ix *Index) map[string]float64 {
+	// Evaluate positive children first and filter by negative ones
+	var result map[string]float64
+	for _, child := range n.children {
+		if _, negative := child.(*notNode); negative {
+			continue
+		}
+		scores := child.eval(ix)
+		if result == nil {
+			result = scores
+			continue
+		}
+		for id, score := range result {
+			if other, ok := scores[id]; ok {
+				result[id] = score + other
+			} else {
+				delete(result, id)
+			}
+		}
+	}
+	if result == nil {
+		result = allDocs(ix)
+	}
+	for _, child := range n.children {
+		if not, negative := child.(*notNode); negative {
+			for id := range not.child.eval(ix) {
+				delete(result, id)
+			}
+		}
+	}
+	return result
+}
+
+func (n *orNode) eval(ix *Index) map[string]float64 {
+	result := map[string]float64{}
+	for _, child := range n.children {
+		for id, score := range child.eval(ix) {
+			result[id] += score
+		}
+	}
+	return result
+}
+
+func (n *notNode) eval(ix *Index) map[string]float64 {
+	result := allDocs(ix)
+	for id := range n.child.eval(ix) {
+		delete(result, id)
+	}
+	return result
+}
+
+func allDocs(ix *Index) map[string]float64 {
+	result := make(map[string]float64, len(ix.docs))
+	for id := range ix.docs {
+		result[id] = 0
+	}
+	return result
+}
+
+// eval scores a term with BM25 in each field it may match, weighting the
+// fields
+func (t *termNode) eval(ix *Index) map[string]float64 {
+	fields := t.fields
+	if fields == nil {
+		fields = allFields
+	}
+
+	n := float64(len(ix.docs))
+	result := map[string]float64{}
+	for _, field := range fields {
+		freqs := t.frequencies(ix, field)
+		if len(freqs) == 0 {
+			continue
+		}
+		df := float64(len(freqs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		avg := float64(ix.fieldLen[field]) / n
+		if avg == 0 {
+			avg = 1
+		}
+		for id, tf := range freqs {
+			length := float64(ix.docs[id].Lengths[field])
+			score := idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*length/avg))
+			result[id] += fieldWeights[field] * score
+		}
+	}
+	return result
+}
+
+// frequencies counts the occurrences of a term in one field of each email
+func (t *termNode) frequencies(ix *Index, field string) map[string]float64 {
+	freqs := map[string]float64{}
+
+	if t.prefix {
+		prefix := postingKey(field, t.words[0])
+		for key, docs := range ix.postings {
+			if strings.HasPrefix(key, prefix) {
+				for id, positions := range docs {
+					freqs[id] += float64(len(positions))
+				}
+			}
+		}
+		return freqs
+	}
+
+	first := ix.postings[postingKey(field, t.words[0])]
+	if len(t.words) == 1 {
+		for id, positions := range first {
+			freqs[id] = float64(len(positions))
+		}
+		return freqs
+	}
+
+	// Phrase: each following word at the following position
+	rest := make([]map[string][]int, len(t.words)-1)
+	for i, word := range t.words[1:] {
+		if rest[i] = ix.postings[postingKey(field, word)]; rest[i] == nil {
+			return freqs
+		}
+	}
+	for id, positions := range first {
+		count := 0
+		for _, pos := range positions {
+			matched := true
+			for i, docs := range rest {
+				if !containsPosition(docs[id], pos+i+1) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				count++
+			}
+		}
+		if count > 0 {
+			freqs[id] = float64(count)
+		}
+	}
+	return freqs
+}
+
+// containsPosition searches sorted positions
+func containsPosition(positions []int, pos int) bool {
+	i := sort.SearchInts(positions, pos)
+	return i < len(positions) && positions[i] == pos
+}
+
+// snapshot is the persisted form of an index
+type snapshot struct {
+	Version  int
+	Postings map[string]map[string][]int
+	Docs     map[string]*document
+}
+
+// Save writes the index to path, replacing it atomically
+func (ix *Index) Save(path string) error {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	snap := snapshot{Version: indexVersion, Postings: ix.postings, Docs: ix.docs}
+	if err := gob.NewEncoder(tmp).Encode(&snap); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads an index written by Save
+func Load(path string) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var snap snapshot
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		return nil, err
+	}
+	if snap.Version != indexVersion {
+		return nil, fmt.Errorf("unsupported search index version %d", snap.Version)
+	}
+
+	ix := New()
+	if snap.Postings != nil {
+		ix.postings = snap.Postings
+	}
+	for id, doc := range snap.Docs {
+		if doc.Lengths == nil {
+			doc.Lengths = map[string]int{}
+		}
+		ix.docs[id] = doc
+		for field, n := range doc.Lengths {
+			ix.fieldLen[field] += n
+		}
+	}
+	return ix, nil
+}
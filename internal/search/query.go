@@ -0,0 +1,246 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSyntax is returned for a query that cannot be parsed
+var ErrSyntax = errors.New("invalid query")
+
+// maxQueryDepth bounds parenthesis and NOT nesting
+const maxQueryDepth = 32
+
+// Query is a parsed search query
+type Query struct {
+	root  node
+	terms []*termNode // positive terms, for highlighting
+}
+
+// node is one operator or term of a query
+type node interface {
+	eval(ix *Index) map[string]float64 // document ID to score
+}
+
+type andNode struct{ children []node }
+type orNode struct{ children []node }
+type notNode struct{ child node }
+
+// termNode matches a word, a word prefix ("invoic*") or a phrase, in the
+// given fields or in any field
+type termNode struct {
+	fields []string
+	words  []string
+	prefix bool
+}
+
+// Parse parses a query such as
+//
+//	from:alice "order confirmed" (invoice OR receipt) -draft
+//
+// Terms are combined with AND unless joined by OR. NOT or a leading "-"
+// negates a term or group, quotes make a phrase, a trailing "*" matches a
+// prefix, and from:, to:, cc:, subject:, body:, html:, header: and
+// attachment: restrict a term to one field.
+func Parse(q string) (*Query, error) {
+	p := &queryParser{tokens: lexQuery(q)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty query", ErrSyntax)
+	}
+	root, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrSyntax, p.tokens[p.pos].text)
+	}
+	return &Query{root: root, terms: p.terms}, nil
+}
+
+// queryToken is a lexical token of a query
+type queryToken struct {
+	text   string // without quotes
+	raw    string
+	quoted bool
+}
+
+// lexQuery splits a query into words, quoted phrases and parentheses. A
+// field prefix stays attached to the phrase that follows it.
+func lexQuery(q string) []queryToken {
+	var tokens []queryToken
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, queryToken{text: string(c)})
+			i++
+		default:
+			start := i
+			for i < len(q) && !strings.ContainsRune(" \t\r\n()", rune(q[i])) {
+				if q[i] == '"' {
+					if end := strings.IndexByte(q[i+1:], '"'); end >= 0 {
+						i += end + 2
+						continue
+					}
+					i = len(q)
+					break
+				}
+				i++
+			}
+			text := q[start:i]
+			quoted := strings.Contains(text, `"`)
+			tokens = append(tokens, queryToken{text: strings.ReplaceAll(text, `"`, ""), raw: text, quoted: quoted})
+		}
+	}
+	return tokens
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	terms  []*termNode
+	negate int // depth of NOT around the term being parsed
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *queryParser) isOperator(word string) bool {
+	t, ok := p.peek()
+	return ok && !t.quoted && t.text == word
+}
+
+func (p *queryParser) parseOr(depth int) (node, error) {
+	if depth > maxQueryDepth {
+		return nil, fmt.Errorf("%w: too deeply nested", ErrSyntax)
+	}
+	first, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	children := []node{first}
+	for p.isOperator("OR") {
+		p.pos++
+		next, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return &orNode{children: children}, nil
+}
+
+func (p *queryParser) parseAnd(depth int) (node, error) {
+	var children []node
+	for {
+		t, ok := p.peek()
+		if !ok || (!t.quoted && (t.text == ")" || t.text == "OR")) {
+			break
+		}
+		if !t.quoted && t.text == "AND" {
+			p.pos++
+			continue
+		}
+		child, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		if child != nil {
+			children = append(children, child)
+		}
+	}
+	switch len(children) {
+	case 0:
+		return nil, fmt.Errorf("%w: expected a term", ErrSyntax)
+	case 1:
+		return children[0], nil
+	}
+	return &andNode{children: children}, nil
+}
+
+func (p *queryParser) parseUnary(depth int) (node, error) {
+	t, _ := p.peek()
+	negated := false
+	switch {
+	case !t.quoted && t.text == "NOT":
+		p.pos++
+		negated = true
+	case len(t.raw) > 1 && t.raw[0] == '-':
+		p.tokens[p.pos].text, p.tokens[p.pos].raw = t.text[1:], t.raw[1:]
+		negated = true
+	}
+	if negated {
+		if depth > maxQueryDepth {
+			return nil, fmt.Errorf("%w: too deeply nested", ErrSyntax)
+		}
+		p.negate++
+		child, err := p.parseUnary(depth + 1)
+		p.negate--
+		if err != nil {
+			return nil, err
+		}
+		if child == nil {
+			return nil, nil
+		}
+		return &notNode{child: child}, nil
+	}
+	return p.parsePrimary(depth)
+}
+
+// parsePrimary parses a group or a term. Terms without any word, such as
+// punctuation, are dropped.
+func (p *queryParser) parsePrimary(depth int) (node, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a term", ErrSyntax)
+	}
+	p.pos++
+
+	if !t.quoted && t.text == "(" {
+		inner, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOperator(")") {
+			return nil, fmt.Errorf("%w: missing )", ErrSyntax)
+		}
+		p.pos++
+		return inner, nil
+	}
+	if !t.quoted && t.text == ")" {
+		return nil, fmt.Errorf("%w: unexpected )", ErrSyntax)
+	}
+
+	term := &termNode{}
+	text := t.text
+	if prefix, rest, found := strings.Cut(text, ":"); found && !strings.HasPrefix(t.raw, `"`) {
+		if fields, known := fieldPrefixes[strings.ToLower(prefix)]; known {
+			term.fields, text = fields, rest
+		}
+	}
+	if !t.quoted && strings.HasSuffix(text, "*") {
+		term.prefix = true
+	}
+	term.words = words(text)
+	if len(term.words) == 0 {
+		return nil, nil
+	}
+	if len(term.words) > 1 {
+		term.prefix = false // a prefix applies to single words only
+	}
+
+	if p.negate == 0 {
+		p.terms = append(p.terms, term)
+	}
+	return term, nil
+}
@@ -0,0 +1,53 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxTokenLength skips long runs such as encoded data
+const maxTokenLength = 64
+
+// token is a word of indexed text with its byte offsets
+type token struct {
+	text       string
+	start, end int
+}
+
+// tokenize splits text into lowercase words of letters and digits
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			tokens = appendToken(tokens, text, start, i)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = appendToken(tokens, text, start, len(text))
+	}
+	return tokens
+}
+
+func appendToken(tokens []token, text string, start, end int) []token {
+	if utf8.RuneCountInString(text[start:end]) > maxTokenLength {
+		return tokens
+	}
+	return append(tokens, token{text: strings.ToLower(text[start:end]), start: start, end: end})
+}
+
+// words returns just the text of tokenize's tokens
+func words(text string) []string {
+	tokens := tokenize(text)
+	out := make([]string, len(tokens))
+	for i, t := range tokens {
+		out[i] = t.text
+	}
+	return out
+}
@@ -0,0 +1,231 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// Stages at which chaos faults can be injected
+const (
+	chaosConnect = "connect"
+	chaosMail    = "mail"
+	chaosRcpt    = "rcpt"
+	chaosData    = "data"
+)
+
+// errChaosDrop ends a session whose connection was dropped on purpose
+var errChaosDrop = errors.New("connection dropped by chaos fault")
+
+// chaos holds the fault injection settings, which may change at any time
+type chaos struct {
+	mu  sync.RWMutex
+	cfg models.ChaosConfig
+}
+
+func (c *chaos) get() models.ChaosConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg
+}
+
+func (c *chaos) set(cfg models.ChaosConfig) error {
+	if err := validateChaos(&cfg); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = cfg
+	return nil
+}
+
+// validateChaos checks cfg and normalises its recipients
+func validateChaos(cfg *models.ChaosConfig) error {
+	if cfg.GreetingDelayMS < 0 || cfg.LatencyMS < 0 || cfg.JitterMS < 0 {
+		return errors.New("delays must not be negative")
+	}
+
+	faults := make([]models.ChaosFault, len(cfg.Faults))
+	for i, f := range cfg.Faults {
+		f.Stage = strings.ToLower(f.Stage)
+		switch f.Stage {
+		case chaosConnect, chaosMail:
+			if len(f.Recipients) > 0 {
+				return fmt.Errorf("fault %d: recipients only apply to the rcpt and data stages", i+1)
+			}
+		case chaosRcpt, chaosData:
+		default:
+			return fmt.Errorf("fault %d: unknown stage %q", i+1, f.Stage)
+		}
+
+		if !f.Drop && (f.Code < 400 || f.Code > 599) {
+			return fmt.Errorf("fault %d: code must be a 4xx or 5xx reply code", i+1)
+		}
+		if f.DropAfter != 0 && (!f.Drop || f.Stage != chaosData) {
+			return fmt.Errorf("fault %d: drop_after_bytes only applies to drop faults at the data stage", i+1)
+		}
+		if f.Percent != nil && (*f.Percent < 0 || *f.Percent > 100) {
+			return fmt.Errorf("fault %d: percent must be between 0 and 100", i+1)
+		}
+		if f.DelayMS < 0 || f.DropAfter < 0 {
+			return fmt.Errorf("fault %d: delay_ms and drop_after_bytes must not be negative", i+1)
+		}
+
+		recipients := make([]string, 0, len(f.Recipients))
+		for _, r := range f.Recipients {
+			if r = strings.ToLower(strings.TrimSpace(r)); r != "" {
+				recipients = append(recipients, r)
+			}
+		}
+		f.Recipients = recipients
+		faults[i] = f
+	}
+	cfg.Faults = faults
+	return nil
+}
+
+// Chaos returns the current fault injection settings
+func (s *Server) Chaos() models.ChaosConfig {
+	return s.chaos.get()
+}
+
+// SetChaos replaces the fault injection settings. Sessions in progress
+// pick up the change at their next command.
+func (s *Server) SetChaos(cfg models.ChaosConfig) error {
+	if err := s.chaos.set(cfg); err != nil {
+		return err
+	}
+	s.logChaos(cfg)
+	return nil
+}
+
+func (s *Server) logChaos(cfg models.ChaosConfig) {
+	if !cfg.Enabled {
+		slog.Info("Chaos mode disabled")
+		return
+	}
+	stages := make([]string, 0, len(cfg.Faults))
+	for _, f := range cfg.Faults {
+		stages = append(stages, f.Stage)
+	}
+	slog.Warn("Chaos mode enabled", "greeting_delay_ms", cfg.GreetingDelayMS,
+		"latency_ms", cfg.LatencyMS, "jitter_ms", cfg.JitterMS, "faults", stages)
+}
+
+// chaosFault returns the first fault for stage that applies to this
+// message, or nil. Recipient-specific faults apply when any of recipients
+// matches.
+func (s *smtpSession) chaosFault(stage string, recipients ...string) *models.ChaosFault {
+	cfg := s.server.chaos.get()
+	if !cfg.Enabled {
+		return nil
+	}
+
+	for _, f := range cfg.Faults {
+		if f.Stage != stage {
+			continue
+		}
+		if len(f.Recipients) > 0 && !matchesRecipient(f.Recipients, recipients) {
+			continue
+		}
+		if f.Percent != nil && !s.chaosRoll(f.Percent) {
+			continue
+		}
+		return &f
+	}
+	return nil
+}
+
+// chaosRoll decides whether a fault with the given percent applies to the
+// current message, rolling once per message so that a rcpt fault is not
+// rolled again for every recipient. Faults are told apart by their
+// Percent pointer, which copies of the settings share.
+func (s *smtpSession) chaosRoll(percent *float64) bool {
+	if applies, ok := s.chaosRolls[percent]; ok {
+		return applies
+	}
+	if s.chaosRolls == nil {
+		s.chaosRolls = make(map[*float64]bool)
+	}
+	applies := rand.Float64()*100 < *percent
+	s.chaosRolls[percent] = applies
+	return applies
+}
+
+// matchesRecipient reports whether any address matches a pattern, either
+// a full address or "@domain"
+func matchesRecipient(patterns, addresses []string) bool {
+	for _, addr := range addresses {
+		addr = strings.ToLower(addr)
+		for _, p := range patterns {
+			if addr == p || (strings.HasPrefix(p, "@") && strings.HasSuffix(addr, p)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// injectFault sends the fault's reply, or returns errChaosDrop after
+// closing the connection for a drop fault
+func (s *smtpSession) injectFault(f *models.ChaosFault) error {
+	if f.DelayMS > 0 {
+		time.Sleep(time.Duration(f.DelayMS) * time.Millisecond)
+	}
+
+	if f.Drop {
+		chaosFaults.WithLabelValues(f.Stage, "drop").Inc()
+		s.log.Info("Chaos fault injected", "stage", f.Stage, "action", "drop")
+		s.recorder.event("chaos: connection dropped at %s", strings.ToUpper(f.Stage))
+		s.conn.Close()
+		return errChaosDrop
+	}
+
+	chaosFaults.WithLabelValues(f.Stage, "reply").Inc()
+	s.log.Info("Chaos fault injected", "stage", f.Stage, "code", f.Code)
+	s.recorder.event("chaos: %d injected at %s", f.Code, strings.ToUpper(f.Stage))
+	return s.writeLine(chaosReply(f))
+}
+
+// chaosReply formats the reply for a fault, with a default message
+func chaosReply(f *models.ChaosFault) string {
+	message := f.Message
+	if message == "" {
+		if f.Code < 500 {
+			message = "4.3.0 Simulated temporary failure"
+		} else {
+			message = "5.3.0 Simulated permanent failure"
+		}
+	}
+	return fmt.Sprintf("%d %s", f.Code, message)
+}
+
+// chaosDelay waits out the configured latency before a reply
+func (s *smtpSession) chaosDelay() {
+	cfg := s.server.chaos.get()
+	if !cfg.Enabled {
+		return
+	}
+	delay := cfg.LatencyMS
+	if cfg.JitterMS > 0 {
+		delay += rand.Intn(cfg.JitterMS + 1)
+	}
+	if delay > 0 {
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+}
+
+// chaosGreetingDelay returns how long to wait before the greeting
+func (s *smtpSession) chaosGreetingDelay() time.Duration {
+	cfg := s.server.chaos.get()
+	if !cfg.Enabled {
+		return 0
+	}
+	return time.Duration(cfg.GreetingDelayMS) * time.Millisecond
+}
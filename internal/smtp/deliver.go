@@ -0,0 +1,151 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/mimeparse"
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/pkg/utils"
+)
+
+// newEmail parses a raw message into an email with the given envelope
+func newEmail(log *slog.Logger, id string, now time.Time, from string, to []string, data []byte) *models.Email {
+	email := &models.Email{
+		ID:         id,
+		From:       from,
+		To:         to,
+		ReceivedAt: now,
+		Size:       int64(len(data)),
+		Headers:    make([]models.Header, 0),
+		Raw:        string(data),
+		Envelope:   &models.Envelope{MailFrom: from},
+	}
+	for _, rcpt := range to {
+		email.Envelope.Recipients = append(email.Envelope.Recipients, models.Recipient{Address: rcpt})
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		log.Warn("Failed to parse email", "error", err)
+		// Continue anyway with raw data
+		email.Body = string(data)
+		return email
+	}
+
+	// Extract subject
+	email.Subject = msg.Header.Get("Subject")
+
+	// Threading headers
+	if ids := messageIDs(msg.Header.Get("Message-ID")); len(ids) > 0 {
+		email.MessageID = ids[0]
+	}
+	if ids := messageIDs(msg.Header.Get("In-Reply-To")); len(ids) > 0 {
+		email.InReplyTo = ids[0]
+	}
+	email.References = messageIDs(msg.Header.Get("References"))
+
+	// Header addresses, which need not match the envelope
+	if from := headerAddresses(msg.Header, "From"); len(from) > 0 {
+		email.Envelope.HeaderFrom = from[0]
+	}
+	email.Envelope.HeaderTo = headerAddresses(msg.Header, "To")
+	email.Envelope.HeaderCc = headerAddresses(msg.Header, "Cc")
+
+	// Extract all headers, in message order
+	email.Headers = parseHeaders(data)
+
+	// Split the body into its text, HTML and attachments
+	if body, err := io.ReadAll(msg.Body); err == nil {
+		content := mimeparse.Parse(msg.Header, body)
+		email.Body = content.Text
+		email.HTML = content.HTML
+		email.Attachments = content.Attachments
+	}
+	return email
+}
+
+// Compose parses a message generated by this server, such as a delivery
+// status notification, into an email without storing it
+func (s *Server) Compose(from string, to []string, raw []byte, tags ...string) *models.Email {
+	email := newEmail(slog.Default(), utils.GenerateID(), time.Now(), from, to, raw)
+	email.Tags = tags
+	return email
+}
+
+// Inject stores a composed email as if it had been received. Rules and
+// webhooks apply as for received mail. A nil email is returned if a rule
+// deleted it.
+func (s *Server) Inject(email *models.Email) (*models.Email, error) {
+	return s.deliver(slog.Default(), email)
+}
+
+// deliver applies the rules to email, then stores it and triggers the
+// webhooks
+func (s *Server) deliver(log *slog.Logger, email *models.Email) (*models.Email, error) {
+	// Apply user rules: tags, inbox, expiry, deletion and webhooks
+	outcome := s.rules.Apply(email)
+	if outcome.Delete {
+		log.Info("Email deleted by rule", "id", email.ID, "from", email.From, "subject", email.Subject)
+		return nil, nil
+	}
+
+	// Save to storage
+	if err := s.storage.Save(email); err != nil {
+		return nil, err
+	}
+
+	log.Info("Email saved", "id", email.ID, "from", email.From,
+		"to", email.To, "subject", email.Subject, "size", email.Size)
+
+	// Trigger webhooks
+	go s.triggerWebhooks(log, email, outcome.Webhooks)
+
+	return email, nil
+}
+
+// triggerWebhooks notifies the registered webhooks and any added by rules
+func (s *Server) triggerWebhooks(log *slog.Logger, email *models.Email, extra []models.Webhook) {
+	webhooks := append(append([]models.Webhook(nil), s.webhooks...), extra...)
+	for _, webhook := range webhooks {
+		start := time.Now()
+		result := "success"
+		if err := utils.TriggerWebhook(webhook, email); err != nil {
+			log.Warn("Webhook failed", "url", webhook.URL, "error", err)
+			result = "failure"
+		}
+		webhookDeliveries.WithLabelValues(result).Inc()
+		webhookDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}
+}
+
+// messageIDs extracts the msg-ids of a Message-ID, In-Reply-To or
+// References header, without angle brackets. A bare ID is accepted when
+// the header has no brackets at all.
+func messageIDs(value string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			break
+		}
+		if id := strings.TrimSpace(value[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+	if ids == nil {
+		if id := strings.TrimSpace(value); id != "" && !strings.ContainsAny(id, " \t") {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,37 @@
+package smtp
+
+import (
+	"github.com/baliboy20/smtp_server_go/internal/dsn"
+)
+
+// checkMailDSN validates the DSN parameters of MAIL FROM, returning the
+// error reply if they are malformed
+func checkMailDSN(params map[string]string) string {
+	if ret, ok := params["RET"]; ok {
+		if _, err := dsn.ParseRet(ret); err != nil {
+			return "501 5.5.4 " + err.Error()
+		}
+	}
+	if envid, ok := params["ENVID"]; ok {
+		if _, err := dsn.ParseEnvID(envid); err != nil {
+			return "501 5.5.4 " + err.Error()
+		}
+	}
+	return ""
+}
+
+// checkRcptDSN validates the DSN parameters of RCPT TO, returning the
+// error reply if they are malformed
+func checkRcptDSN(params map[string]string) string {
+	if notify, ok := params["NOTIFY"]; ok {
+		if _, err := dsn.ParseNotify(notify); err != nil {
+			return "501 5.5.4 " + err.Error()
+		}
+	}
+	if orcpt, ok := params["ORCPT"]; ok {
+		if _, _, err := dsn.ParseORCPT(orcpt); err != nil {
+			return "501 5.5.4 " + err.Error()
+		}
+	}
+	return ""
+}
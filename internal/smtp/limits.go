@@ -0,0 +1,142 @@
+package smtp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/baliboy20/smtp_server_go/internal/config"
+)
+
+// idleLimiterTTL is how long a per-IP rate limiter is kept after its last use
+const idleLimiterTTL = 10 * time.Minute
+
+// connLimits tracks concurrent connections and per-IP rate limiters
+type connLimits struct {
+	mu          sync.Mutex
+	maxConns    int
+	maxPerIP    int
+	active      int
+	activePerIP map[string]int
+
+	connectRate *ipRateLimiter
+	messageRate *ipRateLimiter
+}
+
+func newConnLimits(cfg *config.Config) *connLimits {
+	return &connLimits{
+		maxConns:    cfg.SMTPMaxConnections,
+		maxPerIP:    cfg.SMTPMaxConnectionsPerIP,
+		activePerIP: make(map[string]int),
+		connectRate: newIPRateLimiter(cfg.SMTPConnectRate),
+		messageRate: newIPRateLimiter(cfg.SMTPMessageRate),
+	}
+}
+
+// acquire registers a new connection from ip. It returns the 421 reply to
+// send if the connection must be refused, in which case release must not
+// be called.
+func (l *connLimits) acquire(ip string) string {
+	if !l.connectRate.allow(ip) {
+		return "421 4.7.0 Too many connections from your host, try again later"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxConns > 0 && l.active >= l.maxConns {
+		return "421 4.3.2 Too many concurrent connections, try again later"
+	}
+	if l.maxPerIP > 0 && l.activePerIP[ip] >= l.maxPerIP {
+		return "421 4.7.0 Too many concurrent connections from your host"
+	}
+
+	l.active++
+	l.activePerIP[ip]++
+	return ""
+}
+
+// release unregisters a connection previously accepted by acquire
+func (l *connLimits) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	if l.activePerIP[ip] <= 1 {
+		delete(l.activePerIP, ip)
+	} else {
+		l.activePerIP[ip]--
+	}
+}
+
+// allowMessage reports whether ip may start another message transaction
+func (l *connLimits) allowMessage(ip string) bool {
+	return l.messageRate.allow(ip)
+}
+
+// ipRateLimiter hands out one token bucket per source IP. A nil
+// *ipRateLimiter allows everything.
+type ipRateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	limiters  map[string]*ipLimiterEntry
+	lastSweep time.Time
+}
+
+type ipLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newIPRateLimiter creates a limiter allowing perMinute events per IP, or
+// nil when perMinute is not positive
+func newIPRateLimiter(perMinute int) *ipRateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &ipRateLimiter{
+		limit:     rate.Every(time.Minute / time.Duration(perMinute)),
+		burst:     perMinute,
+		limiters:  make(map[string]*ipLimiterEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (r *ipRateLimiter) allow(ip string) bool {
+	if r == nil {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastSweep) > idleLimiterTTL {
+		for key, entry := range r.limiters {
+			if now.Sub(entry.lastSeen) > idleLimiterTTL {
+				delete(r.limiters, key)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	entry, exists := r.limiters[ip]
+	if !exists {
+		entry = &ipLimiterEntry{limiter: rate.NewLimiter(r.limit, r.burst)}
+		r.limiters[ip] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.AllowN(now, 1)
+}
+
+// remoteIP returns the host part of a connection's remote address
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,55 @@
+package smtp
+
+import (
+	"github.com/baliboy20/smtp_server_go/internal/metrics"
+)
+
+var (
+	connectionsTotal = metrics.NewCounterVec("smtp_connections_total",
+		"SMTP connections by outcome (accepted or refused by limits).", "result")
+	sessionsActive = metrics.NewGauge("smtp_sessions_active",
+		"SMTP sessions currently open.")
+	commandsTotal = metrics.NewCounterVec("smtp_commands_total",
+		"SMTP commands received by verb.", "verb")
+	repliesTotal = metrics.NewCounterVec("smtp_replies_total",
+		"SMTP replies sent by reply code.", "code")
+	messagesAccepted = metrics.NewCounter("smtp_messages_accepted_total",
+		"Messages accepted and stored.")
+	messagesRejected = metrics.NewCounterVec("smtp_messages_rejected_total",
+		"Message transactions refused, by reason.", "reason")
+	bytesReceived = metrics.NewCounter("smtp_received_bytes_total",
+		"Bytes of message data received after DATA.")
+	authTotal = metrics.NewCounterVec("smtp_auth_total",
+		"AUTH attempts by result.", "result")
+	tlsHandshakes = metrics.NewCounterVec("smtp_tls_handshakes_total",
+		"STARTTLS handshakes by result.", "result")
+	chaosFaults = metrics.NewCounterVec("smtp_chaos_faults_total",
+		"Faults injected by chaos mode, by stage and action (reply or drop).", "stage", "action")
+
+	webhookDeliveries = metrics.NewCounterVec("webhook_deliveries_total",
+		"Webhook deliveries by result.", "result")
+	webhookDuration = metrics.NewHistogramVec("webhook_delivery_duration_seconds",
+		"Webhook delivery latency.", nil, "result")
+)
+
+// knownVerbs bounds the cardinality of smtp_commands_total
+var knownVerbs = map[string]bool{
+	"HELO": true, "EHLO": true, "MAIL": true, "RCPT": true, "DATA": true,
+	"RSET": true, "NOOP": true, "QUIT": true, "AUTH": true, "STARTTLS": true,
+	"VRFY": true, "EXPN": true, "HELP": true, "BDAT": true,
+}
+
+func observeCommand(verb string) {
+	if !knownVerbs[verb] {
+		verb = "unknown"
+	}
+	commandsTotal.WithLabelValues(verb).Inc()
+}
+
+// observeReply counts a reply once, on its last line: the continuation
+// lines of a multi-line reply have a '-' after the code
+func observeReply(line string) {
+	if len(line) >= 3 && (len(line) == 3 || line[3] != '-') {
+		repliesTotal.WithLabelValues(line[:3]).Inc()
+	}
+}
@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/config"
+)
+
+// Policy decides which senders and recipients are accepted at MAIL FROM
+// and RCPT TO time
+type Policy struct {
+	allowedRcptDomains  []string
+	blockedRcptDomains  []string
+	allowedRcptPatterns []*regexp.Regexp
+	blockedRcptPatterns []*regexp.Regexp
+	blockedFromDomains  []string
+	blockedFromPatterns []*regexp.Regexp
+	maxRecipients       int
+	rejectNullSender    bool
+}
+
+// NewPolicy builds a policy from configuration, compiling all patterns
+func NewPolicy(cfg *config.Config) (*Policy, error) {
+	p := &Policy{
+		allowedRcptDomains: normalizeDomains(cfg.AllowedRecipientDomains),
+		blockedRcptDomains: normalizeDomains(cfg.BlockedRecipientDomains),
+		blockedFromDomains: normalizeDomains(cfg.BlockedSenderDomains),
+		maxRecipients:      cfg.MaxRecipients,
+		rejectNullSender:   cfg.RejectNullSender,
+	}
+
+	var err error
+	if p.allowedRcptPatterns, err = compilePatterns(cfg.AllowedRecipientPatterns); err != nil {
+		return nil, err
+	}
+	if p.blockedRcptPatterns, err = compilePatterns(cfg.BlockedRecipientPatterns); err != nil {
+		return nil, err
+	}
+	if p.blockedFromPatterns, err = compilePatterns(cfg.BlockedSenderPatterns); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// CheckSender returns the SMTP reply to send if the envelope sender is
+// rejected, or an empty string if it is accepted
+func (p *Policy) CheckSender(from string) string {
+	if from == "" {
+		if p.rejectNullSender {
+			return "553 5.1.7 Null sender not accepted"
+		}
+		return ""
+	}
+
+	domain, ok := addressDomain(from)
+	if !ok {
+		return "553 5.1.7 Malformed sender address"
+	}
+	if matchDomain(domain, p.blockedFromDomains) || matchPattern(from, p.blockedFromPatterns) {
+		return "550 5.7.1 Sender address rejected"
+	}
+	return ""
+}
+
+// CheckRecipient returns the SMTP reply to send if the recipient is
+// rejected, or an empty string if it is accepted. count is the number of
+// recipients already accepted for the current message.
+func (p *Policy) CheckRecipient(to string, count int) string {
+	if p.maxRecipients > 0 && count >= p.maxRecipients {
+		return "452 4.5.3 Too many recipients"
+	}
+
+	// RFC 5321 section 4.5.1 requires accepting the bare postmaster,
+	// which has no domain to check
+	if strings.EqualFold(to, "postmaster") {
+		return ""
+	}
+
+	domain, ok := addressDomain(to)
+	if !ok {
+		return "553 5.1.3 Malformed recipient address"
+	}
+	if matchDomain(domain, p.blockedRcptDomains) || matchPattern(to, p.blockedRcptPatterns) {
+		return "550 5.7.1 Recipient address rejected"
+	}
+
+	// An allow list, when present, is exhaustive
+	if len(p.allowedRcptDomains) > 0 || len(p.allowedRcptPatterns) > 0 {
+		if !matchDomain(domain, p.allowedRcptDomains) && !matchPattern(to, p.allowedRcptPatterns) {
+			return "550 5.7.1 Recipient address rejected: relay not permitted"
+		}
+	}
+	return ""
+}
+
+// addressDomain returns the lower-cased domain of a mailbox address
+func addressDomain(addr string) (string, bool) {
+	at := strings.LastIndex(addr, "@")
+	if at <= 0 || at == len(addr)-1 {
+		return "", false
+	}
+	return strings.ToLower(addr[at+1:]), true
+}
+
+// matchDomain reports whether domain equals, or is a subdomain of, any entry
+func matchDomain(domain string, domains []string) bool {
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(addr string, patterns []*regexp.Regexp) bool {
+	for _, re := range patterns {
+		if re.MatchString(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeDomains(domains []string) []string {
+	out := make([]string, 0, len(domains))
+	for _, d := range domains {
+		out = append(out, strings.ToLower(strings.TrimPrefix(d, "@")))
+	}
+	return out
+}
+
+// compilePatterns compiles case-insensitive address patterns
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	out := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address pattern %q: %w", pattern, err)
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
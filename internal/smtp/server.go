@@ -3,62 +3,175 @@ package smtp
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/mail"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/baliboy20/smtp_server_go/internal/analysis"
 	"github.com/baliboy20/smtp_server_go/internal/config"
+	"github.com/baliboy20/smtp_server_go/internal/mailauth"
 	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/pipeline"
+	"github.com/baliboy20/smtp_server_go/internal/responses"
+	"github.com/baliboy20/smtp_server_go/internal/rules"
 	"github.com/baliboy20/smtp_server_go/internal/storage"
 	"github.com/baliboy20/smtp_server_go/pkg/utils"
 )
 
+// expirySweepInterval is how often expired emails are looked for
+const expirySweepInterval = 30 * time.Second
+
 // Server represents an SMTP server
 type Server struct {
-	config  *config.Config
-	storage storage.Storage
-	listener net.Listener
-	webhooks []models.Webhook
+	config    *config.Config
+	storage   storage.Storage
+	policy    *Policy
+	limits    *connLimits
+	history   *sessionHistory
+	verifier  *mailauth.Verifier // nil when verification is disabled
+	pipeline  *pipeline.Pipeline // nil when no processors are configured
+	rules     *rules.Engine
+	responses *responses.Table
+	chaos     chaos
+	mu        sync.Mutex // guards listener
+	listener  net.Listener
+	done      chan struct{}
+	webhooks  []models.Webhook
+
+	rejectedSenders    atomic.Int64
+	rejectedRecipients atomic.Int64
 }
 
 // NewServer creates a new SMTP server
-func NewServer(cfg *config.Config, store storage.Storage) *Server {
-	return &Server{
-		config:  cfg,
-		storage: store,
-		webhooks: make([]models.Webhook, 0),
+func NewServer(cfg *config.Config, store storage.Storage) (*Server, error) {
+	policy, err := NewPolicy(cfg)
+	if err != nil {
+		return nil, err
 	}
+
+	var verifier *mailauth.Verifier
+	if cfg.EnableVerification {
+		var resolver mailauth.Resolver = mailauth.NewDNSResolver()
+		if cfg.DNSZoneFile != "" {
+			zone, err := mailauth.LoadZoneFile(cfg.DNSZoneFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load DNS zone file: %w", err)
+			}
+			resolver = zone
+		}
+		verifier = mailauth.NewVerifier(resolver)
+	}
+
+	var pl *pipeline.Pipeline
+	if cfg.PipelineFile != "" {
+		if pl, err = pipeline.LoadFile(cfg.PipelineFile); err != nil {
+			return nil, fmt.Errorf("failed to load pipeline: %w", err)
+		}
+		slog.Info("Message pipeline loaded", "file", cfg.PipelineFile, "processors", len(pl.Processors()))
+	}
+
+	ruleEngine, err := rules.NewEngine(cfg.RulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rules: %w", err)
+	}
+
+	responseTable, err := responses.NewTable(cfg.ResponsesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load response rules: %w", err)
+	}
+
+	return &Server{
+		config:    cfg,
+		storage:   store,
+		policy:    policy,
+		limits:    newConnLimits(cfg),
+		history:   newSessionHistory(cfg.SessionHistory),
+		verifier:  verifier,
+		pipeline:  pl,
+		rules:     ruleEngine,
+		responses: responseTable,
+		done:      make(chan struct{}),
+		webhooks:  make([]models.Webhook, 0),
+	}, nil
 }
 
 // Start starts the SMTP server
 func (s *Server) Start() error {
 	addr := fmt.Sprintf("%s:%s", s.config.SMTPHost, s.config.SMTPPort)
 
-	var err error
-	s.listener, err = net.Listen("tcp", addr)
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to start SMTP server: %w", err)
 	}
 
-	log.Printf("SMTP server listening on %s", addr)
+	slog.Info("SMTP server listening", "addr", addr)
+	return s.Serve(listener)
+}
+
+// Serve accepts SMTP connections on l until the server stops. If Stop
+// has already been called, l is closed and Serve returns at once.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return l.Close()
+	default:
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	go s.expireEmails()
 
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			slog.Error("Failed to accept connection", "error", err)
+			continue
+		}
+
+		ip := remoteIP(conn.RemoteAddr())
+		if reply := s.limits.acquire(ip); reply != "" {
+			slog.Warn("Refusing connection", "remote", conn.RemoteAddr().String(), "reply", reply)
+			connectionsTotal.WithLabelValues("refused").Inc()
+			// Refuse off the accept loop, so clients that never read the
+			// reply cannot hold up everyone else
+			go func() {
+				conn.SetWriteDeadline(time.Now().Add(time.Second))
+				conn.Write([]byte(reply + "\r\n"))
+				conn.Close()
+			}()
 			continue
 		}
 
-		go s.handleConnection(conn)
+		connectionsTotal.WithLabelValues("accepted").Inc()
+		go func() {
+			defer s.limits.release(ip)
+			s.handleConnection(conn)
+		}()
 	}
 }
 
 // Stop stops the SMTP server
 func (s *Server) Stop() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.listener != nil {
 		return s.listener.Close()
 	}
@@ -70,36 +183,134 @@ func (s *Server) AddWebhook(webhook models.Webhook) {
 	s.webhooks = append(s.webhooks, webhook)
 }
 
+// Rules returns the rule engine applied to every saved email
+func (s *Server) Rules() *rules.Engine {
+	return s.rules
+}
+
+// expireEmails periodically deletes emails whose rule-set expiry has
+// passed, until the server stops
+func (s *Server) expireEmails() {
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			removed, err := storage.DeleteExpired(s.storage, now)
+			if err != nil {
+				slog.Error("Failed to delete expired emails", "error", err)
+			}
+			if removed > 0 {
+				slog.Info("Deleted expired emails", "count", removed)
+			}
+		}
+	}
+}
+
+// Responses returns the scripted response rules
+func (s *Server) Responses() *responses.Table {
+	return s.responses
+}
+
+// SetPipeline replaces the message processing pipeline. Call it before
+// Start; nil disables processing.
+func (s *Server) SetPipeline(p *pipeline.Pipeline) {
+	s.pipeline = p
+}
+
+// RejectionStats returns how many senders and recipients were refused by
+// the acceptance policy since startup
+func (s *Server) RejectionStats() (senders, recipients int64) {
+	return s.rejectedSenders.Load(), s.rejectedRecipients.Load()
+}
+
+// RecentSessions returns the transcripts of recent sessions that ended
+// without delivering a message, newest first
+func (s *Server) RecentSessions() []*models.Transcript {
+	return s.history.list()
+}
+
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	sessionsActive.Inc()
+	defer sessionsActive.Dec()
+
+	id := utils.GenerateID()[:12]
 	session := &smtpSession{
-		conn:    conn,
-		server:  s,
-		reader:  bufio.NewReader(conn),
-		timeout: s.config.SMTPTimeout,
+		id:       id,
+		conn:     conn,
+		server:   s,
+		reader:   bufio.NewReader(conn),
+		timeout:  s.config.SMTPTimeout,
+		remoteIP: remoteIP(conn.RemoteAddr()),
+		log:      slog.With("session", id, "remote", conn.RemoteAddr().String()),
+		recorder: newRecorder(id, conn.RemoteAddr().String()),
 	}
+	session.pipe = pipeline.NewSession(s.config.SMTPHostname, session.log)
+	defer s.pipeline.Close(session.pipe)
 
-	if err := session.handle(); err != nil {
-		log.Printf("Session error: %v", err)
+	session.log.Info("Connection opened")
+	if err := session.handle(); err != nil && !errors.Is(err, errChaosDrop) {
+		session.log.Warn("Session error", "error", err)
+		session.recorder.event("session error: %v", err)
+	}
+	session.log.Info("Connection closed", "commands", session.commands)
+
+	transcript := session.recorder.finish()
+	if session.delivered == 0 {
+		s.history.add(transcript)
 	}
 }
 
 type smtpSession struct {
-	conn      net.Conn
-	server    *Server
-	reader    *bufio.Reader
-	timeout   time.Duration
-	from      string
-	to        []string
-	data      []byte
+	id            string
+	log           *slog.Logger
+	recorder      *recorder
+	pipe          *pipeline.Session
+	delivered     int // messages accepted in this session
+	conn          net.Conn
+	server        *Server
+	reader        *bufio.Reader
+	timeout       time.Duration
+	remoteIP      string
+	commands      int
+	helo          string
+	esmtp         bool
+	tlsState      *tls.ConnectionState
+	from          string
+	hasFrom       bool // MAIL FROM seen; from may legitimately be empty (<>)
+	mailParams    map[string]string
+	to            []string
+	recipients    []models.Recipient
+	data          []byte
 	authenticated bool
+	authUser      string
+	chaosRolls    map[*float64]bool // chaos percent rolls for this message
 }
 
 func (s *smtpSession) handle() error {
+	if delay := s.chaosGreetingDelay(); delay > 0 {
+		s.recorder.event("chaos: greeting delayed %s", delay)
+		time.Sleep(delay)
+	}
+
 	// Set initial timeout
 	s.conn.SetDeadline(time.Now().Add(s.timeout))
 
+	if f := s.chaosFault(chaosConnect); f != nil {
+		return s.injectFault(f)
+	}
+
+	if v := s.server.pipeline.Connect(s.stage()); v.Refused() {
+		s.recorder.event("connection refused by %s", v.Processor)
+		s.writeLine(v.Reply())
+		return nil
+	}
+
 	// Send greeting
 	if err := s.writeLine("220 SMTP Server Ready"); err != nil {
 		return err
@@ -122,9 +333,17 @@ func (s *smtpSession) handle() error {
 			continue
 		}
 
-		log.Printf("Client: %s", line)
+		s.log.Debug("Client: " + redactCommand(line))
+		s.recorder.client(redactCommand(line))
+
+		s.commands++
+		if limit := s.server.config.SMTPMaxCommands; limit > 0 && s.commands > limit {
+			s.writeLine("421 4.7.0 Too many commands, closing connection")
+			return nil
+		}
 
 		cmd := strings.ToUpper(strings.Split(line, " ")[0])
+		observeCommand(cmd)
 
 		switch cmd {
 		case "HELO", "EHLO":
@@ -172,7 +391,18 @@ func (s *smtpSession) handle() error {
 }
 
 func (s *smtpSession) handleHelo(line string) error {
-	if strings.HasPrefix(strings.ToUpper(line), "EHLO") {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return s.writeLine("501 Syntax: " + strings.ToUpper(fields[0]) + " hostname")
+	}
+	if v := s.server.pipeline.Helo(s.stage(), fields[1]); v.Refused() {
+		return s.writeLine(v.Reply())
+	}
+	s.helo = fields[1]
+	s.esmtp = strings.EqualFold(fields[0], "EHLO")
+	s.reset()
+
+	if s.esmtp {
 		// Extended SMTP
 		if err := s.writeLine("250-Hello"); err != nil {
 			return err
@@ -187,6 +417,9 @@ func (s *smtpSession) handleHelo(line string) error {
 				return err
 			}
 		}
+		if err := s.writeLine("250-DSN"); err != nil {
+			return err
+		}
 		if err := s.writeLine("250 SIZE 10485760"); err != nil { // 10MB max
 			return err
 		}
@@ -205,8 +438,41 @@ func (s *smtpSession) handleMail(line string) error {
 		return s.writeLine("501 Syntax error in parameters")
 	}
 
-	from := strings.Trim(parts[1], " <>")
+	if !s.server.limits.allowMessage(s.remoteIP) {
+		messagesRejected.WithLabelValues("rate_limit").Inc()
+		return s.writeLine("450 4.7.1 Message rate limit exceeded, try again later")
+	}
+
+	s.chaosRolls = nil // each MAIL starts a new message
+	if f := s.chaosFault(chaosMail); f != nil {
+		messagesRejected.WithLabelValues("chaos").Inc()
+		return s.injectFault(f)
+	}
+
+	from, params := parsePath(parts[1])
+	mailParams := parseParams(params)
+	if reply := checkMailDSN(mailParams); reply != "" {
+		return s.writeLine(reply)
+	}
+
+	if r := s.scriptedReply(responses.StageMail, from); r != nil {
+		messagesRejected.WithLabelValues("scripted").Inc()
+		return s.writeLine(r.String())
+	}
+	if reply := s.server.policy.CheckSender(from); reply != "" {
+		s.server.rejectedSenders.Add(1)
+		messagesRejected.WithLabelValues("policy").Inc()
+		return s.writeLine(reply)
+	}
+
+	if v := s.server.pipeline.Mail(s.stage(), from, mailParams); v.Refused() {
+		messagesRejected.WithLabelValues("pipeline").Inc()
+		return s.writeLine(v.Reply())
+	}
+
 	s.from = from
+	s.hasFrom = true
+	s.mailParams = mailParams
 	return s.writeLine("250 OK")
 }
 
@@ -217,16 +483,85 @@ func (s *smtpSession) handleRcpt(line string) error {
 		return s.writeLine("501 Syntax error in parameters")
 	}
 
-	to := strings.Trim(parts[1], " <>")
+	if !s.hasFrom {
+		return s.writeLine("503 Bad sequence of commands")
+	}
+
+	to, params := parsePath(parts[1])
+	rcptParams := parseParams(params)
+	if reply := checkRcptDSN(rcptParams); reply != "" {
+		return s.writeLine(reply)
+	}
+
+	if f := s.chaosFault(chaosRcpt, to); f != nil {
+		return s.injectFault(f)
+	}
+	if r := s.scriptedReply(responses.StageRcpt, s.from, to); r != nil {
+		return s.writeLine(r.String())
+	}
+	if reply := s.server.policy.CheckRecipient(to, len(s.to)); reply != "" {
+		s.server.rejectedRecipients.Add(1)
+		return s.writeLine(reply)
+	}
+
+	if v := s.server.pipeline.Rcpt(s.stage(), to, rcptParams); v.Refused() {
+		return s.writeLine(v.Reply())
+	}
+
 	s.to = append(s.to, to)
+	s.recipients = append(s.recipients, models.Recipient{Address: to, Params: rcptParams})
 	return s.writeLine("250 OK")
 }
 
+// parseParams turns ESMTP parameters such as "SIZE=1024" or "SMTPUTF8"
+// into a map keyed by upper-cased name
+func parseParams(params []string) map[string]string {
+	if len(params) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(params))
+	for _, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		out[strings.ToUpper(key)] = value
+	}
+	return out
+}
+
+// redactCommand hides credentials passed inline with AUTH, keeping only
+// the mechanism name
+func redactCommand(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+		return fields[0] + " " + fields[1] + " [redacted]"
+	}
+	return line
+}
+
+// parsePath splits the argument of MAIL FROM or RCPT TO into the mailbox
+// and any trailing ESMTP parameters
+func parsePath(arg string) (string, []string) {
+	arg = strings.TrimSpace(arg)
+	if strings.HasPrefix(arg, "<") {
+		if end := strings.Index(arg, ">"); end >= 0 {
+			return arg[1:end], strings.Fields(arg[end+1:])
+		}
+	}
+
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.Trim(fields[0], "<>"), fields[1:]
+}
+
 func (s *smtpSession) handleData() error {
-	if s.from == "" || len(s.to) == 0 {
+	if !s.hasFrom || len(s.to) == 0 {
 		return s.writeLine("503 Bad sequence of commands")
 	}
 
+	// Decided up front so a drop can happen part way through the data
+	fault := s.chaosFault(chaosData, s.to...)
+
 	if err := s.writeLine("354 Start mail input; end with <CRLF>.<CRLF>"); err != nil {
 		return err
 	}
@@ -239,20 +574,59 @@ func (s *smtpSession) handleData() error {
 			return err
 		}
 
+		if fault != nil && fault.Drop && len(data)+len(line) > fault.DropAfter {
+			messagesRejected.WithLabelValues("chaos").Inc()
+			return s.injectFault(fault)
+		}
+
 		if line == ".\r\n" || line == ".\n" {
 			break
 		}
 
+		// Undo dot-stuffing (RFC 5321 section 4.5.2)
+		if strings.HasPrefix(line, ".") {
+			line = line[1:]
+		}
+
 		data = append(data, []byte(line)...)
 	}
 
 	s.data = data
+	bytesReceived.Add(float64(len(data)))
+	s.recorder.event("%d bytes of message data", len(data))
+
+	if fault != nil {
+		messagesRejected.WithLabelValues("chaos").Inc()
+		s.reset()
+		return s.injectFault(fault)
+	}
+	if r := s.scriptedReply(responses.StageData, s.from, s.to...); r != nil {
+		messagesRejected.WithLabelValues("scripted").Inc()
+		s.reset()
+		return s.writeLine(r.String())
+	}
 
 	// Parse and save email
-	if err := s.saveEmail(); err != nil {
-		log.Printf("Failed to save email: %v", err)
+	verdict, err := s.saveEmail()
+	if err != nil {
+		s.log.Error("Failed to save email", "error", err)
+		messagesRejected.WithLabelValues("error").Inc()
+		s.reset()
 		return s.writeLine("554 Transaction failed")
 	}
+	switch {
+	case verdict.Refused():
+		messagesRejected.WithLabelValues("pipeline").Inc()
+		s.recorder.event("message refused by %s", verdict.Processor)
+		s.reset()
+		return s.writeLine(verdict.Reply())
+	case verdict.Action == pipeline.Discard:
+		messagesRejected.WithLabelValues("discarded").Inc()
+		s.recorder.event("message discarded by %s", verdict.Processor)
+	default:
+		messagesAccepted.Inc()
+		s.delivered++
+	}
 
 	s.reset()
 	return s.writeLine("250 OK: Message accepted")
@@ -270,52 +644,97 @@ func (s *smtpSession) handleAuth(line string) error {
 
 	mechanism := strings.ToUpper(parts[1])
 
+	// Clients may send the first response inline, e.g. "AUTH PLAIN <base64>"
+	initial := ""
+	if len(parts) > 2 {
+		initial = parts[2]
+	}
+
 	switch mechanism {
 	case "PLAIN":
-		if err := s.writeLine("334 "); err != nil {
-			return err
+		response := initial
+		if response == "" {
+			var err error
+			if response, err = s.readAuthResponse("334 "); err != nil {
+				return err
+			}
 		}
 
-		// Read authentication data
-		authData, err := s.reader.ReadString('\n')
+		// authzid NUL authcid NUL passwd
+		decoded, err := decodeAuth(response)
 		if err != nil {
-			return err
+			authTotal.WithLabelValues("failure").Inc()
+			return s.writeLine("501 Cannot decode response")
+		}
+		fields := strings.SplitN(decoded, "\x00", 3)
+		if len(fields) != 3 {
+			authTotal.WithLabelValues("failure").Inc()
+			return s.writeLine("501 Malformed PLAIN response")
 		}
 
 		// For simplicity, accept any authentication if configured
 		// In production, properly validate credentials
 		s.authenticated = true
+		s.authUser = fields[1]
+		authTotal.WithLabelValues("success").Inc()
 		return s.writeLine("235 Authentication successful")
 
 	case "LOGIN":
-		if err := s.writeLine("334 VXNlcm5hbWU6"); err != nil { // "Username:" in base64
-			return err
-		}
-
-		// Read username
-		_, err := s.reader.ReadString('\n')
-		if err != nil {
-			return err
+		username := initial
+		if username == "" {
+			var err error
+			if username, err = s.readAuthResponse("334 VXNlcm5hbWU6"); err != nil { // "Username:" in base64
+				return err
+			}
 		}
 
-		if err := s.writeLine("334 UGFzc3dvcmQ6"); err != nil { // "Password:" in base64
+		if _, err := s.readAuthResponse("334 UGFzc3dvcmQ6"); err != nil { // "Password:" in base64
 			return err
 		}
 
-		// Read password
-		_, err = s.reader.ReadString('\n')
+		decoded, err := decodeAuth(username)
 		if err != nil {
-			return err
+			authTotal.WithLabelValues("failure").Inc()
+			return s.writeLine("501 Cannot decode response")
 		}
 
 		s.authenticated = true
+		s.authUser = decoded
+		authTotal.WithLabelValues("success").Inc()
 		return s.writeLine("235 Authentication successful")
 
 	default:
+		authTotal.WithLabelValues("failure").Inc()
 		return s.writeLine("504 Authentication mechanism not supported")
 	}
 }
 
+// readAuthResponse sends an AUTH challenge and reads the client's reply,
+// keeping it out of logs and transcripts
+func (s *smtpSession) readAuthResponse(challenge string) (string, error) {
+	if err := s.writeLine(challenge); err != nil {
+		return "", err
+	}
+
+	response, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	s.log.Debug("Client: [redacted]")
+	s.recorder.client("[redacted]")
+
+	return strings.TrimSpace(response), nil
+}
+
+// decodeAuth decodes a base64 SASL response, where "=" stands for empty
+func decodeAuth(response string) (string, error) {
+	if response == "=" {
+		return "", nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	return string(decoded), err
+}
+
 func (s *smtpSession) handleStartTLS() error {
 	if !s.server.config.EnableTLS || s.server.config.TLSCertFile == "" {
 		return s.writeLine("454 TLS not available")
@@ -327,6 +746,7 @@ func (s *smtpSession) handleStartTLS() error {
 
 	cert, err := tls.LoadX509KeyPair(s.server.config.TLSCertFile, s.server.config.TLSKeyFile)
 	if err != nil {
+		tlsHandshakes.WithLabelValues("failure").Inc()
 		return err
 	}
 
@@ -335,8 +755,17 @@ func (s *smtpSession) handleStartTLS() error {
 	})
 
 	if err := tlsConn.Handshake(); err != nil {
+		tlsHandshakes.WithLabelValues("failure").Inc()
+		s.recorder.event("TLS handshake failed: %v", err)
 		return err
 	}
+	tlsHandshakes.WithLabelValues("success").Inc()
+
+	state := tlsConn.ConnectionState()
+	s.tlsState = &state
+	s.recorder.tls = true
+	s.recorder.event("TLS handshake completed: %s %s",
+		tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
 
 	s.conn = tlsConn
 	s.reader = bufio.NewReader(tlsConn)
@@ -344,77 +773,136 @@ func (s *smtpSession) handleStartTLS() error {
 	return nil
 }
 
-func (s *smtpSession) saveEmail() error {
-	// Parse email
-	msg, err := mail.ReadMessage(strings.NewReader(string(s.data)))
-	if err != nil {
-		log.Printf("Warning: Failed to parse email: %v", err)
-		// Continue anyway with raw data
-	}
-
-	email := &models.Email{
-		ID:         utils.GenerateID(),
-		From:       s.from,
-		To:         s.to,
-		ReceivedAt: time.Now(),
-		Size:       int64(len(s.data)),
-		Headers:    make([]models.Header, 0),
-	}
-
-	if msg != nil {
-		// Extract subject
-		email.Subject = msg.Header.Get("Subject")
-
-		// Extract all headers
-		for key, values := range msg.Header {
-			for _, value := range values {
-				email.Headers = append(email.Headers, models.Header{
-					Key:   key,
-					Value: value,
-				})
-			}
-		}
+func (s *smtpSession) saveEmail() (pipeline.Verdict, error) {
+	id := utils.GenerateID()
+	now := time.Now()
+	received := s.data
+
+	// Authenticate the sender before any headers of our own are added
+	var auth *models.AuthResults
+	if s.server.verifier != nil {
+		auth = s.verifyMessage()
+	}
 
-		// Read body
-		body, err := io.ReadAll(msg.Body)
-		if err == nil {
-			email.Body = string(body)
+	// Stamp trace headers as the receiving MTA
+	s.prependTraceHeaders(id, now)
+
+	// Let processors refuse, tag or rewrite the message
+	from, to, tags := s.from, s.to, []string(nil)
+	if s.server.pipeline != nil {
+		pm := pipeline.ParseMessage(s.data)
+		pm.QueueID = id
+		pm.MailFrom = s.from
+		pm.Recipients = append([]string(nil), s.to...)
+
+		verdict := s.server.pipeline.Data(s.stage(), pm)
+		if verdict.Refused() || verdict.Action == pipeline.Discard {
+			return verdict, nil
 		}
-	} else {
-		// Use raw data if parsing failed
-		email.Body = string(s.data)
+		if pm.Modified() {
+			s.data = pm.Bytes()
+		}
+		from, to, tags = pm.MailFrom, pm.Recipients, pm.Tags
 	}
 
-	// Save to storage
-	if err := s.server.storage.Save(email); err != nil {
-		return err
+	email := newEmail(s.log, id, now, from, to, s.data)
+	email.Tags = tags
+	email.Size = int64(len(received))
+	email.Auth = auth
+	if s.server.config.EnableSpamScoring {
+		email.Spam = analysis.ScoreSpam(email, s.server.config.SpamThreshold)
 	}
+	s.recorder.event("message queued as %s", email.ID)
+	email.Transcript = s.recorder.snapshot()
+	email.Session = s.sessionInfo()
+	email.Envelope.MailFrom = s.from
+	email.Envelope.MailParams = s.mailParams
+	email.Envelope.Recipients = s.recipients
+
+	if _, err := s.server.deliver(s.log, email); err != nil {
+		return pipeline.Verdict{}, err
+	}
+	return pipeline.Verdict{}, nil
+}
 
-	log.Printf("Email saved: ID=%s, From=%s, To=%v, Subject=%s",
-		email.ID, email.From, email.To, email.Subject)
+// sessionInfo describes the connection for storing alongside a message
+func (s *smtpSession) sessionInfo() *models.Session {
+	info := &models.Session{
+		ID:           s.id,
+		Helo:         s.helo,
+		ESMTP:        s.esmtp,
+		RemoteIP:     s.remoteIP,
+		AuthUsername: s.authUser,
+	}
+	if addr, ok := s.conn.RemoteAddr().(*net.TCPAddr); ok {
+		info.RemotePort = addr.Port
+	}
+	if s.tlsState != nil {
+		info.TLS = true
+		info.TLSVersion = tls.VersionName(s.tlsState.Version)
+		info.TLSCipher = tls.CipherSuiteName(s.tlsState.CipherSuite)
+	}
+	return info
+}
 
-	// Trigger webhooks
-	go s.triggerWebhooks(email)
+// scriptedReply returns the reply a response rule scripts for the command,
+// or nil
+func (s *smtpSession) scriptedReply(stage, sender string, recipients ...string) *responses.Reply {
+	r := s.server.responses.Check(responses.Attempt{
+		Stage:      stage,
+		RemoteIP:   s.remoteIP,
+		Sender:     sender,
+		Recipients: recipients,
+	})
+	if r != nil {
+		s.log.Info("Scripted reply", "rule", r.Rule, "stage", stage, "code", r.Code, "greylisted", r.Greylisted)
+		s.recorder.event("scripted reply from rule %q", r.Rule)
+	}
+	return r
+}
 
-	return nil
+// stage refreshes the connection details processors see before a hook
+func (s *smtpSession) stage() *pipeline.Session {
+	s.pipe.Session = s.sessionInfo()
+	return s.pipe
 }
 
-func (s *smtpSession) triggerWebhooks(email *models.Email) {
-	for _, webhook := range s.server.webhooks {
-		if err := utils.TriggerWebhook(webhook, email); err != nil {
-			log.Printf("Webhook failed: %v", err)
-		}
+// headerAddresses returns the bare addresses in an address header. If the
+// header does not parse, its raw value is returned instead.
+func headerAddresses(h mail.Header, key string) []string {
+	value := h.Get(key)
+	if value == "" {
+		return nil
+	}
+	list, err := h.AddressList(key)
+	if err != nil {
+		return []string{value}
 	}
+	out := make([]string, 0, len(list))
+	for _, addr := range list {
+		out = append(out, addr.Address)
+	}
+	return out
 }
 
 func (s *smtpSession) reset() {
+	s.server.pipeline.Reset(s.pipe)
 	s.from = ""
+	s.hasFrom = false
+	s.mailParams = nil
 	s.to = make([]string, 0)
+	s.recipients = nil
 	s.data = nil
+	s.chaosRolls = nil
 }
 
 func (s *smtpSession) writeLine(line string) error {
-	log.Printf("Server: %s", line)
+	if len(line) < 4 || line[3] != '-' {
+		s.chaosDelay() // once per reply, before its last line
+	}
+	s.log.Debug("Server: " + line)
+	s.recorder.server(line)
+	observeReply(line)
 	_, err := s.conn.Write([]byte(line + "\r\n"))
 	return err
 }
@@ -0,0 +1,99 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// protocol returns the RFC 3848 "with" keyword for the session
+func (s *smtpSession) protocol() string {
+	if !s.esmtp {
+		return "SMTP"
+	}
+	proto := "ESMTP"
+	if s.tlsState != nil {
+		proto += "S"
+	}
+	if s.authenticated {
+		proto += "A"
+	}
+	return proto
+}
+
+// traceHeaders builds the Return-Path and RFC 5321 section 4.4 Received
+// headers for a message accepted under queueID. Each clause of Received is
+// returned separately so callers can fold it.
+func (s *smtpSession) traceHeaders(queueID string, now time.Time) (returnPath string, received []string) {
+	helo := s.helo
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	received = append(received, fmt.Sprintf("from %s ([%s])", helo, s.remoteIP))
+	received = append(received, fmt.Sprintf("by %s with %s id %s", s.server.config.SMTPHostname, s.protocol(), queueID))
+	if s.tlsState != nil {
+		received = append(received, fmt.Sprintf("(version=%s cipher=%s)",
+			tls.VersionName(s.tlsState.Version), tls.CipherSuiteName(s.tlsState.CipherSuite)))
+	}
+
+	// Naming the recipient is only safe when there is exactly one
+	stamp := "; " + now.Format(time.RFC1123Z)
+	if len(s.to) == 1 {
+		received = append(received, "for <"+s.to[0]+">"+stamp)
+	} else {
+		received[len(received)-1] += stamp
+	}
+
+	return "<" + s.from + ">", received
+}
+
+// prependTraceHeaders adds Return-Path and Received to the top of the raw
+// message
+func (s *smtpSession) prependTraceHeaders(queueID string, now time.Time) {
+	returnPath, received := s.traceHeaders(queueID, now)
+
+	var buf bytes.Buffer
+	buf.WriteString("Return-Path: " + returnPath + "\r\n")
+	buf.WriteString("Received: " + strings.Join(received, "\r\n\t") + "\r\n")
+	s.data = append(buf.Bytes(), s.data...)
+}
+
+// parseHeaders returns the header fields of a raw message in the order they
+// appear, with folded lines joined
+func parseHeaders(data []byte) []models.Header {
+	headers := make([]models.Header, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+
+		// Continuation of the previous field
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			last := &headers[len(headers)-1]
+			last.Value += " " + strings.TrimSpace(line)
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		headers = append(headers, models.Header{
+			Key:   textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(key)),
+			Value: strings.TrimSpace(value),
+		})
+	}
+
+	return headers
+}
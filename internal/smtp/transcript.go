@@ -0,0 +1,109 @@
+package smtp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// maxTranscriptEntries caps the dialogue kept for a single session
+const maxTranscriptEntries = 2000
+
+// recorder accumulates the transcript of one session. It is only used from
+// the session's own goroutine.
+type recorder struct {
+	transcript models.Transcript
+	tls        bool
+	truncated  bool
+}
+
+func newRecorder(sessionID, remoteAddr string) *recorder {
+	return &recorder{transcript: models.Transcript{
+		SessionID:  sessionID,
+		RemoteAddr: remoteAddr,
+		StartedAt:  time.Now(),
+		Entries:    make([]models.TranscriptEntry, 0),
+	}}
+}
+
+func (r *recorder) client(line string) { r.add("client", line) }
+func (r *recorder) server(line string) { r.add("server", line) }
+func (r *recorder) event(format string, args ...interface{}) {
+	r.add("event", fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) add(direction, line string) {
+	if len(r.transcript.Entries) >= maxTranscriptEntries {
+		if !r.truncated {
+			r.truncated = true
+			r.transcript.Entries[len(r.transcript.Entries)-1] = r.entry("event", "transcript truncated")
+		}
+		return
+	}
+	r.transcript.Entries = append(r.transcript.Entries, r.entry(direction, line))
+}
+
+func (r *recorder) entry(direction, line string) models.TranscriptEntry {
+	now := time.Now()
+	return models.TranscriptEntry{
+		Time:      now,
+		ElapsedMS: now.Sub(r.transcript.StartedAt).Milliseconds(),
+		Direction: direction,
+		Line:      line,
+		TLS:       r.tls,
+	}
+}
+
+// snapshot returns a copy of the transcript so far
+func (r *recorder) snapshot() *models.Transcript {
+	t := r.transcript
+	t.Entries = append([]models.TranscriptEntry(nil), r.transcript.Entries...)
+	return &t
+}
+
+// finish stamps the end time and returns the final transcript
+func (r *recorder) finish() *models.Transcript {
+	now := time.Now()
+	r.transcript.EndedAt = &now
+	return r.snapshot()
+}
+
+// sessionHistory keeps the transcripts of the most recent sessions that
+// ended without delivering a message
+type sessionHistory struct {
+	mu       sync.Mutex
+	limit    int
+	sessions []*models.Transcript
+}
+
+func newSessionHistory(limit int) *sessionHistory {
+	return &sessionHistory{limit: limit}
+}
+
+func (h *sessionHistory) add(t *models.Transcript) {
+	if h.limit <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sessions = append(h.sessions, t)
+	if len(h.sessions) > h.limit {
+		h.sessions = h.sessions[len(h.sessions)-h.limit:]
+	}
+}
+
+// list returns the kept transcripts, newest first
+func (h *sessionHistory) list() []*models.Transcript {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make([]*models.Transcript, 0, len(h.sessions))
+	for i := len(h.sessions) - 1; i >= 0; i-- {
+		out = append(out, h.sessions[i])
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/mailauth"
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// verifyMessage checks SPF, DKIM and DMARC for the message just received
+// and prepends an Authentication-Results header recording the outcome. Any
+// the client sent in our name are removed first, so they cannot be
+// mistaken for ours (RFC 8601 section 5).
+func (s *smtpSession) verifyMessage() *models.AuthResults {
+	ctx, cancel := context.WithTimeout(context.Background(), s.server.config.VerificationTimeout)
+	defer cancel()
+
+	results := s.server.verifier.Verify(ctx, mailauth.Input{
+		Raw:      s.data,
+		ClientIP: net.ParseIP(s.remoteIP),
+		Helo:     s.helo,
+		MailFrom: s.from,
+	})
+
+	authservID := s.server.config.SMTPHostname
+	header := "Authentication-Results: " + mailauth.AuthenticationResults(authservID, results) + "\r\n"
+	s.data = append([]byte(header), stripAuthResults(s.data, authservID)...)
+
+	attrs := []any{}
+	if results.SPF != nil {
+		attrs = append(attrs, "spf", results.SPF.Result)
+	}
+	for _, d := range results.DKIM {
+		attrs = append(attrs, "dkim", d.Result)
+	}
+	if results.DMARC != nil {
+		attrs = append(attrs, "dmarc", results.DMARC.Result)
+	}
+	s.log.Debug("Verified sender authentication", attrs...)
+
+	return results
+}
+
+// stripAuthResults removes the Authentication-Results header fields of
+// a message that claim authservID as their source
+func stripAuthResults(data []byte, authservID string) []byte {
+	if authservID == "" {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	rest := data
+	for len(rest) > 0 {
+		n := lineLength(rest)
+		if len(bytes.TrimRight(rest[:n], "\r\n")) == 0 {
+			break // the body follows
+		}
+		// Take the field with its continuation lines
+		for n < len(rest) && (rest[n] == ' ' || rest[n] == '\t') {
+			n += lineLength(rest[n:])
+		}
+		field := rest[:n]
+		rest = rest[n:]
+		if !isAuthResultsFrom(field, authservID) {
+			out = append(out, field...)
+		}
+	}
+	return append(out, rest...)
+}
+
+// lineLength returns the length of the first line of b, including its
+// line ending
+func lineLength(b []byte) int {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		return i + 1
+	}
+	return len(b)
+}
+
+var headerComment = regexp.MustCompile(`\([^()]*\)`)
+
+// isAuthResultsFrom reports whether a raw header field is an
+// Authentication-Results header whose authserv-id is authservID
+func isAuthResultsFrom(field []byte, authservID string) bool {
+	name, value, ok := bytes.Cut(field, []byte(":"))
+	if !ok || !strings.EqualFold(strings.TrimSpace(string(name)), "Authentication-Results") {
+		return false
+	}
+	id, _, _ := strings.Cut(string(value), ";")
+	words := strings.Fields(headerComment.ReplaceAllString(id, " "))
+	return len(words) > 0 && strings.EqualFold(words[0], authservID)
+}
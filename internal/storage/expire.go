@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"time"
+)
+
+// DeleteExpired removes emails whose ExpiresAt has passed and returns how
+// many were removed. Emails already deleted meanwhile are skipped.
+func DeleteExpired(store Storage, now time.Time) (int, error) {
+	emails, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []string
+	for _, email := range emails {
+		if email.ExpiresAt != nil && !email.ExpiresAt.After(now) {
+			ids = append(ids, email.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	removed, err := store.DeleteMany(ids)
+	return len(removed), err
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// Filter selects emails by envelope, header and session attributes.
+// String fields are case-insensitive substring matches; empty fields match
+// everything.
+type Filter struct {
+	// ExactAddresses makes From and To match whole addresses rather than
+	// substrings, so that a delete for job-1 cannot also remove job-10's
+	// mail. See matchAddress for the accepted forms.
+	ExactAddresses bool `json:"-"`
+
+	From      string `json:"from,omitempty"` // envelope sender or header From
+	To        string `json:"to,omitempty"`   // any envelope recipient or header To/Cc
+	Subject   string `json:"subject,omitempty"`
+	Helo      string `json:"helo,omitempty"`
+	RemoteIP  string `json:"remote_ip,omitempty"`
+	AuthUser  string `json:"auth_user,omitempty"`
+	SessionID string `json:"session,omitempty"`
+	TLS       *bool  `json:"tls,omitempty"`
+	Tag       string `json:"tag,omitempty"`   // exact tag, ignoring case
+	Inbox     string `json:"inbox,omitempty"` // exact inbox name, ignoring case
+	Seen      *bool  `json:"seen,omitempty"`
+	Flagged   *bool  `json:"flagged,omitempty"`
+
+	// Received before or after these times; zero means unbounded
+	Before time.Time `json:"before,omitempty"`
+	After  time.Time `json:"after,omitempty"`
+}
+
+// Empty reports whether no criterion is set, so the filter matches every
+// email
+func (f *Filter) Empty() bool {
+	rest := *f
+	rest.Before, rest.After = time.Time{}, time.Time{}
+	rest.ExactAddresses = false
+	return rest == (Filter{}) && f.Before.IsZero() && f.After.IsZero()
+}
+
+// Match reports whether email satisfies every set criterion
+func (f *Filter) Match(email *models.Email) bool {
+	env := email.Envelope
+	if env == nil {
+		env = &models.Envelope{}
+	}
+	session := email.Session
+	if session == nil {
+		session = &models.Session{}
+	}
+
+	matchAddresses := containsAny
+	if f.ExactAddresses {
+		matchAddresses = matchAddress
+	}
+	if f.From != "" && !matchAddresses(f.From, email.From, env.HeaderFrom) {
+		return false
+	}
+	if f.To != "" {
+		candidates := append(append(append([]string(nil), email.To...), env.HeaderTo...), env.HeaderCc...)
+		if !matchAddresses(f.To, candidates...) {
+			return false
+		}
+	}
+	if f.Subject != "" && !containsAny(f.Subject, email.Subject) {
+		return false
+	}
+	if f.Helo != "" && !containsAny(f.Helo, session.Helo) {
+		return false
+	}
+	if f.RemoteIP != "" && session.RemoteIP != f.RemoteIP {
+		return false
+	}
+	if f.AuthUser != "" && !strings.EqualFold(session.AuthUsername, f.AuthUser) {
+		return false
+	}
+	if f.SessionID != "" && session.ID != f.SessionID {
+		return false
+	}
+	if f.TLS != nil && session.TLS != *f.TLS {
+		return false
+	}
+	if f.Tag != "" && !hasTag(email.Tags, f.Tag) {
+		return false
+	}
+	if f.Inbox != "" && !strings.EqualFold(email.Inbox, f.Inbox) {
+		return false
+	}
+	if f.Seen != nil && email.Seen != *f.Seen {
+		return false
+	}
+	if f.Flagged != nil && email.Flagged != *f.Flagged {
+		return false
+	}
+	if !f.Before.IsZero() && !email.ReceivedAt.Before(f.Before) {
+		return false
+	}
+	if !f.After.IsZero() && !email.ReceivedAt.After(f.After) {
+		return false
+	}
+	return true
+}
+
+// containsAny reports whether any value contains needle, ignoring case
+func containsAny(needle string, values ...string) bool {
+	needle = strings.ToLower(needle)
+	for _, v := range values {
+		if strings.Contains(strings.ToLower(v), needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddress reports whether any address matches pattern, ignoring
+// case. The pattern is a whole address, "@domain" for every address at
+// that domain, or a glob such as "*@job-1234.test".
+func matchAddress(pattern string, addresses ...string) bool {
+	pattern = strings.ToLower(pattern)
+	for _, address := range addresses {
+		address = strings.ToLower(address)
+		switch {
+		case strings.ContainsAny(pattern, "*?["):
+			if ok, _ := path.Match(pattern, address); ok {
+				return true
+			}
+		case strings.HasPrefix(pattern, "@"):
+			if strings.HasSuffix(address, pattern) {
+				return true
+			}
+		case address == pattern:
+			return true
+		}
+	}
+	return false
+}
+
+// hasTag reports whether tags contains tag, ignoring case
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
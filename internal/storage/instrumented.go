@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/metrics"
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/search"
+)
+
+var operationDuration = metrics.NewHistogramVec("storage_operation_duration_seconds",
+	"Storage operation latency by operation.", nil, "operation", "result")
+
+// InstrumentedStorage wraps a Storage and records operation latency
+type InstrumentedStorage struct {
+	Storage
+}
+
+// NewInstrumentedStorage wraps store with latency metrics
+func NewInstrumentedStorage(store Storage) *InstrumentedStorage {
+	return &InstrumentedStorage{Storage: store}
+}
+
+func observe(operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	operationDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+func (s *InstrumentedStorage) Save(email *models.Email) error {
+	start := time.Now()
+	err := s.Storage.Save(email)
+	observe("save", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) Get(id string) (*models.Email, error) {
+	start := time.Now()
+	email, err := s.Storage.Get(id)
+	observe("get", start, err)
+	return email, err
+}
+
+func (s *InstrumentedStorage) List() ([]*models.Email, error) {
+	start := time.Now()
+	emails, err := s.Storage.List()
+	observe("list", start, err)
+	return emails, err
+}
+
+func (s *InstrumentedStorage) Update(id string, update *models.EmailUpdate) (*models.Email, error) {
+	start := time.Now()
+	email, err := s.Storage.Update(id, update)
+	observe("update", start, err)
+	return email, err
+}
+
+func (s *InstrumentedStorage) UpdateMany(ids []string, update *models.EmailUpdate) ([]string, error) {
+	start := time.Now()
+	updated, err := s.Storage.UpdateMany(ids, update)
+	observe("update_many", start, err)
+	return updated, err
+}
+
+func (s *InstrumentedStorage) Delete(id string) error {
+	start := time.Now()
+	err := s.Storage.Delete(id)
+	observe("delete", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) DeleteMany(ids []string) ([]string, error) {
+	start := time.Now()
+	removed, err := s.Storage.DeleteMany(ids)
+	observe("delete_many", start, err)
+	return removed, err
+}
+
+func (s *InstrumentedStorage) DeleteMatching(filter *Filter) (int, error) {
+	start := time.Now()
+	removed, err := s.Storage.DeleteMatching(filter)
+	observe("delete_matching", start, err)
+	return removed, err
+}
+
+func (s *InstrumentedStorage) Clear() error {
+	start := time.Now()
+	err := s.Storage.Clear()
+	observe("clear", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) Stats() *models.Stats {
+	start := time.Now()
+	stats := s.Storage.Stats()
+	observe("stats", start, nil)
+	return stats
+}
+
+func (s *InstrumentedStorage) Threads() ([]*models.Thread, error) {
+	start := time.Now()
+	threads, err := s.Storage.Threads()
+	observe("threads", start, err)
+	return threads, err
+}
+
+func (s *InstrumentedStorage) Search(query *search.Query) ([]search.Hit, error) {
+	start := time.Now()
+	hits, err := s.Storage.Search(query)
+	observe("search", start, err)
+	return hits, err
+}
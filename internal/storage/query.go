@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// filterParam is the query parameter for one filter field. The API reads
+// filters with it and the Go client writes them, so the two cannot drift.
+type filterParam struct {
+	name   string
+	parse  func(f *Filter, v string, now time.Time) error
+	format func(f *Filter) string // empty when the field is unset
+}
+
+var filterParams = []filterParam{
+	stringParam("from", func(f *Filter) *string { return &f.From }),
+	stringParam("to", func(f *Filter) *string { return &f.To }),
+	stringParam("subject", func(f *Filter) *string { return &f.Subject }),
+	stringParam("helo", func(f *Filter) *string { return &f.Helo }),
+	stringParam("remote_ip", func(f *Filter) *string { return &f.RemoteIP }),
+	stringParam("auth_user", func(f *Filter) *string { return &f.AuthUser }),
+	stringParam("session", func(f *Filter) *string { return &f.SessionID }),
+	stringParam("tag", func(f *Filter) *string { return &f.Tag }),
+	stringParam("inbox", func(f *Filter) *string { return &f.Inbox }),
+	boolParam("tls", func(f *Filter) **bool { return &f.TLS }),
+	boolParam("seen", func(f *Filter) **bool { return &f.Seen }),
+	boolParam("flagged", func(f *Filter) **bool { return &f.Flagged }),
+	timeParam("before", func(f *Filter) *time.Time { return &f.Before }),
+	timeParam("after", func(f *Filter) *time.Time { return &f.After }),
+}
+
+func stringParam(name string, field func(*Filter) *string) filterParam {
+	return filterParam{
+		name: name,
+		parse: func(f *Filter, v string, _ time.Time) error {
+			*field(f) = v
+			return nil
+		},
+		format: func(f *Filter) string { return *field(f) },
+	}
+}
+
+func boolParam(name string, field func(*Filter) **bool) filterParam {
+	return filterParam{
+		name: name,
+		parse: func(f *Filter, v string, _ time.Time) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			*field(f) = &b
+			return nil
+		},
+		format: func(f *Filter) string {
+			if b := *field(f); b != nil {
+				return strconv.FormatBool(*b)
+			}
+			return ""
+		},
+	}
+}
+
+func timeParam(name string, field func(*Filter) *time.Time) filterParam {
+	return filterParam{
+		name: name,
+		parse: func(f *Filter, v string, now time.Time) error {
+			t, err := parseTime(v, now)
+			if err != nil {
+				return err
+			}
+			*field(f) = t
+			return nil
+		},
+		format: func(f *Filter) string {
+			if t := *field(f); !t.IsZero() {
+				return t.Format(time.RFC3339Nano)
+			}
+			return ""
+		},
+	}
+}
+
+// parseTime reads an RFC 3339 timestamp, or a duration such as "1h"
+// meaning that long before now
+func parseTime(v string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// IsFilterParam reports whether name is a filter's query parameter
+func IsFilterParam(name string) bool {
+	for _, p := range filterParams {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFilterQuery builds a filter from query parameters, reading the
+// first value of each. Durations such as "1h" in before and after count
+// back from now.
+func ParseFilterQuery(q url.Values, now time.Time) (*Filter, error) {
+	filter := &Filter{}
+	for _, p := range filterParams {
+		if v := q.Get(p.name); v != "" {
+			if err := p.parse(filter, v, now); err != nil {
+				return nil, fmt.Errorf("invalid %s value %q", p.name, v)
+			}
+		}
+	}
+	return filter, nil
+}
+
+// Query encodes the filter as query parameters
+func (f *Filter) Query() url.Values {
+	q := url.Values{}
+	for _, p := range filterParams {
+		if v := p.format(f); v != "" {
+			q.Set(p.name, v)
+		}
+	}
+	return q
+}
@@ -2,22 +2,32 @@ package storage
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/search"
 )
 
+// ErrNotFound is returned for an email ID that is not stored
+var ErrNotFound = errors.New("email not found")
+
 // Storage interface defines email storage operations
 type Storage interface {
 	Save(email *models.Email) error
 	Get(id string) (*models.Email, error)
 	List() ([]*models.Email, error)
+	Update(id string, update *models.EmailUpdate) (*models.Email, error)
+	UpdateMany(ids []string, update *models.EmailUpdate) ([]string, error) // returns the IDs that were stored
 	Delete(id string) error
+	DeleteMany(ids []string) ([]string, error)  // returns the IDs that were removed
+	DeleteMatching(filter *Filter) (int, error) // returns how many were removed
 	Clear() error
 	Stats() *models.Stats
+	Threads() ([]*models.Thread, error) // most recently active first
+	Search(query *search.Query) ([]search.Hit, error)
 }
 
 // MemoryStorage implements in-memory email storage
@@ -27,6 +37,8 @@ type MemoryStorage struct {
 	emailOrder    []string
 	maxEmails     int
 	serverStarted time.Time
+	threads       []*models.Thread // thread index, nil when stale
+	index         *search.Index
 }
 
 // NewMemoryStorage creates a new in-memory storage
@@ -36,6 +48,7 @@ func NewMemoryStorage(maxEmails int, serverStarted time.Time) *MemoryStorage {
 		emailOrder:    make([]string, 0),
 		maxEmails:     maxEmails,
 		serverStarted: serverStarted,
+		index:         search.New(),
 	}
 }
 
@@ -50,11 +63,14 @@ func (s *MemoryStorage) Save(email *models.Email) error {
 			oldestID := s.emailOrder[0]
 			delete(s.emails, oldestID)
 			s.emailOrder = s.emailOrder[1:]
+			s.index.Remove(oldestID)
 		}
 	}
 
 	s.emails[email.ID] = email
 	s.emailOrder = append(s.emailOrder, email.ID)
+	s.threads = nil
+	s.index.Add(email)
 	return nil
 }
 
@@ -64,7 +80,7 @@ func (s *MemoryStorage) Get(id string) (*models.Email, error) {
 
 	email, exists := s.emails[id]
 	if !exists {
-		return nil, fmt.Errorf("email not found")
+		return nil, ErrNotFound
 	}
 	return email, nil
 }
@@ -83,15 +99,51 @@ func (s *MemoryStorage) List() ([]*models.Email, error) {
 	return emails, nil
 }
 
+// Update stores a changed copy of an email, leaving copies already handed
+// out untouched
+func (s *MemoryStorage) Update(id string, update *models.EmailUpdate) (*models.Email, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	email, exists := s.emails[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	updated := applyUpdate(email, update)
+	s.emails[id] = updated
+	s.threads = nil
+	return updated, nil
+}
+
+// UpdateMany applies one update to every stored email among ids
+func (s *MemoryStorage) UpdateMany(ids []string, update *models.EmailUpdate) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated := []string{}
+	for _, id := range ids {
+		if email, exists := s.emails[id]; exists {
+			s.emails[id] = applyUpdate(email, update)
+			updated = append(updated, id)
+		}
+	}
+	if len(updated) > 0 {
+		s.threads = nil
+	}
+	return updated, nil
+}
+
 func (s *MemoryStorage) Delete(id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, exists := s.emails[id]; !exists {
-		return fmt.Errorf("email not found")
+		return ErrNotFound
 	}
 
 	delete(s.emails, id)
+	s.index.Remove(id)
 
 	// Remove from order slice
 	for i, eid := range s.emailOrder {
@@ -100,16 +152,69 @@ func (s *MemoryStorage) Delete(id string) error {
 			break
 		}
 	}
+	s.threads = nil
 
 	return nil
 }
 
+// DeleteMany removes every stored email among ids
+func (s *MemoryStorage) DeleteMany(ids []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := []string{}
+	for _, id := range ids {
+		if _, exists := s.emails[id]; exists {
+			delete(s.emails, id)
+			s.index.Remove(id)
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+
+	kept := make([]string, 0, len(s.emailOrder))
+	for _, id := range s.emailOrder {
+		if _, exists := s.emails[id]; exists {
+			kept = append(kept, id)
+		}
+	}
+	s.emailOrder = kept
+	s.threads = nil
+	return removed, nil
+}
+
+func (s *MemoryStorage) DeleteMatching(filter *Filter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := make([]string, 0, len(s.emailOrder))
+	removed := 0
+	for _, id := range s.emailOrder {
+		if email, exists := s.emails[id]; exists && filter.Match(email) {
+			delete(s.emails, id)
+			s.index.Remove(id)
+			removed++
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.emailOrder = kept
+	if removed > 0 {
+		s.threads = nil
+	}
+	return removed, nil
+}
+
 func (s *MemoryStorage) Clear() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.emails = make(map[string]*models.Email)
 	s.emailOrder = make([]string, 0)
+	s.threads = nil
+	s.index.Reset()
 	return nil
 }
 
@@ -119,12 +224,19 @@ func (s *MemoryStorage) Stats() *models.Stats {
 
 	var totalSize int64
 	var lastEmailAt time.Time
+	var unread, flagged int
 
 	for _, email := range s.emails {
 		totalSize += email.Size
 		if email.ReceivedAt.After(lastEmailAt) {
 			lastEmailAt = email.ReceivedAt
 		}
+		if !email.Seen {
+			unread++
+		}
+		if email.Flagged {
+			flagged++
+		}
 	}
 
 	return &models.Stats{
@@ -132,9 +244,32 @@ func (s *MemoryStorage) Stats() *models.Stats {
 		TotalSize:     totalSize,
 		LastEmailAt:   lastEmailAt,
 		ServerStarted: s.serverStarted,
+		UnreadEmails:  unread,
+		FlaggedEmails: flagged,
 	}
 }
 
+// Threads returns the thread index, rebuilding it after changes
+func (s *MemoryStorage) Threads() ([]*models.Thread, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.threads == nil {
+		emails := make([]*models.Email, 0, len(s.emails))
+		for _, id := range s.emailOrder {
+			emails = append(emails, s.emails[id])
+		}
+		s.threads = BuildThreads(emails)
+	}
+	return s.threads, nil
+}
+
+// Search runs a full-text query against the index kept up to date by
+// Save and Delete
+func (s *MemoryStorage) Search(query *search.Query) ([]search.Hit, error) {
+	return s.index.Search(query), nil
+}
+
 // FileStorage implements file-based email storage
 type FileStorage struct {
 	*MemoryStorage
@@ -160,21 +295,53 @@ func (fs *FileStorage) Save(email *models.Email) error {
 	if err := fs.MemoryStorage.Save(email); err != nil {
 		return err
 	}
-	return fs.persist()
+	return fs.persistAll()
+}
+
+func (fs *FileStorage) Update(id string, update *models.EmailUpdate) (*models.Email, error) {
+	email, err := fs.MemoryStorage.Update(id, update)
+	if err != nil {
+		return nil, err
+	}
+	return email, fs.persist()
+}
+
+func (fs *FileStorage) UpdateMany(ids []string, update *models.EmailUpdate) ([]string, error) {
+	updated, err := fs.MemoryStorage.UpdateMany(ids, update)
+	if err != nil || len(updated) == 0 {
+		return updated, err
+	}
+	return updated, fs.persist()
 }
 
 func (fs *FileStorage) Delete(id string) error {
 	if err := fs.MemoryStorage.Delete(id); err != nil {
 		return err
 	}
-	return fs.persist()
+	return fs.persistAll()
+}
+
+func (fs *FileStorage) DeleteMany(ids []string) ([]string, error) {
+	removed, err := fs.MemoryStorage.DeleteMany(ids)
+	if err != nil || len(removed) == 0 {
+		return removed, err
+	}
+	return removed, fs.persistAll()
+}
+
+func (fs *FileStorage) DeleteMatching(filter *Filter) (int, error) {
+	removed, err := fs.MemoryStorage.DeleteMatching(filter)
+	if err != nil || removed == 0 {
+		return removed, err
+	}
+	return removed, fs.persistAll()
 }
 
 func (fs *FileStorage) Clear() error {
 	if err := fs.MemoryStorage.Clear(); err != nil {
 		return err
 	}
-	return fs.persist()
+	return fs.persistAll()
 }
 
 func (fs *FileStorage) load() error {
@@ -196,7 +363,41 @@ func (fs *FileStorage) load() error {
 		fs.emailOrder = append(fs.emailOrder, email.ID)
 	}
 
-	return nil
+	// Reuse the saved search index unless it is missing or out of date
+	if index, err := search.Load(fs.indexFile()); err == nil && indexCovers(index, emails) {
+		fs.index = index
+		return nil
+	}
+	for _, email := range emails {
+		fs.index.Add(email)
+	}
+	return fs.index.Save(fs.indexFile())
+}
+
+// indexCovers reports whether index holds exactly the given emails
+func indexCovers(index *search.Index, emails []*models.Email) bool {
+	if index.Len() != len(emails) {
+		return false
+	}
+	for _, email := range emails {
+		if !index.Has(email.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexFile is where the search index is saved, next to the emails
+func (fs *FileStorage) indexFile() string {
+	return fs.filename + ".index"
+}
+
+// persistAll saves the emails and the search index
+func (fs *FileStorage) persistAll() error {
+	if err := fs.persist(); err != nil {
+		return err
+	}
+	return fs.index.Save(fs.indexFile())
 }
 
 func (fs *FileStorage) persist() error {
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// container is a node of the thread tree. A container without an email
+// stands for a message that is referenced but not stored.
+type container struct {
+	email    *models.Email
+	parent   *container
+	children []*container
+}
+
+// hasDescendant reports whether c is d or one of d's ancestors
+func (c *container) hasDescendant(d *container) bool {
+	for ; d != nil; d = d.parent {
+		if d == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *container) setParent(parent *container) {
+	if c.parent != nil {
+		siblings := c.parent.children
+		for i, child := range siblings {
+			if child == c {
+				c.parent.children = append(siblings[:i], siblings[i+1:]...)
+				break
+			}
+		}
+	}
+	c.parent = parent
+	if parent != nil {
+		parent.children = append(parent.children, c)
+	}
+}
+
+// earliest is when the first stored message of a subtree arrived
+func (c *container) earliest() time.Time {
+	var t time.Time
+	if c.email != nil {
+		t = c.email.ReceivedAt
+	}
+	for _, child := range c.children {
+		if ct := child.earliest(); !ct.IsZero() && (t.IsZero() || ct.Before(t)) {
+			t = ct
+		}
+	}
+	return t
+}
+
+// replyPrefix matches the reply and forward markers that subject
+// threading ignores, such as "Re:", "RE[2]:" and "Fwd:"
+var replyPrefix = regexp.MustCompile(`(?i)^\s*(re|aw|fwd?)(\[\d+\])?\s*:\s*`)
+
+// baseSubject strips reply and forward markers from a subject and reports
+// whether there were any
+func baseSubject(subject string) (string, bool) {
+	reply := false
+	for {
+		loc := replyPrefix.FindStringIndex(subject)
+		if loc == nil {
+			break
+		}
+		subject = subject[loc[1]:]
+		reply = true
+	}
+	return strings.TrimSpace(subject), reply
+}
+
+// BuildThreads groups emails into threads with the JWZ algorithm
+// (https://www.jwz.org/doc/threading.html). Messages are linked by their
+// References and In-Reply-To headers; a reply lacking both joins the
+// thread with the same base subject. Threads are returned most recently
+// active first.
+func BuildThreads(emails []*models.Email) []*models.Thread {
+	// Oldest first, so the earliest copy of a duplicate Message-ID wins
+	sorted := append([]*models.Email(nil), emails...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ReceivedAt.Before(sorted[j].ReceivedAt)
+	})
+
+	byID := map[string]*container{}
+	get := func(id string) *container {
+		c := byID[id]
+		if c == nil {
+			c = &container{}
+			byID[id] = c
+		}
+		return c
+	}
+
+	var all []*container
+	for _, email := range sorted {
+		c := byID[email.MessageID]
+		if email.MessageID == "" || (c != nil && c.email != nil) {
+			c = &container{} // no or duplicate Message-ID
+		} else {
+			c = get(email.MessageID)
+		}
+		c.email = email
+		all = append(all, c)
+
+		refs := email.References
+		if email.InReplyTo != "" && (len(refs) == 0 || refs[len(refs)-1] != email.InReplyTo) {
+			refs = append(append([]string(nil), refs...), email.InReplyTo)
+		}
+
+		// Link the references to each other, keeping existing links
+		var prev *container
+		for _, ref := range refs {
+			r := get(ref)
+			if prev != nil && r.parent == nil && !r.hasDescendant(prev) {
+				r.setParent(prev)
+			}
+			prev = r
+		}
+
+		// The last reference is this message's parent
+		if prev != nil && !c.hasDescendant(prev) {
+			c.setParent(prev)
+		}
+	}
+	for _, c := range byID {
+		if c.email == nil {
+			all = append(all, c)
+		}
+	}
+
+	var roots []*container
+	for _, c := range all {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+	roots = pruneEmpty(roots)
+
+	// Subject fallback: a reply without threading headers joins the
+	// thread its base subject came from
+	sort.SliceStable(roots, func(i, j int) bool {
+		return roots[i].earliest().Before(roots[j].earliest())
+	})
+	bySubject := map[string]*container{}
+	var threads []*container
+	for _, root := range roots {
+		subject, reply := baseSubject(rootSubject(root))
+		key := strings.ToLower(subject)
+		if target := bySubject[key]; target != nil && reply && key != "" &&
+			root.email != nil && root.email.InReplyTo == "" && len(root.email.References) == 0 {
+			root.setParent(target)
+			continue
+		}
+		if bySubject[key] == nil {
+			bySubject[key] = root
+		}
+		threads = append(threads, root)
+	}
+
+	result := make([]*models.Thread, 0, len(threads))
+	for _, root := range threads {
+		result = append(result, newThread(root))
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].LastAt.After(result[j].LastAt)
+	})
+	return result
+}
+
+// pruneEmpty drops containers for missing messages, promoting their
+// children. A missing root keeps its place if it holds several threads.
+func pruneEmpty(roots []*container) []*container {
+	var pruned []*container
+	for _, root := range roots {
+		pruneChildren(root)
+		switch {
+		case root.email != nil:
+			pruned = append(pruned, root)
+		case len(root.children) == 1:
+			child := root.children[0]
+			child.parent = nil
+			pruned = append(pruned, child)
+		case len(root.children) > 1:
+			pruned = append(pruned, root)
+		}
+	}
+	return pruned
+}
+
+func pruneChildren(c *container) {
+	var children []*container
+	for _, child := range c.children {
+		pruneChildren(child)
+		if child.email != nil {
+			children = append(children, child)
+			continue
+		}
+		for _, grandchild := range child.children {
+			grandchild.parent = c
+			children = append(children, grandchild)
+		}
+	}
+	c.children = children
+}
+
+// rootSubject is the subject of a thread's root, or of its first stored
+// message when the root is missing
+func rootSubject(c *container) string {
+	if c.email != nil {
+		return c.email.Subject
+	}
+	var first *models.Email
+	for _, child := range c.children {
+		if child.email != nil && (first == nil || child.email.ReceivedAt.Before(first.ReceivedAt)) {
+			first = child.email
+		}
+	}
+	if first == nil {
+		return ""
+	}
+	return first.Subject
+}
+
+// newThread walks a thread tree depth-first, replies in arrival order
+func newThread(root *container) *models.Thread {
+	subject, _ := baseSubject(rootSubject(root))
+	thread := &models.Thread{Subject: subject, Participants: []string{}}
+	seen := map[string]bool{}
+
+	var walk func(c *container, parent *models.Email, depth int)
+	walk = func(c *container, parent *models.Email, depth int) {
+		if email := c.email; email != nil {
+			msg := models.ThreadMessage{
+				EmailID:    email.ID,
+				MessageID:  email.MessageID,
+				Depth:      depth,
+				From:       email.From,
+				Subject:    email.Subject,
+				ReceivedAt: email.ReceivedAt,
+				Seen:       email.Seen,
+			}
+			if parent != nil {
+				msg.ParentID = parent.ID
+			}
+			thread.Messages = append(thread.Messages, msg)
+
+			if !email.Seen {
+				thread.UnreadCount++
+			}
+			if thread.FirstAt.IsZero() || email.ReceivedAt.Before(thread.FirstAt) {
+				thread.FirstAt = email.ReceivedAt
+				thread.ID = email.ID
+			}
+			if email.ReceivedAt.After(thread.LastAt) {
+				thread.LastAt = email.ReceivedAt
+			}
+			for _, addr := range append([]string{email.From}, email.To...) {
+				if key := strings.ToLower(addr); addr != "" && !seen[key] {
+					seen[key] = true
+					thread.Participants = append(thread.Participants, addr)
+				}
+			}
+			parent, depth = email, depth+1
+		}
+
+		children := append([]*container(nil), c.children...)
+		sort.SliceStable(children, func(i, j int) bool {
+			return children[i].earliest().Before(children[j].earliest())
+		})
+		for _, child := range children {
+			walk(child, parent, depth)
+		}
+	}
+	walk(root, nil, 0)
+
+	thread.MessageCount = len(thread.Messages)
+	return thread
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"strings"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+)
+
+// applyUpdate returns a copy of email with update applied. Tags are
+// trimmed and deduplicated, ignoring case.
+func applyUpdate(email *models.Email, update *models.EmailUpdate) *models.Email {
+	updated := *email
+
+	if update.Seen != nil {
+		updated.Seen = *update.Seen
+	}
+	if update.Flagged != nil {
+		updated.Flagged = *update.Flagged
+	}
+	if update.Notes != nil {
+		updated.Notes = *update.Notes
+	}
+
+	tags := email.Tags
+	if update.Tags != nil {
+		tags = *update.Tags
+	}
+	var result []string
+	for _, tag := range append(append([]string(nil), tags...), update.AddTags...) {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !hasTag(result, tag) && !hasTag(update.RemoveTags, tag) {
+			result = append(result, tag)
+		}
+	}
+	updated.Tags = result
+
+	return &updated
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/baliboy20/smtp_server_go/internal/analysis"
+)
+
+// Analysis and extraction types shared with the server
+type (
+	Analysis  = analysis.Report
+	Links     = analysis.Links
+	Extractor = analysis.Extractor
+	Extracted = analysis.Extracted
+)
+
+// SpamResult is a spam report with its SpamAssassin-style text
+type SpamResult struct {
+	EmailID string `json:"email_id"`
+	*SpamReport
+	Report string `json:"report"`
+}
+
+// Extraction is what extractors found in an email
+type Extraction struct {
+	EmailID    string                `json:"email_id"`
+	From       string                `json:"from"`
+	To         []string              `json:"to"`
+	Subject    string                `json:"subject"`
+	ReceivedAt time.Time             `json:"received_at"`
+	Results    map[string]*Extracted `json:"results"`
+}
+
+// Value returns the first value an extractor found, or ""
+func (e *Extraction) Value(name string) string {
+	if r := e.Results[name]; r != nil {
+		return r.Value
+	}
+	return ""
+}
+
+// Analyze reports on the links, images and client support of an email's
+// HTML
+func (c *Client) Analyze(ctx context.Context, id string) (*Analysis, error) {
+	var report Analysis
+	if err := c.getJSON(ctx, "/api/emails/"+url.PathEscape(id)+"/analysis", nil, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Links returns the links, verification links and one-time codes of an
+// email
+func (c *Client) Links(ctx context.Context, id string) (*Links, error) {
+	var links Links
+	if err := c.getJSON(ctx, "/api/emails/"+url.PathEscape(id)+"/links", nil, &links); err != nil {
+		return nil, err
+	}
+	return &links, nil
+}
+
+// Spam scores an email on the server's spam heuristics
+func (c *Client) Spam(ctx context.Context, id string) (*SpamResult, error) {
+	var result SpamResult
+	if err := c.getJSON(ctx, "/api/emails/"+url.PathEscape(id)+"/spam", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Extract runs extractors on an email. Without any, the built-in otp and
+// url extractors run.
+func (c *Client) Extract(ctx context.Context, id string, extractors ...*Extractor) (*Extraction, error) {
+	return c.extract(ctx, "/api/emails/"+url.PathEscape(id)+"/extract", url.Values{}, extractors)
+}
+
+// ExtractLatest runs extractors on the newest email matching a filter,
+// waiting up to wait for one to arrive
+func (c *Client) ExtractLatest(ctx context.Context, filter *Filter, wait time.Duration, extractors ...*Extractor) (*Extraction, error) {
+	q := filterQuery(filter)
+	if wait > 0 {
+		q.Set("wait", wait.String())
+	}
+	return c.extract(ctx, "/api/emails/latest/extract", q, extractors)
+}
+
+func (c *Client) extract(ctx context.Context, path string, q url.Values, extractors []*Extractor) (*Extraction, error) {
+	var result Extraction
+	var err error
+	if len(extractors) == 0 {
+		err = c.getJSON(ctx, path, q, &result)
+	} else {
+		body := struct {
+			Extractors []*Extractor `json:"extractors"`
+		}{extractors}
+		err = c.doJSON(ctx, http.MethodPost, path, q, body, &result)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
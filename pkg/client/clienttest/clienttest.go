@@ -0,0 +1,123 @@
+// Package clienttest runs the SMTP and API servers in-process on random
+// local ports, for tests written against pkg/client
+package clienttest
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	netsmtp "net/smtp"
+	"testing"
+
+	"github.com/baliboy20/smtp_server_go/internal/api"
+	"github.com/baliboy20/smtp_server_go/internal/config"
+	"github.com/baliboy20/smtp_server_go/internal/smtp"
+	"github.com/baliboy20/smtp_server_go/internal/storage"
+	"github.com/baliboy20/smtp_server_go/pkg/client"
+)
+
+// Config is the server configuration options may change
+type Config = config.Config
+
+// Server is a running SMTP and API server
+type Server struct {
+	SMTPAddr string         // host:port of the SMTP server
+	URL      string         // base URL of the API
+	Client   *client.Client // client for the API, with the API key if one is set
+	Config   *Config
+
+	smtp *smtp.Server
+	api  *httptest.Server
+}
+
+// NewServer starts a server that stops when the test ends. Options adjust
+// the configuration before the server starts.
+func NewServer(t testing.TB, opts ...func(*Config)) *Server {
+	t.Helper()
+	s, err := Start(opts...)
+	if err != nil {
+		t.Fatalf("clienttest: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Start starts a server outside a test; call Close to stop it. The
+// configuration starts from the environment, as the server's does, but
+// always uses memory storage, no rate limit and no rules, response or
+// pipeline files.
+func Start(opts ...func(*Config)) (*Server, error) {
+	cfg := config.LoadConfig()
+	cfg.SMTPHost, cfg.APIHost = "127.0.0.1", "127.0.0.1"
+	cfg.StorageType = "memory"
+	cfg.RateLimit = 0
+	cfg.RulesFile, cfg.ResponsesFile, cfg.PipelineFile = "", "", ""
+	cfg.EnableIMAP, cfg.EnablePOP3 = false, false
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	smtpListener, err := net.Listen("tcp", net.JoinHostPort(cfg.SMTPHost, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for SMTP: %w", err)
+	}
+	apiListener, err := net.Listen("tcp", net.JoinHostPort(cfg.APIHost, "0"))
+	if err != nil {
+		smtpListener.Close()
+		return nil, fmt.Errorf("failed to listen for the API: %w", err)
+	}
+	_, cfg.SMTPPort, _ = net.SplitHostPort(smtpListener.Addr().String())
+	_, cfg.APIPort, _ = net.SplitHostPort(apiListener.Addr().String())
+
+	closeListeners := func() {
+		smtpListener.Close()
+		apiListener.Close()
+	}
+	store := storage.NewInstrumentedStorage(storage.NewMemoryStorage(cfg.MaxEmails, cfg.ServerStarted))
+	smtpServer, err := smtp.NewServer(cfg, store)
+	if err != nil {
+		closeListeners()
+		return nil, fmt.Errorf("failed to initialize SMTP server: %w", err)
+	}
+	apiServer, err := api.NewServer(cfg, store, smtpServer)
+	if err != nil {
+		closeListeners()
+		return nil, fmt.Errorf("failed to initialize API server: %w", err)
+	}
+
+	go smtpServer.Serve(smtpListener)
+	ts := httptest.NewUnstartedServer(apiServer.Handler())
+	ts.Listener.Close()
+	ts.Listener = apiListener
+	ts.Start()
+
+	var clientOpts []client.Option
+	if cfg.APIKey != "" {
+		clientOpts = append(clientOpts, client.WithAPIKey(cfg.APIKey))
+	}
+	return &Server{
+		SMTPAddr: smtpListener.Addr().String(),
+		URL:      ts.URL,
+		Client:   client.New(ts.URL, clientOpts...),
+		Config:   cfg,
+		smtp:     smtpServer,
+		api:      ts,
+	}, nil
+}
+
+// Send delivers a raw message over SMTP, authenticating when the server
+// requires it
+func (s *Server) Send(from string, to []string, msg []byte) error {
+	var auth netsmtp.Auth
+	if s.Config.EnableAuth && s.Config.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(s.SMTPAddr)
+		auth = netsmtp.PlainAuth("", s.Config.SMTPUsername, s.Config.SMTPPassword, host)
+	}
+	return netsmtp.SendMail(s.SMTPAddr, auth, from, to, msg)
+}
+
+// Close stops the servers
+func (s *Server) Close() {
+	s.smtp.Stop()
+	s.api.Close()
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxWait is the longest wait the server accepts in one request
+const maxWait = 5 * time.Minute
+
+// BulkRequest applies one action to emails chosen by ID or by filter
+type BulkRequest struct {
+	Action string   `json:"action"` // mark-read, mark-unread, flag, unflag, tag, untag or delete
+	IDs    []string `json:"ids,omitempty"`
+	Filter *Filter  `json:"filter,omitempty"`
+	Tags   []string `json:"tags,omitempty"` // for tag and untag
+}
+
+// BulkResult reports which emails a bulk action changed
+type BulkResult struct {
+	Action   string   `json:"action"`
+	IDs      []string `json:"ids"`
+	Count    int      `json:"count"`
+	NotFound []string `json:"not_found"`
+}
+
+// ExportOptions control GET /api/emails/{id}/raw
+type ExportOptions struct {
+	Sign             bool     // add a DKIM signature
+	Canonicalization string   // e.g. "relaxed/relaxed"; the server's default when empty
+	Headers          []string // headers to sign; the server's default when empty
+}
+
+// DSNRequest asks for a delivery status notification about an email
+type DSNRequest struct {
+	Action     string   `json:"action,omitempty"` // failed (default), delayed, delivered, relayed or expanded
+	Recipients []string `json:"recipients,omitempty"`
+	Status     string   `json:"status,omitempty"`
+	Diagnostic string   `json:"diagnostic,omitempty"`
+	Return     string   `json:"return,omitempty"` // FULL or HDRS
+	Force      bool     `json:"force,omitempty"`
+	WebhookURL string   `json:"webhook_url,omitempty"`
+}
+
+// ListEmails returns the emails matching a filter; nil lists them all
+func (c *Client) ListEmails(ctx context.Context, filter *Filter) ([]*Email, error) {
+	var resp struct {
+		Emails []*Email `json:"emails"`
+	}
+	if err := c.getJSON(ctx, "/api/emails", filterQuery(filter), &resp); err != nil {
+		return nil, err
+	}
+	return resp.Emails, nil
+}
+
+// GetEmail returns one email
+func (c *Client) GetEmail(ctx context.Context, id string) (*Email, error) {
+	var email Email
+	if err := c.getJSON(ctx, "/api/emails/"+url.PathEscape(id), nil, &email); err != nil {
+		return nil, err
+	}
+	return &email, nil
+}
+
+// UpdateEmail changes the seen, flagged, tags and notes state of an email
+func (c *Client) UpdateEmail(ctx context.Context, id string, update *EmailUpdate) (*Email, error) {
+	var email Email
+	if err := c.doJSON(ctx, http.MethodPatch, "/api/emails/"+url.PathEscape(id), nil, update, &email); err != nil {
+		return nil, err
+	}
+	return &email, nil
+}
+
+// Bulk applies one action to many emails
+func (c *Client) Bulk(ctx context.Context, req BulkRequest) (*BulkResult, error) {
+	var result BulkResult
+	if err := c.doJSON(ctx, http.MethodPost, "/api/emails/bulk", nil, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DeleteEmail deletes one email
+func (c *Client) DeleteEmail(ctx context.Context, id string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/emails/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// DeleteEmails deletes the emails matching a filter and returns how many
+// there were. Use ClearEmails to delete everything.
+func (c *Client) DeleteEmails(ctx context.Context, filter *Filter) (int, error) {
+	q := filterQuery(filter)
+	if len(q) == 0 {
+		return 0, errors.New("client: empty filter; use ClearEmails to delete every email")
+	}
+	var resp message
+	if err := c.doJSON(ctx, http.MethodDelete, "/api/emails", q, nil, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// ClearEmails deletes every email
+func (c *Client) ClearEmails(ctx context.Context) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/emails", nil, nil, nil)
+}
+
+// Transcript returns the SMTP dialogue that delivered an email
+func (c *Client) Transcript(ctx context.Context, id string) (*Transcript, error) {
+	var t Transcript
+	if err := c.getJSON(ctx, "/api/emails/"+url.PathEscape(id)+"/transcript", nil, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RawEmail returns an email as .eml, optionally DKIM signed
+func (c *Client) RawEmail(ctx context.Context, id string, opts *ExportOptions) ([]byte, error) {
+	q := url.Values{}
+	if opts != nil {
+		if opts.Sign {
+			q.Set("sign", "true")
+		}
+		setSignOptions(q, opts.Canonicalization, opts.Headers)
+	}
+	return c.doRaw(ctx, http.MethodGet, "/api/emails/"+url.PathEscape(id)+"/raw", q, nil, "")
+}
+
+// CreateDSN generates a delivery status notification about an email. It
+// returns the stored notification, or the one posted to the webhook. The
+// email is nil when a rule deleted the notification.
+func (c *Client) CreateDSN(ctx context.Context, id string, req DSNRequest) (*Email, error) {
+	var email Email
+	if err := c.doJSON(ctx, http.MethodPost, "/api/emails/"+url.PathEscape(id)+"/dsn", nil, req, &email); err != nil {
+		return nil, err
+	}
+	if email.ID == "" {
+		return nil, nil
+	}
+	return &email, nil
+}
+
+// LatestEmail returns the newest email matching a filter. With a wait
+// (up to 5 minutes) the server waits that long for one to arrive. It
+// returns an error matching ErrNotFound when there is none.
+func (c *Client) LatestEmail(ctx context.Context, filter *Filter, wait time.Duration) (*Email, error) {
+	q := filterQuery(filter)
+	if wait > 0 {
+		q.Set("wait", wait.String())
+	}
+	var email Email
+	if err := c.getJSON(ctx, "/api/emails/latest", q, &email); err != nil {
+		return nil, err
+	}
+	return &email, nil
+}
+
+// WaitForEmail waits for an email matching a filter, returning the
+// newest. It gives up when ctx is done, so give ctx a deadline. Combine it
+// with Filter.After to skip emails that were already there.
+func (c *Client) WaitForEmail(ctx context.Context, filter *Filter) (*Email, error) {
+	for {
+		wait := maxWait
+		if deadline, ok := ctx.Deadline(); ok {
+			if wait = time.Until(deadline).Truncate(time.Millisecond); wait > maxWait {
+				wait = maxWait
+			}
+			if wait <= 0 {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+		}
+
+		email, err := c.LatestEmail(ctx, filter, wait)
+		switch {
+		case err == nil:
+			return email, nil
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case !errors.Is(err, ErrNotFound):
+			return nil, err
+		}
+	}
+}
+
+// setSignOptions adds the canonicalization and headers parameters of the
+// DKIM signing endpoints
+func setSignOptions(q url.Values, canonicalization string, headers []string) {
+	if canonicalization != "" {
+		q.Set("canonicalization", canonicalization)
+	}
+	if len(headers) > 0 {
+		q.Set("headers", strings.Join(headers, ","))
+	}
+}
+
+// queryInt sets an integer parameter unless it is zero
+func queryInt(q url.Values, name string, value int) {
+	if value != 0 {
+		q.Set(name, strconv.Itoa(value))
+	}
+}
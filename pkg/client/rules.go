@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/baliboy20/smtp_server_go/internal/models"
+	"github.com/baliboy20/smtp_server_go/internal/rules"
+)
+
+// Rule and response types shared with the server
+type (
+	RuleResult    = rules.Result
+	GreylistEntry = models.GreylistEntry
+)
+
+// RuleTest evaluates a rule, or every saved rule when Rule is nil, against
+// an email given inline or by ID
+type RuleTest struct {
+	Rule    *Rule  `json:"rule,omitempty"`
+	EmailID string `json:"email_id,omitempty"`
+	Email   *Email `json:"email,omitempty"`
+}
+
+// Rules returns the tagging, routing and expiry rules
+func (c *Client) Rules(ctx context.Context) ([]Rule, error) {
+	var resp struct {
+		Rules []Rule `json:"rules"`
+	}
+	if err := c.getJSON(ctx, "/api/rules", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Rules, nil
+}
+
+// Rule returns one rule
+func (c *Client) Rule(ctx context.Context, id string) (*Rule, error) {
+	var rule Rule
+	if err := c.getJSON(ctx, "/api/rules/"+url.PathEscape(id), nil, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// CreateRule adds a rule and returns it with its ID
+func (c *Client) CreateRule(ctx context.Context, rule Rule) (*Rule, error) {
+	var created Rule
+	if err := c.doJSON(ctx, http.MethodPost, "/api/rules", nil, rule, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateRule replaces a rule
+func (c *Client) UpdateRule(ctx context.Context, id string, rule Rule) (*Rule, error) {
+	var updated Rule
+	if err := c.doJSON(ctx, http.MethodPut, "/api/rules/"+url.PathEscape(id), nil, rule, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DeleteRule deletes a rule
+func (c *Client) DeleteRule(ctx context.Context, id string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/rules/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// TestRules reports what rules would do to an email, changing nothing
+func (c *Client) TestRules(ctx context.Context, test RuleTest) (*RuleResult, error) {
+	var result RuleResult
+	if err := c.doJSON(ctx, http.MethodPost, "/api/rules/test", nil, test, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Responses returns the scripted SMTP response rules
+func (c *Client) Responses(ctx context.Context) ([]ResponseRule, error) {
+	var resp struct {
+		Responses []ResponseRule `json:"responses"`
+	}
+	if err := c.getJSON(ctx, "/api/responses", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Responses, nil
+}
+
+// Response returns one response rule
+func (c *Client) Response(ctx context.Context, id string) (*ResponseRule, error) {
+	var rule ResponseRule
+	if err := c.getJSON(ctx, "/api/responses/"+url.PathEscape(id), nil, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// CreateResponse adds a response rule and returns it with its ID
+func (c *Client) CreateResponse(ctx context.Context, rule ResponseRule) (*ResponseRule, error) {
+	var created ResponseRule
+	if err := c.doJSON(ctx, http.MethodPost, "/api/responses", nil, rule, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateResponse replaces a response rule
+func (c *Client) UpdateResponse(ctx context.Context, id string, rule ResponseRule) (*ResponseRule, error) {
+	var updated ResponseRule
+	if err := c.doJSON(ctx, http.MethodPut, "/api/responses/"+url.PathEscape(id), nil, rule, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DeleteResponse deletes a response rule
+func (c *Client) DeleteResponse(ctx context.Context, id string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/responses/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// Greylist returns the remembered greylisting triplets
+func (c *Client) Greylist(ctx context.Context) ([]GreylistEntry, error) {
+	var resp struct {
+		Entries []GreylistEntry `json:"entries"`
+	}
+	if err := c.getJSON(ctx, "/api/responses/greylist", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Entries, nil
+}
+
+// ClearGreylist forgets every triplet, so the next attempt is deferred
+// again
+func (c *Client) ClearGreylist(ctx context.Context) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/responses/greylist", nil, nil, nil)
+}
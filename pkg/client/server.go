@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// SignOptions control POST /api/tools/dkim-sign
+type SignOptions struct {
+	Canonicalization string   // e.g. "relaxed/relaxed"; the server's default when empty
+	Headers          []string // headers to sign; the server's default when empty
+}
+
+// Health is the server's health report
+type Health struct {
+	Status        string  `json:"status"`
+	Timestamp     string  `json:"timestamp"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Storage       string  `json:"storage"`
+	SMTPPort      string  `json:"smtp_port"`
+	APIPort       string  `json:"api_port"`
+	TotalEmails   int     `json:"total_emails"`
+}
+
+// Uptime is how long the server has been running
+func (h *Health) Uptime() time.Duration {
+	return time.Duration(h.UptimeSeconds * float64(time.Second))
+}
+
+// Health checks that the server is up; it needs no API key
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var health Health
+	if err := c.getJSON(ctx, "/health", nil, &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// Stats returns email counts and sizes
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	var stats Stats
+	if err := c.getJSON(ctx, "/api/stats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// AddWebhook registers a URL to be called with every new email
+func (c *Client) AddWebhook(ctx context.Context, webhook Webhook) error {
+	return c.doJSON(ctx, http.MethodPost, "/api/webhooks", nil, webhook, nil)
+}
+
+// Chaos returns the fault injection settings
+func (c *Client) Chaos(ctx context.Context) (*ChaosConfig, error) {
+	var cfg ChaosConfig
+	if err := c.getJSON(ctx, "/api/chaos", nil, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// SetChaos replaces the fault injection settings
+func (c *Client) SetChaos(ctx context.Context, cfg ChaosConfig) (*ChaosConfig, error) {
+	var updated ChaosConfig
+	if err := c.doJSON(ctx, http.MethodPut, "/api/chaos", nil, cfg, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// ResetChaos turns fault injection off
+func (c *Client) ResetChaos(ctx context.Context) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/chaos", nil, nil, nil)
+}
+
+// DKIMSign signs a raw message with the server's DKIM key
+func (c *Client) DKIMSign(ctx context.Context, raw []byte, opts *SignOptions) ([]byte, error) {
+	q := url.Values{}
+	if opts != nil {
+		setSignOptions(q, opts.Canonicalization, opts.Headers)
+	}
+	return c.doRaw(ctx, http.MethodPost, "/api/tools/dkim-sign", q, raw, "message/rfc822")
+}
+
+// Metrics returns the Prometheus metrics in text exposition format
+func (c *Client) Metrics(ctx context.Context) ([]byte, error) {
+	return c.doRaw(ctx, http.MethodGet, "/metrics", nil, nil, "")
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"net/url"
+)
+
+// SearchOptions page through search results
+type SearchOptions struct {
+	Limit  int // 1 to 100; 20 when zero
+	Offset int
+}
+
+// SearchResult is one ranked match with highlighted snippets by field
+type SearchResult struct {
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+	Email      *Email            `json:"email"`
+}
+
+// SearchResults is a page of search results
+type SearchResults struct {
+	Results []SearchResult `json:"results"`
+	Count   int            `json:"count"`
+	Total   int            `json:"total"` // matches on every page
+}
+
+// ThreadDetail is a thread with its emails, in thread order
+type ThreadDetail struct {
+	Thread
+	Emails []*Email `json:"emails"`
+}
+
+// Search runs a full-text query such as `from:alice subject:"order 1"`
+func (c *Client) Search(ctx context.Context, query string, opts *SearchOptions) (*SearchResults, error) {
+	q := url.Values{"q": {query}}
+	if opts != nil {
+		queryInt(q, "limit", opts.Limit)
+		queryInt(q, "offset", opts.Offset)
+	}
+	var results SearchResults
+	if err := c.getJSON(ctx, "/api/search", q, &results); err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// Threads returns thread summaries, without their messages, most recently
+// active first
+func (c *Client) Threads(ctx context.Context) ([]Thread, error) {
+	var resp struct {
+		Threads []Thread `json:"threads"`
+	}
+	if err := c.getJSON(ctx, "/api/threads", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Threads, nil
+}
+
+// Thread returns a thread, looked up by its ID or that of any of its
+// emails
+func (c *Client) Thread(ctx context.Context, id string) (*ThreadDetail, error) {
+	var thread ThreadDetail
+	if err := c.getJSON(ctx, "/api/threads/"+url.PathEscape(id), nil, &thread); err != nil {
+		return nil, err
+	}
+	return &thread, nil
+}
+
+// Sessions returns the transcripts of recent SMTP sessions that ended
+// without a message
+func (c *Client) Sessions(ctx context.Context) ([]*Transcript, error) {
+	var resp struct {
+		Sessions []*Transcript `json:"sessions"`
+	}
+	if err := c.getJSON(ctx, "/api/sessions", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Sessions, nil
+}